@@ -0,0 +1,227 @@
+package chord
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type chordAdmin struct {
+	server httpEndpoint
+}
+
+type NodeInfo struct {
+	ID          uint32 `json:"id"`
+	Addr        string `json:"addr"`
+	Online      bool   `json:"online"`
+	SuccListLen int    `json:"succListLen"`
+	Replication int    `json:"replication"`
+	// Namespaces are the configs of the namespaces which differ from the node
+	Namespaces map[string]NamespaceConfig `json:"namespaces,omitempty"`
+}
+
+type FingerInfo struct {
+	Index int    `json:"index"`
+	Start uint32 `json:"start"`
+	ID    uint32 `json:"id"`
+	Addr  string `json:"addr"`
+}
+
+type RoutingInfo struct {
+	Predecessor string       `json:"predecessor"`
+	Fingers     []FingerInfo `json:"fingers"`
+}
+
+type StorageInfo struct {
+	DataKeys   int   `json:"dataKeys"`
+	BackupKeys []int `json:"backupKeys"`
+	// Namespaces are the stats of the primary data by namespace, of the default one under ""
+	Namespaces map[string]NamespaceStats `json:"namespaces"`
+}
+
+type HealthInfo struct {
+	Online          bool   `json:"online"`
+	Successor       string `json:"successor"`
+	SuccReachable   bool   `json:"successorReachable"`
+	HasPredecessor  bool   `json:"hasPredecessor"`
+	StabilizeOK     int64  `json:"stabilizeSuccess"`
+	StabilizeFailed int64  `json:"stabilizeFailure"`
+	// QuotaUsage is the largest fraction of a storage quota in use, zero without quotas
+	QuotaUsage float64 `json:"quotaUsage"`
+	// Full is set once the quota of the primary data is used up, when the node rejects
+	// the writes growing it
+	Full bool `json:"full"`
+	// BackupOverQuota is set while the backups are beyond their quota, which the node
+	// does not refuse the backups for
+	BackupOverQuota bool `json:"backupOverQuota"`
+}
+
+func (n *ChordNode) NodeInfo() NodeInfo {
+	return NodeInfo{
+		ID:          n.Id,
+		Addr:        n.Addr,
+		Online:      n.online.Load(),
+		SuccListLen: n.cfg.SuccListLen,
+		Replication: n.cfg.Replication,
+		Namespaces:  n.cfg.Namespaces,
+	}
+}
+
+// RoutingInfo returns the predecessor and the connected fingers.
+func (n *ChordNode) RoutingInfo() RoutingInfo {
+	var info RoutingInfo
+	n.predecsorLock.RLock()
+	info.Predecessor = n.predecessor.remoteAddr
+	n.predecsorLock.RUnlock()
+	n.fingersLock.RLock()
+	for i := range n.fingers {
+		fin := &n.fingers[i]
+		if !fin.isConnected() {
+			continue
+		}
+		info.Fingers = append(info.Fingers, FingerInfo{i, n.Id + (1 << i), fin.id, fin.remoteAddr})
+	}
+	n.fingersLock.RUnlock()
+	return info
+}
+
+func (n *ChordNode) SuccList() []string {
+	n.succListLock.RLock()
+	defer n.succListLock.RUnlock()
+	return append([]string(nil), n.succList...)
+}
+
+func (n *ChordNode) StorageInfo() StorageInfo {
+	info := StorageInfo{DataKeys: n.data.Len(), Namespaces: n.NamespaceStats()}
+	n.backupDataLock.RLock()
+	for _, backup := range n.backupData {
+		info.BackupKeys = append(info.BackupKeys, backup.Len())
+	}
+	n.backupDataLock.RUnlock()
+	return info
+}
+
+// LocalData returns a copy of the primary data of the node.
+func (n *ChordNode) LocalData() map[string]string {
+	return n.data.Copy()
+}
+
+// Health tells whether the node is online and can reach a successor.
+func (n *ChordNode) Health() HealthInfo {
+	info := HealthInfo{
+		Online:          n.online.Load(),
+		StabilizeOK:     n.metrics.stabilizeOK.Load(),
+		StabilizeFailed: n.metrics.stabilizeFail.Load(),
+		QuotaUsage:      n.quotaUsage(),
+	}
+	info.Full = n.quotaRatio(false) >= 1
+	info.BackupOverQuota = n.quotaRatio(true) > 1
+	if succ := n.getOnlineSucc(); succ != nil {
+		info.Successor = succ.remoteAddr
+		info.SuccReachable = true
+		succ.close()
+	}
+	n.predecsorLock.RLock()
+	info.HasPredecessor = n.predecessor.isConnected()
+	n.predecsorLock.RUnlock()
+	return info
+}
+
+// RefreshFingers fixes all the fingers at once instead of one per FixFingerInterval,
+// and returns the number of fingers which failed.
+func (n *ChordNode) RefreshFingers() int {
+	failed := 0
+	for i := 1; i < ChordM; i++ {
+		if n.fixFinger(i) != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminGet(f func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, f())
+	}
+}
+
+func adminPost(f func(w http.ResponseWriter)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		f(w)
+	}
+}
+
+// AdminHandler serves the state of the node as JSON under /admin/, and the actions
+// stabilize, fix-fingers and quit as POST requests.
+func (n *ChordNode) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/admin/node", adminGet(func() interface{} { return n.NodeInfo() }))
+	mux.Handle("/admin/routing", adminGet(func() interface{} { return n.RoutingInfo() }))
+	mux.Handle("/admin/succlist", adminGet(func() interface{} { return n.SuccList() }))
+	mux.Handle("/admin/storage", adminGet(func() interface{} { return n.StorageInfo() }))
+	mux.HandleFunc("/admin/health", func(w http.ResponseWriter, r *http.Request) {
+		info := n.Health()
+		status := http.StatusOK
+		if !info.Online || !info.SuccReachable {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, info)
+	})
+	mux.Handle("/admin/stabilize", adminPost(func(w http.ResponseWriter) {
+		if !n.online.Load() {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "node is offline"})
+			return
+		}
+		ok := n.stabilize()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": ok, "succList": n.SuccList()})
+	}))
+	mux.Handle("/admin/fix-fingers", adminPost(func(w http.ResponseWriter) {
+		if !n.online.Load() {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "node is offline"})
+			return
+		}
+		failed := n.RefreshFingers()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"failed": failed, "routing": n.RoutingInfo()})
+	}))
+	mux.Handle("/admin/quit", adminPost(func(w http.ResponseWriter) {
+		if !n.online.Load() {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "node is offline"})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "quitting"})
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		// Quit closes the admin server, so it is not done in the handler
+		go n.Quit()
+	}))
+	return mux
+}
+
+// ServeAdmin exposes the admin API on addr until the node quits.
+func (n *ChordNode) ServeAdmin(addr string) error {
+	if err := n.admin.server.serve(n, addr, n.AdminHandler()); err != nil {
+		n.logger.Error(n.Addr, " ServeAdmin: listen error: ", err)
+		return err
+	}
+	return nil
+}
+
+func (n *ChordNode) closeAdmin() {
+	n.admin.server.close()
+}
@@ -0,0 +1,214 @@
+package chord
+
+import (
+	"dht/internal"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KeyResult is the result of one key of GetMany.
+type KeyResult struct {
+	Value string
+	ETag  string
+	Err   error
+}
+
+// groupByOwner finds the owners of keys with about one lookup per owner: the owner found
+// for a key is asked for its predecessor, and the other keys between the two are given
+// to it as well. The keys whose owner cannot be found are in errs.
+func (n *ChordNode) groupByOwner(keys []string, trace TraceContext) (map[string][]string, map[string]error) {
+	type keyID struct {
+		key string
+		id  uint32
+	}
+	pending := make([]keyID, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			pending = append(pending, keyID{key, internal.Str_uint32_sha1(key)})
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].id < pending[j].id })
+	groups := make(map[string][]string)
+	errs := make(map[string]error)
+	for len(pending) > 0 {
+		first := pending[0]
+		pending = pending[1:]
+		owner, err := n.lookup(first.key, trace)
+		if err != nil {
+			n.logger.Error(n.Addr, " groupByOwner: failed in FindSuccessor ", err)
+			errs[first.key] = err
+			continue
+		}
+		groups[owner] = append(groups[owner], first.key)
+		var link chordLink
+		if err := link.Dial(owner, &n.cfg); err != nil {
+			continue
+		}
+		var predAddr string
+		err = link.GetPredecessor(&predAddr)
+		link.close()
+		if err != nil {
+			continue
+		}
+		predID, ownerID := internal.Str_uint32_sha1(predAddr), internal.Str_uint32_sha1(owner)
+		rest := pending[:0]
+		for _, k := range pending {
+			if inRange(predID+1, ownerID+1, k.id) {
+				groups[owner] = append(groups[owner], k.key)
+			} else {
+				rest = append(rest, k)
+			}
+		}
+		pending = rest
+	}
+	return groups, errs
+}
+
+// eachOwner runs f for the keys of every owner in parallel, and sets the error of the
+// keys in errs to that of f, or to the error of dialing the owner.
+func (n *ChordNode) eachOwner(groups map[string][]string, errs map[string]error, f func(link *chordLink, keys []string) error) {
+	var wg sync.WaitGroup
+	var errsLock sync.Mutex
+	for owner, keys := range groups {
+		wg.Add(1)
+		go func(owner string, keys []string) {
+			defer wg.Done()
+			var link chordLink
+			err := link.Dial(owner, &n.cfg)
+			if err == nil {
+				err = f(&link, keys)
+				link.close()
+			}
+			if err != nil {
+				n.logger.Error(n.Addr, " batch: failed on owner ", owner, " ", err)
+			}
+			errsLock.Lock()
+			for _, key := range keys {
+				errs[key] = err
+			}
+			errsLock.Unlock()
+		}(owner, keys)
+	}
+	wg.Wait()
+}
+
+// PutMany puts the pairs with one RPC per owner, and returns the error of every key, nil
+// for the keys put. The values to be chunked are put one by one.
+func (n *ChordNode) PutMany(pairs map[string]string) map[string]error {
+	errs, _ := n.putMany(pairs)
+	return errs
+}
+
+// putMany is PutMany which also returns the ETags of the keys put.
+func (n *ChordNode) putMany(pairs map[string]string) (map[string]error, map[string]string) {
+	sp := n.startSpan("PutMany", TraceContext{})
+	sp.set("chord.keys", len(pairs))
+	defer sp.finish(nil)
+	keys := make([]string, 0, len(pairs))
+	single := make(map[string]error)
+	etags := make(map[string]string, len(pairs))
+	var etagsLock sync.Mutex
+	for key, value := range pairs {
+		if len(value) > n.cfg.ChunkSize || strings.HasPrefix(value, reservedPrefix) {
+			etags[key], single[key] = n.putValue(key, strings.NewReader(value), Precondition{}, sp.context())
+			continue
+		}
+		if err := CheckKey(key); err != nil {
+			single[key] = err
+			continue
+		}
+		if err := n.cfg.checkSize(key, value); err != nil {
+			single[key] = err
+			continue
+		}
+		keys = append(keys, key)
+	}
+	groups, errs := n.groupByOwner(keys, sp.context())
+	for key, err := range single {
+		errs[key] = err
+	}
+	n.eachOwner(groups, errs, func(link *chordLink, keys []string) error {
+		part := make(map[string]string, len(keys))
+		for _, key := range keys {
+			part[key] = pairs[key]
+		}
+		put, err := link.PutDataBatch(part, false, 0, sp.context())
+		etagsLock.Lock()
+		for k, etag := range put {
+			etags[k] = etag
+		}
+		etagsLock.Unlock()
+		return err
+	})
+	return errs, etags
+}
+
+// GetMany gets the keys with one RPC per owner. The keys the owners do not have fail
+// with ErrNotFound.
+func (n *ChordNode) GetMany(keys []string) map[string]KeyResult {
+	sp := n.startSpan("GetMany", TraceContext{})
+	sp.set("chord.keys", len(keys))
+	defer sp.finish(nil)
+	groups, errs := n.groupByOwner(keys, sp.context())
+	found := make(map[string]string, len(keys))
+	var lock sync.Mutex
+	n.eachOwner(groups, errs, func(link *chordLink, keys []string) error {
+		pairs, err := link.GetDataBatch(keys, sp.context())
+		lock.Lock()
+		for k, v := range pairs {
+			found[k] = v
+		}
+		lock.Unlock()
+		return err
+	})
+	results := make(map[string]KeyResult, len(errs))
+	for key, err := range errs {
+		if stored, ok := found[key]; ok && err == nil {
+			value, err := n.readValue(stored, sp.context())
+			results[key] = KeyResult{Value: value, ETag: storedETag(stored), Err: err}
+		} else if err == nil {
+			results[key] = KeyResult{Err: ErrNotFound}
+		} else {
+			results[key] = KeyResult{Err: err}
+		}
+	}
+	return results
+}
+
+// DeleteMany deletes the keys with one RPC per owner, and returns the error of every key,
+// ErrNotFound for the keys which did not exist.
+func (n *ChordNode) DeleteMany(keys []string) map[string]error {
+	sp := n.startSpan("DeleteMany", TraceContext{})
+	sp.set("chord.keys", len(keys))
+	defer sp.finish(nil)
+	reserved := make(map[string]error)
+	plain := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if err := CheckKey(key); err != nil {
+			reserved[key] = err
+		} else {
+			plain = append(plain, key)
+		}
+	}
+	groups, errs := n.groupByOwner(plain, sp.context())
+	for key, err := range reserved {
+		errs[key] = err
+	}
+	var missing []string
+	var lock sync.Mutex
+	n.eachOwner(groups, errs, func(link *chordLink, keys []string) error {
+		var part []string
+		err := link.DeleteDataBatch(keys, false, 0, sp.context(), &part)
+		lock.Lock()
+		missing = append(missing, part...)
+		lock.Unlock()
+		return err
+	})
+	for _, key := range missing {
+		errs[key] = ErrNotFound
+	}
+	return errs
+}
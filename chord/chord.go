@@ -4,7 +4,6 @@ import (
 	"dht/internal"
 	"net"
 	"net/rpc"
-	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,18 +11,11 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func init() {
-	f, _ := os.Create("dht_chord.log")
-	logrus.SetOutput(f)
-}
-
 const (
-	ChordM            = 32
-	ChordK            = 6
-	ChordTTL          = 50
-	stabilizeInterval = time.Millisecond * 200
-	fixFingerInterval = time.Millisecond * 200
-	fixPredInterval   = time.Millisecond * 200
+	ChordM = 32
+	// default length of the successor list and max hops of FindSuccessor, see Config
+	ChordK   = 6
+	ChordTTL = 50
 )
 
 // inRange judges whether id is in range [start, end) on the circle
@@ -59,15 +51,32 @@ type ChordNode struct {
 	Addr      string
 	curFinger uint16
 	online    atomic.Bool
+	// quit is closed by Quit and ForceQuit to wake the maintenance routines, which are
+	// counted in routines with the serve loop, so that the node is cleared after they stop
+	quit     chan struct{}
+	routines sync.WaitGroup
 
 	listener net.Listener
 	server   *rpc.Server
 
-	data     map[string]string
-	dataLock sync.RWMutex
+	cfg Config
+
+	data Storage
+	// writeLock makes the check of a Precondition and the write to data atomic
+	writeLock sync.Mutex
+	// leaseLock orders the changes of the locks, which wait for the backup
+	leaseLock sync.Mutex
+	chunks    chunkLeases
+	writes    keyWrites
+	scans     keyScans
+	watches   chordWatches
+	topics    chordTopics
 
-	backupData     map[string]string
+	// backupData[i] is the data of the (i+1)-th predecessor
+	backupData     []Storage
 	backupDataLock sync.RWMutex
+	// backupWriteLock makes the merges of the sets and counters into the backups atomic
+	backupWriteLock sync.Mutex
 
 	fingers     [ChordM]chordLink
 	fingersLock sync.RWMutex
@@ -75,55 +84,119 @@ type ChordNode struct {
 	predecessor   chordLink
 	predecsorLock sync.RWMutex
 
-	succList     [ChordK]string
+	succList     []string
 	succListLock sync.RWMutex
 
 	activeConn     map[net.Conn]struct{}
 	activeConnLock sync.Mutex
+
+	stats   internal.Counters
+	metrics chordMetrics
+	admin   chordAdmin
+	gateway chordGateway
+	logger  *logrus.Entry
 }
 
 // local methods
 
-func CreateChordNode(addr string) *ChordNode {
-	return &ChordNode{
+// NewChordNode creates a node tuned by opts, and fails if the resulting config is invalid.
+func NewChordNode(addr string, opts ...Option) (*ChordNode, error) {
+	var c Config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	c.setDefaults()
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	id := internal.Str_uint32_sha1(addr)
+	n := &ChordNode{
 		Addr:       addr,
-		Id:         internal.Str_uint32_sha1(addr),
-		data:       make(map[string]string),
-		backupData: make(map[string]string),
+		Id:         id,
+		cfg:        c,
+		succList:   make([]string, c.SuccListLen),
 		activeConn: make(map[net.Conn]struct{}),
+		logger:     c.newLogger().WithFields(logrus.Fields{"node": addr, "id": id}),
+	}
+	n.resetData()
+	return n, nil
+}
+
+// CreateChordNode is like NewChordNode but panics if the config is invalid.
+func CreateChordNode(addr string, opts ...Option) *ChordNode {
+	n, err := NewChordNode(addr, opts...)
+	if err != nil {
+		panic(err)
 	}
+	return n
+}
+
+func (n *ChordNode) resetData() {
+	n.data = n.newStorage()
+	n.resetBackup()
 }
 
+func (n *ChordNode) resetBackup() {
+	n.backupDataLock.Lock()
+	n.backupData = make([]Storage, n.cfg.Replication)
+	for i := range n.backupData {
+		n.backupData[i] = n.newStorage()
+	}
+	n.backupDataLock.Unlock()
+}
+
+// Clear drops the data and the state of the ring after the node stopped serving. Addr and
+// Id are kept, since the requests still being finished may log them.
 func (n *ChordNode) Clear() {
-	n.Id = 0
-	n.Addr = ""
 	n.curFinger = 0
 	n.server = nil
-	n.data = make(map[string]string)
-	n.backupData = make(map[string]string)
-	n.activeConn = make(map[net.Conn]struct{})
+	n.data.DeleteFunc(func(string) bool { return true })
+	n.resetBackup()
+	n.chunks.reset()
+	n.writes.reset()
+	n.watches.reset()
+	n.topics.reset()
 }
 
 func (n *ChordNode) RunRPCServer() {
+	if err := n.listen(); err != nil {
+		return
+	}
+	n.routines.Add(1)
+	n.serve(n.server, n.listener)
+}
+
+func (n *ChordNode) listen() error {
 	n.server = rpc.NewServer()
 	n.server.Register(n)
 	var err error
-	n.listener, err = net.Listen("tcp", n.Addr)
+	n.listener, err = n.cfg.Transport.Listen(n.Addr)
 	if err != nil {
-		logrus.Error(n.Addr, " listen error: ", err)
+		n.logger.Error(n.Addr, " listen error: ", err)
+		return err
 	}
+	n.quit = make(chan struct{})
 	n.online.Store(true)
-	for n.online.Load() {
-		conn, err := n.listener.Accept()
+	return nil
+}
+
+// serve accepts connections until Quit or ForceQuit closes the listener.
+func (n *ChordNode) serve(server *rpc.Server, listener net.Listener) {
+	defer n.routines.Done()
+	for {
+		conn, err := listener.Accept()
 		if err != nil {
-			logrus.Warn(n.Addr, " accpet: ", err)
+			if !n.online.Load() {
+				return
+			}
+			n.logger.Warn(n.Addr, " accpet: ", err)
 			continue
 		}
 		go func(conn net.Conn) {
 			n.activeConnLock.Lock()
 			n.activeConn[conn] = struct{}{}
 			n.activeConnLock.Unlock()
-			n.server.ServeConn(conn)
+			internal.ServeConn(server, conn, n.stats.RecordRPC)
 			n.activeConnLock.Lock()
 			delete(n.activeConn, conn)
 			n.activeConnLock.Unlock()
@@ -131,6 +204,25 @@ func (n *ChordNode) RunRPCServer() {
 	}
 }
 
+// stop makes the node stop accepting connections and waits for the serve loop and the
+// maintenance routines to return, after online is set to false.
+func (n *ChordNode) stop() {
+	if err := n.listener.Close(); err != nil {
+		n.logger.Error(n.Addr, " stop: close listener with error: ", err)
+	}
+	close(n.quit)
+	n.routines.Wait()
+}
+
+// sleep waits for d, or until the node quits, and returns whether the node is online.
+func (n *ChordNode) sleep(d time.Duration) bool {
+	select {
+	case <-n.quit:
+	case <-time.After(d):
+	}
+	return n.online.Load()
+}
+
 func (n *ChordNode) CloseRPCLinks() {
 	n.fingersLock.Lock()
 	for i := 0; i < len(n.fingers); i++ {
@@ -148,70 +240,94 @@ func (n *ChordNode) CloseRPCLinks() {
 }
 
 func (n *ChordNode) maintain() {
+	n.routines.Add(4)
 	go func() {
+		defer n.routines.Done()
 		for n.online.Load() {
-			n.stabilize()
-			time.Sleep(stabilizeInterval)
+			if n.stabilize() {
+				n.metrics.stabilizeOK.Add(1)
+			} else {
+				n.metrics.stabilizeFail.Add(1)
+			}
+			n.sleep(n.cfg.StabilizeInterval)
 		}
 	}()
 	go func() {
+		defer n.routines.Done()
 		for n.online.Load() {
 			n.fixFingers()
-			time.Sleep(fixFingerInterval)
+			n.sleep(n.cfg.FixFingerInterval)
 		}
 	}()
 	go func() {
+		defer n.routines.Done()
 		for n.online.Load() {
 			n.fixPredecessor()
-			time.Sleep(fixPredInterval)
+			n.sleep(n.cfg.FixPredInterval)
+		}
+	}()
+	go func() {
+		defer n.routines.Done()
+		for n.sleep(n.cfg.ChunkGCInterval) {
+			n.collectChunks()
 		}
 	}()
+	if n.cfg.hasKeyTTL() {
+		n.routines.Add(1)
+		go func() {
+			defer n.routines.Done()
+			for n.sleep(nsExpireInterval) {
+				n.expireKeys()
+			}
+		}()
+	}
 }
 
-func (n *ChordNode) stabilize() {
+// stabilize returns whether the successor is confirmed
+func (n *ChordNode) stabilize() bool {
 	succ := n.getOnlineSucc()
 	if succ == nil {
-		logrus.Warn(n.Addr, " stabilize: no online successor ")
-		return
+		n.logger.Warn(n.Addr, " stabilize: no online successor ")
+		return false
 	}
 	var succAddr string
 	err := succ.GetPredecessor(&succAddr)
 	if err != nil {
 		if err.Error() == "no immediate predecessor" {
 			succAddr = succ.remoteAddr
-			logrus.Warn(n.Addr, " stabilize: get possible succ addr failed: ", err, " try original succ")
+			n.logger.Warn(n.Addr, " stabilize: get possible succ addr failed: ", err, " try original succ")
 		} else {
-			logrus.Error(n.Addr, " stabilize: failed to get possible succ")
-			return
+			n.logger.Error(n.Addr, " stabilize: failed to get possible succ")
+			return false
 		}
 	}
 	succID := internal.Str_uint32_sha1(succAddr)
 	// logrus.Infof("%s stabilize: possible succ: %s %d", n.Addr, succAddr, succID)
 	if inRange(n.Id+1, succ.id, succID) {
-		logrus.Infof("%s stabilize: closer succ: %s %d", n.Addr, succAddr, succID)
+		n.logger.Infof("%s stabilize: closer succ: %s %d", n.Addr, succAddr, succID)
 		succ.close()
-		err = succ.Dial(succAddr)
+		err = succ.Dial(succAddr, &n.cfg)
 		if err != nil {
-			logrus.Error(n.Addr, " stabilize: succ dial error: ", err)
-			return
+			n.logger.Error(n.Addr, " stabilize: succ dial error: ", err)
+			return false
 		}
 	} else { // succ remain unchanged
 		succAddr = succ.remoteAddr
 		succID = succ.id
 	}
 	if succ.remoteAddr == n.Addr {
-		logrus.Info(n.Addr, " stabilize: succ is self")
-		return
+		n.logger.Info(n.Addr, " stabilize: succ is self")
+		return true
 	}
 	err = succ.Notify(n.Addr)
 	if err != nil {
-		logrus.Error(n.Addr, " stabilize: notify failed with ", err)
+		n.logger.Error(n.Addr, " stabilize: notify failed with ", err)
 	}
-	var newSuccList [ChordK]string
+	var newSuccList []string
 	err = succ.GetSuccList(&newSuccList)
 	if err != nil {
-		logrus.Error(n.Addr, " stabilize: get succList failed with ", err)
-		return
+		n.logger.Error(n.Addr, " stabilize: get succList failed with ", err)
+		return false
 	}
 	n.fingersLock.Lock()
 	if n.fingers[0].id == succID {
@@ -222,55 +338,86 @@ func (n *ChordNode) stabilize() {
 	}
 	n.fingersLock.Unlock()
 	n.succListLock.Lock()
+	changed := n.succList[0] != succAddr
 	n.succList[0] = succAddr
-	for i := 1; i < ChordK && newSuccList[i-1] != ""; i++ {
+	for i := 1; i < len(n.succList) && i-1 < len(newSuccList) && newSuccList[i-1] != ""; i++ {
+		changed = changed || n.succList[i] != newSuccList[i-1]
 		n.succList[i] = newSuccList[i-1]
 	}
-	logrus.Info(n.Addr, " stabilize: new succ list ", n.succList)
+	if changed {
+		n.metrics.succListChanges.Add(1)
+	}
+	n.logger.Info(n.Addr, " stabilize: new succ list ", n.succList)
 	n.succListLock.Unlock()
+	return true
 }
 
 func (n *ChordNode) fixFingers() {
-	var startID uint32 = n.Id + (1 << n.curFinger)
-	var addr string
-	err := n.FindSuccessor(FindSuccessorRequest{startID, ChordTTL}, &addr)
+	n.fixFinger(int(n.curFinger))
+	n.curFinger = (n.curFinger + 1) % ChordM
+	if n.curFinger == 0 {
+		n.curFinger = 1
+	}
+}
+
+// fixFinger points fingers[i] to the successor of n.Id + 2^i
+func (n *ChordNode) fixFinger(i int) error {
+	var startID uint32 = n.Id + (1 << i)
+	addr, err := n.findSuccessor(startID)
 	if err != nil {
-		logrus.Errorf("%s fixFingers: fialed to find successor of %d: %s", n.Addr, startID, err)
-		return
+		n.logger.Errorf("%s fixFingers: fialed to find successor of %d: %s", n.Addr, startID, err)
+		return err
 	}
-	finger := &n.fingers[n.curFinger]
+	finger := &n.fingers[i]
 	n.fingersLock.Lock()
+	defer n.fingersLock.Unlock()
 	if finger.remoteAddr != addr {
 		finger.close()
-		err := finger.Dial(addr)
+		err := finger.Dial(addr, &n.cfg)
 		if err != nil {
-			logrus.Error(n.Addr, " fixFingers: fail to dial ", err)
+			n.logger.Error(n.Addr, " fixFingers: fail to dial ", err)
+			return err
 		}
 	}
-	n.fingersLock.Unlock()
-	n.curFinger = (n.curFinger + 1) % ChordM
-	if n.curFinger == 0 {
-		n.curFinger = 1
-	}
+	return nil
 }
 
+// fetchBackupData gets the data of the predecessor and, with replication larger than one,
+// its backups of the farther predecessors.
 func (n *ChordNode) fetchBackupData() {
-	newBackup := make(map[string]string)
+	var replicas []map[string]string
 	n.predecsorLock.RLock()
 	defer n.predecsorLock.RUnlock()
 	if !n.predecessor.isConnected() {
-		logrus.Warn(n.Addr, " fetchBackupData: predecessor not connected")
+		n.logger.Warn(n.Addr, " fetchBackupData: predecessor not connected")
 		return
 	}
-	if err := n.predecessor.GetAllData(&newBackup); err != nil {
-		logrus.Error(n.Addr, " fetchBackupData: get backup data from ", n.predecessor.remoteAddr, " failed with ", err)
+	if err := n.predecessor.GetReplicas(n.cfg.Replication, &replicas); err != nil {
+		n.logger.Error(n.Addr, " fetchBackupData: get backup data from ", n.predecessor.remoteAddr, " failed with ", err)
 		return
 	}
+	newBackup := make([]Storage, n.cfg.Replication)
+	for i := range newBackup {
+		newBackup[i] = n.newStorage()
+		if i < len(replicas) {
+			newBackup[i].Merge(replicas[i])
+		}
+	}
 	n.backupDataLock.Lock()
 	n.backupData = newBackup
 	n.backupDataLock.Unlock()
 }
 
+// backupLevel returns the storage of the given backup level, nil if it is out of range
+func (n *ChordNode) backupLevel(level int) Storage {
+	n.backupDataLock.RLock()
+	defer n.backupDataLock.RUnlock()
+	if level < 0 || level >= len(n.backupData) {
+		return nil
+	}
+	return n.backupData[level]
+}
+
 func (n *ChordNode) fixPredecessor() {
 	n.predecsorLock.Lock()
 	defer n.predecsorLock.Unlock()
@@ -278,24 +425,50 @@ func (n *ChordNode) fixPredecessor() {
 		return
 	}
 	if _, err := n.predecessor.Ping(); err != nil {
-		logrus.Warn(n.Addr, " fixPredecessor: predecessor disconnected: ", err)
-		n.backupDataLock.RLock()
-		n.dataLock.Lock()
-		for k, v := range n.backupData {
-			n.data[k] = v
-		}
-		n.dataLock.Unlock()
-		n.backupDataLock.RUnlock()
+		n.logger.Warn(n.Addr, " fixPredecessor: predecessor disconnected: ", err)
+		// take over the data of the predecessor, and the farther backups move one level up
+		n.backupDataLock.Lock()
+		backup := n.backupData[0].Copy()
+		n.backupData = append(n.backupData[1:], n.newStorage())
+		n.backupDataLock.Unlock()
+		n.mergePrimary(backup)
 		succ := n.getOnlineSucc()
 		if succ != nil {
-			err = succ.SendBackupData(&n.backupData)
+			err = succ.SendBackupData(&backup)
 			if err != nil {
-				logrus.Error(n.Addr, " fixPredecessor: failed to send backup data ", err)
+				n.logger.Error(n.Addr, " fixPredecessor: failed to send backup data ", err)
 			}
+			if n.cfg.Replication > 1 {
+				if err = succ.RefreshBackup(n.cfg.Replication - 1); err != nil {
+					n.logger.Error(n.Addr, " fixPredecessor: failed to refresh backup of successors ", err)
+				}
+			}
+			succ.close()
 		}
 	} else {
-		logrus.Infof("%s fixPredecessor: %s OK", n.Addr, n.predecessor.remoteAddr)
+		n.logger.Infof("%s fixPredecessor: %s OK", n.Addr, n.predecessor.remoteAddr)
+	}
+}
+
+func (n *ChordNode) findSuccessor(id uint32) (string, error) {
+	var reply FindSuccessorReply
+	err := n.FindSuccessor(FindSuccessorRequest{id, n.cfg.TTL, TraceContext{}}, &reply)
+	return reply.Addr, err
+}
+
+// lookup finds the node responsible for key and records the lookup in the stats
+func (n *ChordNode) lookup(key string, trace TraceContext) (string, error) {
+	start := time.Now()
+	var reply FindSuccessorReply
+	err := n.FindSuccessor(FindSuccessorRequest{internal.Str_uint32_sha1(key), n.cfg.TTL, trace}, &reply)
+	if err == nil {
+		n.stats.RecordLookup(int(n.cfg.TTL-reply.TTL), time.Since(start))
 	}
+	return reply.Addr, err
+}
+
+func (n *ChordNode) Stats() internal.NodeStats {
+	return n.stats.Snapshot()
 }
 
 func (n *ChordNode) getOnlineSucc() *chordLink {
@@ -306,11 +479,11 @@ func (n *ChordNode) getOnlineSucc() *chordLink {
 			continue
 		}
 		link := &chordLink{}
-		err := link.Dial(addr)
+		err := link.Dial(addr, &n.cfg)
 		if err == nil {
 			return link
 		}
-		logrus.Warn(n.Addr, " getOnlineSucc: failed to connect to succ ", addr, " : ", err)
+		n.logger.Warn(n.Addr, " getOnlineSucc: failed to connect to succ ", addr, " : ", err)
 	}
 	return nil
 }
@@ -3,17 +3,16 @@ package chord
 import (
 	"dht/internal"
 	"errors"
-	"net"
 	"net/rpc"
 	"time"
 )
 
-func (l *chordLink) Dial(addr string) error {
+func (l *chordLink) Dial(addr string, c *Config) error {
 	// logrus.Infof("Connecting to %s", addr)
 	l.remoteAddr = addr
 	l.id = internal.Str_uint32_sha1(addr)
 	var err error
-	conn, err := net.DialTimeout("tcp", addr, time.Second*10)
+	conn, err := c.Transport.Dial(addr, c.DialTimeout)
 	if err != nil {
 		// logrus.Error("Dial:", err)
 		return err
@@ -29,11 +28,12 @@ func (link *chordLink) Call(method string, args interface{}, reply interface{})
 	return err
 }
 
-func (link *chordLink) FindSuccessor(id uint32, ttl int16, addr *string) error {
+func (link *chordLink) FindSuccessor(id uint32, ttl int16, trace TraceContext, reply *FindSuccessorReply) error {
 	return link.Call("FindSuccessor", FindSuccessorRequest{
-		ID:  id,
-		TTL: ttl,
-	}, addr)
+		ID:    id,
+		TTL:   ttl,
+		Trace: trace,
+	}, reply)
 }
 
 func (link *chordLink) GetPredecessor(addr *string) error {
@@ -60,7 +60,7 @@ func (link *chordLink) Notify(addr string) error {
 	return link.Call("Notify", addr, &tmp)
 }
 
-func (link *chordLink) GetSuccList(succList *[ChordK]string) error {
+func (link *chordLink) GetSuccList(succList *[]string) error {
 	var tmp int8
 	return link.Call("GetSuccList", tmp, succList)
 }
@@ -69,23 +69,64 @@ func (link *chordLink) GetAllData(data *map[string]string) error {
 	return link.Call("GetAllData", false, data)
 }
 
-func (link *chordLink) GetDataByKey(key string) (string, error) {
+func (link *chordLink) GetDataByKey(key string, trace TraceContext) (string, error) {
 	var value string
-	err := link.Call("GetDataByKey", key, &value)
-	return value, err
+	err := link.Call("GetDataByKey", GetDataRequest{
+		Key:   key,
+		Trace: trace,
+	}, &value)
+	return value, remoteError(err)
 }
 
 func (link *chordLink) GetBackupData(backup *map[string]string) error {
 	return link.Call("GetAllData", true, backup)
 }
 
-func (link *chordLink) PutData(key, value string, isBackup bool) error {
+func (link *chordLink) GetReplicas(levels int, replicas *[]map[string]string) error {
+	return link.Call("GetReplicas", levels, replicas)
+}
+
+func (link *chordLink) Inspect(state *NodeState) error {
+	var tmp int8
+	return link.Call("Inspect", tmp, state)
+}
+
+func (link *chordLink) InspectKeys(request KeysRequest, reply *KeysReply) error {
+	return link.Call("InspectKeys", request, reply)
+}
+
+func (link *chordLink) GetStats(reply *NodeStatsReply) error {
+	var tmp int8
+	return link.Call("GetStats", tmp, reply)
+}
+
+func (link *chordLink) RefreshBackup(levels int) error {
 	var ok bool
-	return link.Call("PutData", PutDataRequest{
+	return link.Call("RefreshBackup", levels, &ok)
+}
+
+// PutData puts the pair into the primary data, or into the backup of level if isBackup.
+func (link *chordLink) PutData(key, value string, isBackup bool, level int, trace TraceContext) error {
+	return link.PutDataIf(key, value, Precondition{}, isBackup, level, trace)
+}
+
+func (link *chordLink) PutDataIf(key, value string, cond Precondition, isBackup bool, level int, trace TraceContext) error {
+	_, err := link.SendPutData(PutDataRequest{
 		IsBackup: isBackup,
+		Level:    level,
 		Key:      key,
 		Value:    value,
-	}, &ok)
+		Trace:    trace,
+		Cond:     cond,
+	})
+	return err
+}
+
+// SendPutData returns the ETag of the key after the write.
+func (link *chordLink) SendPutData(request PutDataRequest) (string, error) {
+	var etag string
+	err := remoteError(link.Call("PutData", request, &etag))
+	return etag, err
 }
 
 func (link *chordLink) SendBackupData(data *map[string]string) error {
@@ -93,27 +134,115 @@ func (link *chordLink) SendBackupData(data *map[string]string) error {
 	return link.Call("SendBackupData", *data, &ok)
 }
 
-func (link *chordLink) DeleteData(key string, isBackup bool) error {
+func (link *chordLink) DeleteData(key string, isBackup bool, level int, trace TraceContext) error {
+	return link.DeleteDataIf(key, Precondition{}, isBackup, level, trace)
+}
+
+func (link *chordLink) DeleteDataIf(key string, cond Precondition, isBackup bool, level int, trace TraceContext) error {
 	var ok bool
-	return link.Call("DeleteData", DeleteDataRequest{
+	return remoteError(link.Call("DeleteData", DeleteDataRequest{
 		IsBackup: isBackup,
+		Level:    level,
 		Key:      key,
-	}, &ok)
+		Trace:    trace,
+		Cond:     cond,
+	}, &ok))
+}
+
+// PutDataBatch returns the ETags of the keys after the write.
+func (link *chordLink) PutDataBatch(pairs map[string]string, isBackup bool, level int, trace TraceContext) (map[string]string, error) {
+	return link.SendPutDataBatch(PutDataBatchRequest{
+		IsBackup: isBackup,
+		Level:    level,
+		Pairs:    pairs,
+		Trace:    trace,
+	})
+}
+
+func (link *chordLink) SendPutDataBatch(request PutDataBatchRequest) (map[string]string, error) {
+	var etags map[string]string
+	err := remoteError(link.Call("PutDataBatch", request, &etags))
+	return etags, err
+}
+
+func (link *chordLink) GetDataBatch(keys []string, trace TraceContext) (map[string]string, error) {
+	var pairs map[string]string
+	err := link.Call("GetDataBatch", GetDataBatchRequest{
+		Keys:  keys,
+		Trace: trace,
+	}, &pairs)
+	return pairs, err
+}
+
+// DeleteDataBatch puts the keys which did not exist into missing, if it is not nil.
+func (link *chordLink) DeleteDataBatch(keys []string, isBackup bool, level int, trace TraceContext, missing *[]string) error {
+	var reply []string
+	err := link.Call("DeleteDataBatch", DeleteDataBatchRequest{
+		IsBackup: isBackup,
+		Level:    level,
+		Keys:     keys,
+		Trace:    trace,
+	}, &reply)
+	if missing != nil {
+		*missing = reply
+	}
+	return remoteError(err)
+}
+
+func (link *chordLink) UpdateSet(request UpdateSetRequest) error {
+	var ok bool
+	return remoteError(link.Call("UpdateSet", request, &ok))
+}
+
+func (link *chordLink) Increment(request IncrementRequest) (int64, error) {
+	var value int64
+	err := link.Call("IncrementCounter", request, &value)
+	return value, remoteError(err)
+}
+
+func (link *chordLink) Lease(request LeaseRequest) (uint64, error) {
+	var token uint64
+	err := link.Call("Lease", request, &token)
+	return token, remoteError(err)
+}
+
+func (link *chordLink) Publish(topic, data string) (int, error) {
+	var count int
+	err := link.Call("PublishTopic", PublishRequest{Topic: topic, Data: data}, &count)
+	return count, remoteError(err)
+}
+
+func (link *chordLink) PollTopic(topic, id string, wait time.Duration) ([]Message, error) {
+	var msgs []Message
+	err := link.Call("PollTopic", PollTopicRequest{Topic: topic, ID: id, Wait: wait}, &msgs)
+	return msgs, remoteError(err)
+}
+
+func (link *chordLink) ExportData(request ExportRequest, reply *ExportReply) error {
+	return link.Call("ExportData", request, reply)
+}
+
+// TouchChunks tells the owner of the chunks that some manifest still refers to them.
+func (link *chordLink) TouchChunks(keys []string) error {
+	var ok bool
+	return link.Call("TouchChunks", keys, &ok)
 }
 
-func (link *chordLink) SuccInformExit(addr, preAddr string, data *map[string]string) {
+func (link *chordLink) SuccInformExit(addr, preAddr string, data *map[string]string, trace TraceContext) {
 	var ok bool
 	link.Call("SuccInformExit", SuccInformExitRequest{
 		Addr:    addr,
 		PreAddr: preAddr,
 		Data:    *data,
+		Trace:   trace,
 	}, &ok)
 }
 
-func (link *chordLink) PredInformExit(addr, succAddr string) {
+func (link *chordLink) PredInformExit(addr, succAddr string, trace TraceContext) {
 	var ok bool
 	link.Call("PredInformExit", PredInformExitRequest{
 		Addr:     addr,
 		SuccAddr: succAddr,
+		Trace:    trace,
 	}, &ok)
 }
@@ -3,40 +3,58 @@ package chord
 import (
 	"dht/internal"
 	"fmt"
-
-	"github.com/sirupsen/logrus"
+	"time"
 )
 
 type FindSuccessorRequest struct {
-	ID  uint32
-	TTL int16
+	ID    uint32
+	TTL   int16
+	Trace TraceContext
+}
+
+// FindSuccessorReply carries the TTL left when the request is resolved, from which the
+// number of hops can be known, and the nodes the request passed through.
+type FindSuccessorReply struct {
+	Addr string
+	TTL  int16
+	Path []string
 }
 
-func (n *ChordNode) FindSuccessor(request FindSuccessorRequest, reply *string) error {
+func (n *ChordNode) FindSuccessor(request FindSuccessorRequest, reply *FindSuccessorReply) (err error) {
+	sp := n.startSpan("FindSuccessor", request.Trace)
+	sp.set("chord.id", request.ID)
+	sp.set("chord.ttl", request.TTL)
+	defer func() { sp.finish(err) }()
 	succ := n.getOnlineSucc()
 	if succ == nil || !succ.isConnected() {
 		err := fmt.Errorf("%s: no online successor", n.Addr)
-		logrus.Error(n.Addr, " FindSucessor: ", err)
+		n.logger.Error(n.Addr, " FindSucessor: ", err)
 		return err
 	}
 	defer succ.close()
 	if inRange(n.Id+1, succ.id+1, request.ID) {
-		*reply = succ.remoteAddr
-		logrus.Info(n.Addr, " FindSuccessor: request for ", request.ID, " resolved with addr ", succ.remoteAddr)
+		*reply = FindSuccessorReply{succ.remoteAddr, request.TTL, []string{n.Addr}}
+		sp.set("chord.resolved", succ.remoteAddr)
+		n.logger.Info(n.Addr, " FindSuccessor: request for ", request.ID, " resolved with addr ", succ.remoteAddr)
 		return nil
 	}
 	if request.TTL == 1 {
 		err := fmt.Errorf(" request for %d redirected too many times ", request.ID)
-		logrus.Error(n.Addr, " FindSuccessor: ", err)
+		n.logger.Error(n.Addr, " FindSuccessor: ", err)
 		return err
 	}
 	fin := n.closestPrecedingFinger(request.ID)
 	if fin == nil || fin.remoteAddr == n.Addr {
-		logrus.Warn(n.Addr, " FindSuccessor: unable to find finger, use succ")
+		n.logger.Warn(n.Addr, " FindSuccessor: unable to find finger, use succ")
 		fin = succ
 	}
+	sp.set("chord.next", fin.remoteAddr)
 	// logrus.Info(n.Addr, " FindSuccessor: redirecting ", request.ID, " to ", fin.remoteAddr)
-	return fin.FindSuccessor(request.ID, request.TTL-1, reply)
+	err = fin.FindSuccessor(request.ID, request.TTL-1, sp.context(), reply)
+	if err == nil {
+		reply.Path = append([]string{n.Addr}, reply.Path...)
+	}
+	return err
 }
 
 func (n *ChordNode) GetPredecessor(_ string, addr *string) error {
@@ -47,7 +65,7 @@ func (n *ChordNode) GetPredecessor(_ string, addr *string) error {
 		return nil
 	}
 	err := fmt.Errorf("no immediate predecessor")
-	logrus.Warnf("%s GetPredecessor: %s", n.Addr, err.Error())
+	n.logger.Warnf("%s GetPredecessor: %s", n.Addr, err.Error())
 	return err
 }
 
@@ -64,133 +82,881 @@ func (n *ChordNode) Notify(request string, _ *int8) error {
 	n.predecsorLock.Lock()
 	defer n.predecsorLock.Unlock()
 	if !n.predecessor.isConnected() || inRange(n.predecessor.id+1, n.Id, id) {
-		logrus.Info(n.Addr, " Notify: being notified new predecessor: ", request)
+		n.logger.Info(n.Addr, " Notify: being notified new predecessor: ", request)
 		n.predecessor.close()
-		err := n.predecessor.Dial(request)
+		err := n.predecessor.Dial(request, &n.cfg)
 		if err != nil {
 			n.predecessor.close()
-			logrus.Error(n.Addr, " Notify: dial error: ", err)
+			n.logger.Error(n.Addr, " Notify: dial error: ", err)
 			return err
 		}
-		go n.fetchBackupData()
-		n.dataLock.Lock()
-		for k := range n.data {
-			dataID := internal.Str_uint32_sha1(k)
-			if inRange(n.Id+1, n.predecessor.id+1, dataID) {
-				delete(n.data, k)
+		predID := n.predecessor.id
+		// if several predecessors failed, the backups still hold keys which are ours now
+		owned := make(map[string]string)
+		n.backupDataLock.RLock()
+		for _, backup := range n.backupData {
+			for k, v := range snapshot(backup) {
+				if inRange(predID+1, n.Id+1, internal.Str_uint32_sha1(k)) {
+					owned[k] = v
+				}
 			}
 		}
-		n.dataLock.Unlock()
+		n.backupDataLock.RUnlock()
+		if len(owned) > 0 {
+			n.mergePrimary(owned)
+			go func() {
+				succ := n.getOnlineSucc()
+				if succ == nil {
+					return
+				}
+				if err := succ.SendBackupData(&owned); err != nil {
+					n.logger.Error(n.Addr, " Notify: failed to send backup data ", err)
+				}
+				succ.close()
+			}()
+		}
+		go n.fetchBackupData()
+		n.data.DeleteFunc(func(k string) bool {
+			return inRange(n.Id+1, predID+1, internal.Str_uint32_sha1(k))
+		})
 	}
 	return nil
 }
 
-func (n *ChordNode) GetSuccList(_ int8, succList *[ChordK]string) error {
+func (n *ChordNode) GetSuccList(_ int8, succList *[]string) error {
 	n.succListLock.RLock()
-	*succList = n.succList
+	*succList = append([]string(nil), n.succList...)
 	n.succListLock.RUnlock()
 	return nil
 }
 
+// GetAllData returns a snapshot of the data or the first backup, which the writes made
+// while it is encoded do not change.
 func (n *ChordNode) GetAllData(isBackup bool, data *map[string]string) error {
 	if isBackup {
-		n.backupDataLock.RLock()
-		*data = n.backupData
-		n.backupDataLock.RUnlock()
+		*data = snapshot(n.backupLevel(0))
 	} else {
-		n.dataLock.RLock()
-		*data = n.data
-		n.dataLock.RUnlock()
+		*data = snapshot(n.data)
+	}
+	return nil
+}
+
+// GetReplicas returns the data followed by the backups, levels maps in total at most,
+// from which the successors build their backups. The snapshots of the backups are taken
+// together, so that a fetchBackupData meanwhile does not mix the levels of two fetches.
+func (n *ChordNode) GetReplicas(levels int, replicas *[]map[string]string) error {
+	*replicas = []map[string]string{snapshot(n.data)}
+	n.backupDataLock.RLock()
+	for i := 0; i < levels-1 && i < len(n.backupData); i++ {
+		*replicas = append(*replicas, snapshot(n.backupData[i]))
+	}
+	n.backupDataLock.RUnlock()
+	for i := 1; i < len(*replicas); i++ {
+		(*replicas)[i] = n.cfg.backedUp((*replicas)[i], i)
 	}
 	return nil
 }
 
-func (n *ChordNode) GetDataByKey(key string, value *string) error {
+// RefreshBackup makes the node fetch its backups again, and the next levels-1 successors
+// in turn, after the data of the predecessor changed a lot.
+func (n *ChordNode) RefreshBackup(levels int, _ *bool) error {
+	go func() {
+		n.fetchBackupData()
+		if levels <= 1 {
+			return
+		}
+		succ := n.getOnlineSucc()
+		if succ == nil {
+			return
+		}
+		if succ.remoteAddr != n.Addr {
+			if err := succ.RefreshBackup(levels - 1); err != nil {
+				n.logger.Error(n.Addr, " RefreshBackup: ", err)
+			}
+		}
+		succ.close()
+	}()
+	return nil
+}
+
+// NodeState is what a node tells about itself to the ring crawler. Inspect sends the
+// numbers of keys only, the crawler pages through the keys with InspectKeys.
+type NodeState struct {
+	Info       NodeInfo
+	Routing    RoutingInfo
+	SuccList   []string
+	DataCnt    int
+	BackupCnt  []int
+	DataKeys   []string
+	BackupKeys [][]string
+}
+
+func (n *ChordNode) Inspect(_ int8, state *NodeState) error {
+	state.Info = n.NodeInfo()
+	state.Routing = n.RoutingInfo()
+	state.SuccList = n.SuccList()
+	state.DataCnt = n.data.Len()
+	n.backupDataLock.RLock()
+	for _, backup := range n.backupData {
+		state.BackupCnt = append(state.BackupCnt, backup.Len())
+	}
+	n.backupDataLock.RUnlock()
+	return nil
+}
+
+// KeysRequest asks for a page of the keys of the primary data, with Level 0, or of the
+// backup of level Level-1. The first page opens a scan with Scan 0, the next ones give
+// the Scan of the reply and the last key of the page before in After.
+type KeysRequest struct {
+	Level int
+	Scan  uint64
+	After string
+	Limit int
+}
+
+type KeysReply struct {
+	Scan uint64
+	Keys []string
+	More bool
+}
+
+func (n *ChordNode) InspectKeys(request KeysRequest, reply *KeysReply) error {
+	var sc *keyScan
+	if request.Scan == 0 {
+		var s Storage
+		if request.Level == 0 {
+			s = n.data
+		} else {
+			n.backupDataLock.RLock()
+			if request.Level <= len(n.backupData) {
+				s = n.backupData[request.Level-1]
+			}
+			n.backupDataLock.RUnlock()
+		}
+		if s == nil {
+			return fmt.Errorf("no backup of level %d", request.Level-1)
+		}
+		reply.Scan, sc = n.scans.start(s)
+	} else {
+		var err error
+		if sc, err = n.scans.get(request.Scan); err != nil {
+			return err
+		}
+		reply.Scan = request.Scan
+	}
+	reply.Keys, reply.More = sc.page(request.After, request.Limit)
+	if !reply.More {
+		n.scans.close(reply.Scan)
+	}
+	return nil
+}
+
+// NodeStatsReply is what dhtctl shows about a node.
+type NodeStatsReply struct {
+	Info    NodeInfo
+	Storage StorageInfo
+	Stats   internal.NodeStats
+}
+
+func (n *ChordNode) GetStats(_ int8, reply *NodeStatsReply) error {
+	*reply = NodeStatsReply{n.NodeInfo(), n.StorageInfo(), n.Stats()}
+	return nil
+}
+
+type GetDataRequest struct {
+	Key   string
+	Trace TraceContext
+}
+
+func (n *ChordNode) GetDataByKey(request GetDataRequest, value *string) (err error) {
+	sp := n.startSpan("GetDataByKey", request.Trace)
+	sp.set("dht.key", request.Key)
+	defer func() { sp.finish(err) }()
 	var ok bool
-	n.dataLock.RLock()
-	*value, ok = n.data[key]
-	n.dataLock.RUnlock()
+	*value, ok = n.data.Get(request.Key)
 	if ok {
 		return nil
 	} else {
-		err := fmt.Errorf("unknown key %s", key)
-		logrus.Error(n.Addr, " GetDataByKey: ", err)
+		err := fmt.Errorf("%w: %s", ErrNotFound, request.Key)
+		n.logger.Warn(n.Addr, " GetDataByKey: ", err)
 		return err
 	}
 }
 
+// checkOwner fails with ErrNotOwner unless the node owns key. A node without a
+// predecessor, e.g. right after Create, takes every key as its own.
+func (n *ChordNode) checkOwner(key string) error {
+	n.predecsorLock.RLock()
+	pred, ok := n.predecessor.id, n.predecessor.isConnected()
+	n.predecsorLock.RUnlock()
+	if !ok || inRange(pred+1, n.Id+1, internal.Str_uint32_sha1(key)) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrNotOwner, key)
+}
+
+// PutDataRequest with IsBackup puts the pair into the backup of the given level, which
+// is then passed on to the next successor until Replication levels are written. Without
+// it the owner refuses the reserved keys, see checkStoredKey.
 type PutDataRequest struct {
 	IsBackup   bool
+	Level      int
 	Key, Value string
+	Trace      TraceContext
+	// Cond is checked against the primary data only
+	Cond Precondition
+	// Restore puts back a pair saved as the nodes keep it, see restoreValue
+	Restore bool
 }
 
-func (n *ChordNode) PutData(request PutDataRequest, ok *bool) error {
+// PutData replies the ETag of the key after the write.
+func (n *ChordNode) PutData(request PutDataRequest, etag *string) (err error) {
+	sp := n.startSpan("PutData", request.Trace)
+	sp.set("dht.key", request.Key)
+	sp.set("chord.backup", request.IsBackup)
+	sp.set("chord.level", request.Level)
+	defer func() { sp.finish(err) }()
+	level := -1
 	if request.IsBackup {
-		n.backupDataLock.Lock()
-		n.backupData[request.Key] = request.Value
-		n.backupDataLock.Unlock()
+		backup := n.backupLevel(request.Level)
+		if backup == nil {
+			err := fmt.Errorf("backup level %d out of range", request.Level)
+			n.logger.Error(n.Addr, " PutData: ", err)
+			return err
+		}
+		// the backups of a set or a counter may come out of order, the merge keeps the
+		// changes of both
+		n.backupWriteLock.Lock()
+		value := request.Value
+		if old, exists := backup.Get(request.Key); exists {
+			value = mergeValue(old, value)
+		}
+		n.noteBackupRoom(backup, map[string]string{request.Key: value})
+		backup.Put(request.Key, value)
+		n.backupWriteLock.Unlock()
+		n.touchWritten(request.Key)
+		level = request.Level
 	} else {
-		n.dataLock.Lock()
-		n.data[request.Key] = request.Value
-		n.dataLock.Unlock()
+		if err := n.cfg.checkSize(request.Key, request.Value); err != nil {
+			n.logger.Warn(n.Addr, " PutData: ", err)
+			return err
+		}
+		if err := checkStoredKey(request.Key, request.Value); err != nil {
+			n.logger.Warn(n.Addr, " PutData: ", err)
+			return err
+		}
+		if err := n.checkOwner(request.Key); err != nil {
+			n.logger.Warn(n.Addr, " PutData: ", err)
+			return err
+		}
+		n.writeLock.Lock()
+		value, exists := n.data.Get(request.Key)
+		if !request.Cond.check(value, exists) {
+			n.writeLock.Unlock()
+			return fmt.Errorf("%w: %s", ErrPreconditionFailed, request.Key)
+		}
+		if request.Restore {
+			stored, ok := restoreValue(request.Key, request.Value, value, exists)
+			if !ok {
+				n.writeLock.Unlock()
+				return fmt.Errorf("%w: %s", ErrPreconditionFailed, request.Key)
+			}
+			request.Value = stored
+		} else {
+			request.Value = versioned(request.Key, request.Value, value)
+		}
+		if err := n.checkRoom(map[string]string{request.Key: request.Value}); err != nil {
+			n.writeLock.Unlock()
+			n.logger.Warn(n.Addr, " PutData: ", err)
+			return err
+		}
+		n.data.Put(request.Key, request.Value)
+		if isChunkKey(request.Key) {
+			n.chunks.touch(request.Key)
+		}
+		n.touchWritten(request.Key)
+		n.notifyWatches(EventPut, request.Key, request.Value)
+		n.writeLock.Unlock()
+	}
+	if level+1 < n.cfg.replication(request.Key) {
 		go func() {
 			succ := n.getOnlineSucc()
 			if succ == nil {
 				return
 			}
-			err := succ.PutData(request.Key, request.Value, true)
+			err := succ.PutData(request.Key, request.Value, true, level+1, sp.context())
 			succ.close()
 			if err != nil {
-				logrus.Error(n.Addr, " PutData: send succ backup KV: ", err)
+				n.logger.Error(n.Addr, " PutData: send succ backup KV: ", err)
 			}
 		}()
 	}
-	*ok = true
+	*etag = storedETag(request.Value)
 	return nil
 }
 
 func (n *ChordNode) SendBackupData(data map[string]string, ok *bool) error {
-	n.backupDataLock.Lock()
-	for k, v := range data {
-		n.backupData[k] = v
-	}
-	n.backupDataLock.Unlock()
+	n.backupWriteLock.Lock()
+	mergeData(n.backupLevel(0), data)
+	n.backupWriteLock.Unlock()
 	return nil
 }
 
 type DeleteDataRequest struct {
 	IsBackup bool
+	Level    int
 	Key      string
+	Trace    TraceContext
+	Cond     Precondition
 }
 
-func (n *ChordNode) DeleteData(request DeleteDataRequest, ok *bool) error {
+func (n *ChordNode) DeleteData(request DeleteDataRequest, ok *bool) (err error) {
+	sp := n.startSpan("DeleteData", request.Trace)
+	sp.set("dht.key", request.Key)
+	sp.set("chord.backup", request.IsBackup)
+	sp.set("chord.level", request.Level)
+	defer func() { sp.finish(err) }()
+	level := -1
 	if request.IsBackup {
-		n.backupDataLock.Lock()
-		delete(n.backupData, request.Key)
-		n.backupDataLock.Unlock()
+		backup := n.backupLevel(request.Level)
+		if backup == nil {
+			err := fmt.Errorf("backup level %d out of range", request.Level)
+			n.logger.Error(n.Addr, " DeleteData: ", err)
+			return err
+		}
+		backup.Delete(request.Key)
+		level = request.Level
 	} else {
-		n.dataLock.Lock()
-		defer n.dataLock.Unlock()
-		_, exist := n.data[request.Key]
-		if !exist {
-			err := fmt.Errorf("key %s not exist", request.Key)
-			logrus.Error(n.Addr, " DeleteData: ", err)
+		if err := CheckKey(request.Key); err != nil {
+			n.logger.Warn(n.Addr, " DeleteData: ", err)
+			return err
+		}
+		if err := n.checkOwner(request.Key); err != nil {
+			n.logger.Warn(n.Addr, " DeleteData: ", err)
+			return err
+		}
+		n.writeLock.Lock()
+		value, exists := n.data.Get(request.Key)
+		if !exists {
+			n.writeLock.Unlock()
+			err := fmt.Errorf("%w: %s", ErrNotFound, request.Key)
+			n.logger.Warn(n.Addr, " DeleteData: ", err)
 			*ok = false
 			return err
 		}
-		delete(n.data, request.Key)
+		if !request.Cond.check(value, exists) {
+			n.writeLock.Unlock()
+			return fmt.Errorf("%w: %s", ErrPreconditionFailed, request.Key)
+		}
+		n.data.Delete(request.Key)
+		n.notifyWatches(EventDelete, request.Key, value)
+		n.writeLock.Unlock()
+	}
+	if level+1 < n.cfg.replication(request.Key) {
+		go func() {
+			succ := n.getOnlineSucc()
+			if succ == nil {
+				return
+			}
+			err := succ.DeleteData(request.Key, true, level+1, sp.context())
+			succ.close()
+			if err != nil {
+				n.logger.Error(n.Addr, " DeleteData: delete succ backup KV: ", err)
+			}
+		}()
+	}
+	*ok = true
+	return nil
+}
+
+// PutDataBatchRequest is PutDataRequest for many pairs, which are passed on to the
+// successors in one request as well.
+type PutDataBatchRequest struct {
+	IsBackup bool
+	Level    int
+	Pairs    map[string]string
+	Trace    TraceContext
+	// Restore puts back pairs saved as the nodes keep them, see restoreValue
+	Restore bool
+}
+
+// PutDataBatch replies the ETags of the keys after the write, of which the keys kept as
+// they are by a Restore are left out.
+func (n *ChordNode) PutDataBatch(request PutDataBatchRequest, etags *map[string]string) (err error) {
+	sp := n.startSpan("PutDataBatch", request.Trace)
+	sp.set("chord.keys", len(request.Pairs))
+	sp.set("chord.backup", request.IsBackup)
+	sp.set("chord.level", request.Level)
+	defer func() { sp.finish(err) }()
+	level := -1
+	if request.IsBackup {
+		backup := n.backupLevel(request.Level)
+		if backup == nil {
+			err := fmt.Errorf("backup level %d out of range", request.Level)
+			n.logger.Error(n.Addr, " PutDataBatch: ", err)
+			return err
+		}
+		n.backupWriteLock.Lock()
+		n.noteBackupRoom(backup, request.Pairs)
+		backup.Merge(request.Pairs)
+		n.backupWriteLock.Unlock()
+		for k := range request.Pairs {
+			n.touchWritten(k)
+		}
+		level = request.Level
+	} else {
+		for k, v := range request.Pairs {
+			if err := n.cfg.checkSize(k, v); err != nil {
+				n.logger.Warn(n.Addr, " PutDataBatch: ", err)
+				return err
+			}
+			if err := checkStoredKey(k, v); err != nil {
+				n.logger.Warn(n.Addr, " PutDataBatch: ", err)
+				return err
+			}
+			if err := n.checkOwner(k); err != nil {
+				n.logger.Warn(n.Addr, " PutDataBatch: ", err)
+				return err
+			}
+		}
+		n.writeLock.Lock()
+		pairs := make(map[string]string, len(request.Pairs))
+		for k, v := range request.Pairs {
+			old, exists := n.data.Get(k)
+			if !request.Restore {
+				pairs[k] = versioned(k, v, old)
+			} else if stored, ok := restoreValue(k, v, old, exists); ok {
+				pairs[k] = stored
+			}
+		}
+		request.Pairs = pairs
+		if err := n.checkRoom(request.Pairs); err != nil {
+			n.writeLock.Unlock()
+			n.logger.Warn(n.Addr, " PutDataBatch: ", err)
+			return err
+		}
+		n.data.Merge(request.Pairs)
+		for k, v := range request.Pairs {
+			if isChunkKey(k) {
+				n.chunks.touch(k)
+			}
+			n.touchWritten(k)
+			n.notifyWatches(EventPut, k, v)
+		}
+		n.writeLock.Unlock()
+	}
+	if pairs := n.cfg.backedUp(request.Pairs, level+1); len(pairs) > 0 {
+		go func() {
+			succ := n.getOnlineSucc()
+			if succ == nil {
+				return
+			}
+			_, err := succ.PutDataBatch(pairs, true, level+1, sp.context())
+			succ.close()
+			if err != nil {
+				n.logger.Error(n.Addr, " PutDataBatch: send succ backup KV: ", err)
+			}
+		}()
+	}
+	if !request.IsBackup {
+		*etags = make(map[string]string, len(request.Pairs))
+		for k, v := range request.Pairs {
+			(*etags)[k] = storedETag(v)
+		}
+	}
+	return nil
+}
+
+type GetDataBatchRequest struct {
+	Keys  []string
+	Trace TraceContext
+}
+
+// GetDataBatch replies the pairs of the keys found, and leaves the others out.
+func (n *ChordNode) GetDataBatch(request GetDataBatchRequest, pairs *map[string]string) error {
+	sp := n.startSpan("GetDataBatch", request.Trace)
+	sp.set("chord.keys", len(request.Keys))
+	defer sp.finish(nil)
+	*pairs = make(map[string]string, len(request.Keys))
+	for _, key := range request.Keys {
+		if value, ok := n.data.Get(key); ok {
+			(*pairs)[key] = value
+		}
+	}
+	return nil
+}
+
+type DeleteDataBatchRequest struct {
+	IsBackup bool
+	Level    int
+	Keys     []string
+	Trace    TraceContext
+}
+
+// DeleteDataBatch replies the keys which did not exist.
+func (n *ChordNode) DeleteDataBatch(request DeleteDataBatchRequest, missing *[]string) (err error) {
+	sp := n.startSpan("DeleteDataBatch", request.Trace)
+	sp.set("chord.keys", len(request.Keys))
+	sp.set("chord.backup", request.IsBackup)
+	sp.set("chord.level", request.Level)
+	defer func() { sp.finish(err) }()
+	level := -1
+	if request.IsBackup {
+		backup := n.backupLevel(request.Level)
+		if backup == nil {
+			err := fmt.Errorf("backup level %d out of range", request.Level)
+			n.logger.Error(n.Addr, " DeleteDataBatch: ", err)
+			return err
+		}
+		for _, key := range request.Keys {
+			backup.Delete(key)
+		}
+		level = request.Level
+	} else {
+		for _, key := range request.Keys {
+			if err := CheckKey(key); err != nil {
+				n.logger.Warn(n.Addr, " DeleteDataBatch: ", err)
+				return err
+			}
+			if err := n.checkOwner(key); err != nil {
+				n.logger.Warn(n.Addr, " DeleteDataBatch: ", err)
+				return err
+			}
+		}
+		n.writeLock.Lock()
+		for _, key := range request.Keys {
+			value, exists := n.data.Get(key)
+			if !exists || !n.data.Delete(key) {
+				*missing = append(*missing, key)
+			} else {
+				n.notifyWatches(EventDelete, key, value)
+			}
+		}
+		n.writeLock.Unlock()
+	}
+	var keys []string
+	for _, key := range request.Keys {
+		if level+1 < n.cfg.replication(key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > 0 {
 		go func() {
 			succ := n.getOnlineSucc()
 			if succ == nil {
 				return
 			}
-			err := succ.DeleteData(request.Key, true)
+			err := succ.DeleteDataBatch(keys, true, level+1, sp.context(), nil)
 			succ.close()
 			if err != nil {
-				logrus.Error(n.Addr, " DeleteData: delete succ backup KV: ", err)
+				n.logger.Error(n.Addr, " DeleteDataBatch: delete succ backup KV: ", err)
 			}
 		}()
 	}
+	return nil
+}
+
+// UpdateSetRequest adds and removes members of the set under Key, applied by the owner.
+type UpdateSetRequest struct {
+	Key    string
+	Add    []string
+	Remove []string
+	// TTL of the added members, zero for none
+	TTL   time.Duration
+	Trace TraceContext
+}
+
+func (n *ChordNode) UpdateSet(request UpdateSetRequest, ok *bool) (err error) {
+	sp := n.startSpan("UpdateSet", request.Trace)
+	sp.set("dht.key", request.Key)
+	defer func() { sp.finish(err) }()
+	if err := n.checkOwner(request.Key); err != nil {
+		n.logger.Warn(n.Addr, " UpdateSet: ", err)
+		return err
+	}
+	now := time.Now()
+	var expire int64
+	if request.TTL > 0 {
+		expire = now.Add(request.TTL).UnixNano()
+	}
+	n.writeLock.Lock()
+	set := newSetValue()
+	if old, exists := n.data.Get(request.Key); exists {
+		var isSet bool
+		if set, isSet = parseSet(old); !isSet {
+			n.writeLock.Unlock()
+			return fmt.Errorf("%w: %s is not a set", ErrWrongType, request.Key)
+		}
+	}
+	set.prune(now.UnixNano())
+	set.add(request.Add, expire, now.UnixNano())
+	set.remove(request.Remove, now.UnixNano())
+	value := set.encode()
+	if err := n.cfg.checkSize(request.Key, value); err != nil {
+		n.writeLock.Unlock()
+		n.logger.Warn(n.Addr, " UpdateSet: ", err)
+		return err
+	}
+	if err := n.checkRoom(map[string]string{request.Key: value}); err != nil {
+		n.writeLock.Unlock()
+		n.logger.Warn(n.Addr, " UpdateSet: ", err)
+		return err
+	}
+	n.data.Put(request.Key, value)
+	n.touchWritten(request.Key)
+	n.notifyWatches(EventPut, request.Key, value)
+	n.writeLock.Unlock()
+	go func() {
+		succ := n.getOnlineSucc()
+		if succ == nil {
+			return
+		}
+		err := succ.PutData(request.Key, value, true, 0, sp.context())
+		succ.close()
+		if err != nil {
+			n.logger.Error(n.Addr, " UpdateSet: send succ backup KV: ", err)
+		}
+	}()
+	*ok = true
+	return nil
+}
+
+// IncrementRequest adds Delta to the counter under Key, applied by the owner.
+type IncrementRequest struct {
+	Key   string
+	Delta int64
+	Trace TraceContext
+}
+
+// IncrementCounter replies the new value of the counter. The backup merges the counter
+// into its copy, so that the backups sent out of order do not lose increments.
+func (n *ChordNode) IncrementCounter(request IncrementRequest, value *int64) (err error) {
+	sp := n.startSpan("Increment", request.Trace)
+	sp.set("dht.key", request.Key)
+	defer func() { sp.finish(err) }()
+	if err := n.checkOwner(request.Key); err != nil {
+		n.logger.Warn(n.Addr, " IncrementCounter: ", err)
+		return err
+	}
+	n.writeLock.Lock()
+	counter := newCounterValue()
+	if old, exists := n.data.Get(request.Key); exists {
+		var isCounter bool
+		if counter, isCounter = parseCounter(old); !isCounter {
+			n.writeLock.Unlock()
+			return fmt.Errorf("%w: %s is not a counter", ErrWrongType, request.Key)
+		}
+	}
+	counter.add(n.Addr, request.Delta)
+	stored := counter.encode()
+	if err := n.checkRoom(map[string]string{request.Key: stored}); err != nil {
+		n.writeLock.Unlock()
+		n.logger.Warn(n.Addr, " IncrementCounter: ", err)
+		return err
+	}
+	n.data.Put(request.Key, stored)
+	n.touchWritten(request.Key)
+	n.notifyWatches(EventPut, request.Key, stored)
+	n.writeLock.Unlock()
+	go func() {
+		succ := n.getOnlineSucc()
+		if succ == nil {
+			return
+		}
+		err := succ.PutData(request.Key, stored, true, 0, sp.context())
+		succ.close()
+		if err != nil {
+			n.logger.Error(n.Addr, " Increment: send succ backup KV: ", err)
+		}
+	}()
+	*value = counter.value()
+	return nil
+}
+
+// LeaseRequest acquires, renews or releases the lock Name for the holder ID, see
+// ChordNode.Acquire.
+type LeaseRequest struct {
+	Op    LeaseOp
+	Name  string
+	ID    string
+	Token uint64
+	TTL   time.Duration
+	Trace TraceContext
+}
+
+// Lease applies the request to the lock at its owner, and replies the fencing token. The
+// new state is written to the backup before it is applied, so that a failed backup fails
+// the request, and the successor never grants a lock the owner has granted.
+func (n *ChordNode) Lease(request LeaseRequest, token *uint64) (err error) {
+	sp := n.startSpan("Lease", request.Trace)
+	sp.set("chord.lock", request.Name)
+	defer func() { sp.finish(err) }()
+	key := LockKey(request.Name)
+	if err := n.checkOwner(key); err != nil {
+		n.logger.Warn(n.Addr, " Lease: ", err)
+		return err
+	}
+	n.leaseLock.Lock()
+	defer n.leaseLock.Unlock()
+	state := &lockState{}
+	if old, exists := n.data.Get(key); exists {
+		var isLock bool
+		if state, isLock = parseLock(old); !isLock {
+			return fmt.Errorf("%w: %s is not a lock", ErrWrongType, request.Name)
+		}
+	}
+	if err := state.apply(request, time.Now()); err != nil {
+		return err
+	}
+	value := state.encode()
+	if err := n.checkRoom(map[string]string{key: value}); err != nil {
+		n.logger.Warn(n.Addr, " Lease: ", err)
+		return err
+	}
+	succ := n.getOnlineSucc()
+	if succ == nil {
+		err := fmt.Errorf("no online successor to back %s up", request.Name)
+		n.logger.Error(n.Addr, " Lease: ", err)
+		return err
+	}
+	err = succ.PutData(key, value, true, 0, sp.context())
+	succ.close()
+	if err != nil {
+		n.logger.Error(n.Addr, " Lease: send succ backup KV: ", err)
+		return err
+	}
+	n.writeLock.Lock()
+	n.data.Put(key, value)
+	n.notifyWatches(EventPut, key, value)
+	n.writeLock.Unlock()
+	*token = state.Token
+	return nil
+}
+
+// WatchRequest registers a watch of Key, or with Range of the ids in (From, To], see
+// watchFilter.
+type WatchRequest struct {
+	ID       string
+	Key      string
+	Range    bool
+	From, To uint32
+}
+
+func (n *ChordNode) RegisterWatch(request WatchRequest, ok *bool) error {
+	n.watches.register(request.ID, watchFilter{Key: request.Key, Range: request.Range, From: request.From, To: request.To})
+	*ok = true
+	return nil
+}
+
+type PollWatchRequest struct {
+	ID string
+	// Wait is how long to wait for an event
+	Wait time.Duration
+}
+
+type PollWatchReply struct {
+	Events []Event
+	// Lost tells that the queue of the watch was full
+	Lost bool
+}
+
+// PollWatch replies the queued events of a watch, waiting for one if there is none.
+func (n *ChordNode) PollWatch(request PollWatchRequest, reply *PollWatchReply) error {
+	timer := time.NewTimer(request.Wait)
+	defer timer.Stop()
+	w := &n.watches
+	for timedOut := false; ; {
+		w.lock.Lock()
+		sub := w.subs[request.ID]
+		if sub == nil || !n.online.Load() {
+			w.lock.Unlock()
+			return fmt.Errorf("watch %s not found", request.ID)
+		}
+		sub.expire = time.Now().Add(watchLease)
+		if len(sub.events) > 0 || sub.lost || timedOut {
+			reply.Events, reply.Lost = sub.events, sub.lost
+			sub.events, sub.lost = nil, false
+			w.lock.Unlock()
+			return nil
+		}
+		wake := sub.wake
+		w.lock.Unlock()
+		select {
+		case <-wake:
+		case <-timer.C:
+			timedOut = true
+		}
+	}
+}
+
+func (n *ChordNode) CancelWatch(id string, ok *bool) error {
+	n.watches.cancel(id)
+	*ok = true
+	return nil
+}
+
+type PublishRequest struct {
+	Topic, Data string
+}
+
+// PublishTopic queues the message for the subscribers of the topic, and replies how many
+// there are. It fails with ErrNotOwner unless the node owns the topic, whose subscribers
+// it would not know.
+func (n *ChordNode) PublishTopic(request PublishRequest, count *int) error {
+	if err := n.checkOwner(TopicKey(request.Topic)); err != nil {
+		n.logger.Warn(n.Addr, " PublishTopic: ", err)
+		return err
+	}
+	subscribers := n.subscribers(request.Topic)
+	n.topics.publish(Message{Topic: request.Topic, Data: request.Data}, subscribers)
+	*count = len(subscribers)
+	return nil
+}
+
+type PollTopicRequest struct {
+	Topic, ID string
+	Wait      time.Duration
+}
+
+// PollTopic replies the queued messages of a subscriber, waiting for one if there is none.
+func (n *ChordNode) PollTopic(request PollTopicRequest, msgs *[]Message) error {
+	timer := time.NewTimer(request.Wait)
+	defer timer.Stop()
+	t := &n.topics
+	for timedOut := false; ; {
+		if !n.online.Load() {
+			return fmt.Errorf("node %s is offline", n.Addr)
+		}
+		if err := n.checkSubscriber(request.Topic, request.ID); err != nil {
+			return err
+		}
+		t.lock.Lock()
+		q := t.queue(request.Topic, request.ID)
+		if len(q.msgs) > 0 || timedOut {
+			*msgs, q.msgs = q.msgs, nil
+			t.lock.Unlock()
+			return nil
+		}
+		t.lock.Unlock()
+		select {
+		case <-q.wake:
+		case <-timer.C:
+			timedOut = true
+		}
+	}
+}
+
+// ExportData replies a page of the primary data in the order of the keys, see ExportRing.
+func (n *ChordNode) ExportData(request ExportRequest, reply *ExportReply) error {
+	var err error
+	*reply, err = n.exportPage(request)
+	return err
+}
+
+// TouchChunks keeps the chunks of keys from the garbage collection for a while, see
+// collectChunks.
+func (n *ChordNode) TouchChunks(keys []string, ok *bool) error {
+	n.chunks.touch(keys...)
 	*ok = true
 	return nil
 }
@@ -198,16 +964,20 @@ func (n *ChordNode) DeleteData(request DeleteDataRequest, ok *bool) error {
 type SuccInformExitRequest struct {
 	Addr, PreAddr string
 	Data          map[string]string
+	Trace         TraceContext
 }
 
 func (n *ChordNode) SuccInformExit(request SuccInformExitRequest, ok *bool) error {
-	logrus.Infof("%s SuccInformExit: %s %s", n.Addr, request.Addr, request.PreAddr)
+	sp := n.startSpan("SuccInformExit", request.Trace)
+	sp.set("chord.keys", len(request.Data))
+	defer sp.finish(nil)
+	n.logger.Infof("%s SuccInformExit: %s %s", n.Addr, request.Addr, request.PreAddr)
 	n.predecsorLock.Lock()
 	if request.Addr == n.predecessor.remoteAddr {
 		n.predecessor.close()
-		err := n.predecessor.Dial(request.PreAddr)
+		err := n.predecessor.Dial(request.PreAddr, &n.cfg)
 		if err != nil {
-			logrus.Error(n.Addr, " SuccInformExit: dialing new predecessor failed with ", err)
+			n.logger.Error(n.Addr, " SuccInformExit: dialing new predecessor failed with ", err)
 			n.predecessor.close()
 		}
 		n.predecsorLock.Unlock()
@@ -216,15 +986,19 @@ func (n *ChordNode) SuccInformExit(request SuccInformExitRequest, ok *bool) erro
 		n.predecsorLock.Unlock()
 		return nil
 	}
-	n.dataLock.Lock()
-	for k, v := range request.Data {
-		n.data[k] = v
-	}
-	n.dataLock.Unlock()
+	n.mergePrimary(request.Data)
 	go func(data *map[string]string) {
 		succ := n.getOnlineSucc()
+		if succ == nil {
+			return
+		}
 		if err := succ.SendBackupData(data); err != nil {
-			logrus.Error(n.Addr, " SuccInformExit: failed to send backup data to ", succ.remoteAddr, " with error: ", err)
+			n.logger.Error(n.Addr, " SuccInformExit: failed to send backup data to ", succ.remoteAddr, " with error: ", err)
+		}
+		if n.cfg.Replication > 1 {
+			if err := succ.RefreshBackup(n.cfg.Replication - 1); err != nil {
+				n.logger.Error(n.Addr, " SuccInformExit: failed to refresh backup of successors ", err)
+			}
 		}
 		succ.close()
 	}(&request.Data)
@@ -233,10 +1007,13 @@ func (n *ChordNode) SuccInformExit(request SuccInformExitRequest, ok *bool) erro
 
 type PredInformExitRequest struct {
 	Addr, SuccAddr string
+	Trace          TraceContext
 }
 
 func (n *ChordNode) PredInformExit(request PredInformExitRequest, ok *bool) error {
-	logrus.Infof("%s PredInformExit: %s %s", n.Addr, request.Addr, request.SuccAddr)
+	sp := n.startSpan("PredInformExit", request.Trace)
+	defer sp.finish(nil)
+	n.logger.Infof("%s PredInformExit: %s %s", n.Addr, request.Addr, request.SuccAddr)
 	n.succListLock.Lock()
 	if n.succList[0] == request.Addr {
 		n.succList[0] = request.SuccAddr
@@ -1,9 +1,22 @@
 package chord
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 const P = 20000
@@ -12,6 +25,89 @@ func makeLocalAddr(port int) string {
 	return fmt.Sprintf("127.0.0.1:%d", P+port)
 }
 
+// startRing starts n nodes made with opts and joins them to the first one, one after the
+// other once the ring is stable. The nodes which have not quit are quit when the test ends.
+func startRing(t *testing.T, n int, opts ...Option) []*ChordNode {
+	t.Helper()
+	nodes := make([]*ChordNode, n)
+	for i := range nodes {
+		nodes[i] = CreateChordNode(makeLocalAddr(i), opts...)
+		if err := nodes[i].Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.Quit()
+		}
+	})
+	nodes[0].Create()
+	for i := 1; i < n; i++ {
+		if !nodes[i].Join(makeLocalAddr(0)) {
+			t.Fatalf("node %d failed to join", i)
+		}
+		if !waitFor(5*time.Second, func() bool { return ringStable(nodes[:i+1]) }) {
+			t.Fatalf("ring not stable after node %d joined", i)
+		}
+	}
+	return nodes
+}
+
+// ringStable returns whether the successor and the predecessor of every node are its
+// neighbours on the circle.
+func ringStable(nodes []*ChordNode) bool {
+	ring := append([]*ChordNode(nil), nodes...)
+	sort.Slice(ring, func(i, j int) bool { return ring[i].Id < ring[j].Id })
+	for i, n := range ring {
+		n.succListLock.RLock()
+		succ := n.succList[0]
+		n.succListLock.RUnlock()
+		n.predecsorLock.RLock()
+		pred := n.predecessor.remoteAddr
+		n.predecsorLock.RUnlock()
+		if succ != ring[(i+1)%len(ring)].Addr || pred != ring[(i+len(ring)-1)%len(ring)].Addr {
+			return false
+		}
+	}
+	return true
+}
+
+// waitFor polls cond until it holds or timeout passes, and returns whether it held.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// without returns nodes except the one at addr
+func without(nodes []*ChordNode, addr string) []*ChordNode {
+	var rest []*ChordNode
+	for _, n := range nodes {
+		if n.Addr != addr {
+			rest = append(rest, n)
+		}
+	}
+	return rest
+}
+
+// backupKeys counts the pairs in all the backups of nodes
+func backupKeys(nodes []*ChordNode) int {
+	count := 0
+	for _, n := range nodes {
+		n.backupDataLock.RLock()
+		for _, backup := range n.backupData {
+			count += backup.Len()
+		}
+		n.backupDataLock.RUnlock()
+	}
+	return count
+}
+
 func TestSmallNodes(t *testing.T) {
 	const N, N1 = 3, 2
 	var nodes [N]*ChordNode
@@ -142,3 +238,1328 @@ func TestQAFQ(t *testing.T) {
 	}
 	time.Sleep(1 * time.Second)
 }
+
+func TestMetrics(t *testing.T) {
+	nodes := startRing(t, 3)
+	metricsAddr := makeLocalAddr(100)
+	if err := nodes[0].ServeMetrics(metricsAddr); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		nodes[0].Put(fmt.Sprint(i), fmt.Sprint(i))
+	}
+	resp, err := http.Get("http://" + metricsAddr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, name := range []string{
+		"chord_rpc_served_total{method=\"ChordNode.Ping\"}",
+		"chord_lookup_hops_count 10",
+		"chord_stabilize_success_total",
+		"chord_data_keys",
+	} {
+		if !strings.Contains(string(body), name) {
+			t.Errorf("metrics should contain %s", name)
+		}
+	}
+	for _, n := range nodes {
+		n.Quit()
+	}
+	if _, err := http.Get("http://" + metricsAddr + "/metrics"); err == nil {
+		t.Errorf("metrics should be closed after quit")
+	}
+}
+
+func TestLoggerOption(t *testing.T) {
+	var buf bytes.Buffer
+	// the log options are kept by WithConfig
+	node := startRing(t, 1, WithLogOutput(&buf), WithJSONLog(), WithLogLevel(logrus.InfoLevel),
+		WithConfig(DefaultConfig()))[0]
+	node.Quit()
+	if !strings.Contains(buf.String(), `"node":"`+makeLocalAddr(0)+`"`) {
+		t.Errorf("log should be JSON with the node field, got %s", buf.String())
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	if _, err := NewChordNode(makeLocalAddr(0), WithSuccListLen(2), WithReplication(3)); err == nil {
+		t.Errorf("replication larger than the successor list should be rejected")
+	}
+	if _, err := NewChordNode(makeLocalAddr(0), WithTTL(-1)); err == nil {
+		t.Errorf("negative TTL should be rejected")
+	}
+	if err := (&Config{}).Validate(); err != nil {
+		t.Errorf("zero config takes the defaults: %v", err)
+	}
+	if err := (&Config{DialTimeout: -time.Second}).Validate(); err == nil {
+		t.Errorf("negative dial timeout should be rejected")
+	}
+}
+
+func TestReplication(t *testing.T) {
+	const N, M = 8, 50
+	nodes := startRing(t, N, WithReplication(3),
+		WithIntervals(100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond))
+	for i := 0; i < M; i++ {
+		if !nodes[i%N].Put(fmt.Sprint(i), fmt.Sprint(i)) {
+			t.Errorf("put %d failed", i)
+		}
+	}
+	if !waitFor(5*time.Second, func() bool { return backupKeys(nodes) == 3*M }) {
+		t.Fatalf("%d pairs in the backups, want %d", backupKeys(nodes), 3*M)
+	}
+	// force quit two adjacent nodes, whose data should be kept by the third successor
+	ring := append([]*ChordNode(nil), nodes...)
+	sort.Slice(ring, func(i, j int) bool { return ring[i].Id < ring[j].Id })
+	survivor := ring[0]
+	ring[1].ForceQuit()
+	ring[2].ForceQuit()
+	waitFor(5*time.Second, func() bool { return ringStable(append(ring[:1:1], ring[3:]...)) })
+	for i := 0; i < M; i++ {
+		ok, val := survivor.Get(fmt.Sprint(i))
+		if !ok || val != fmt.Sprint(i) {
+			t.Errorf("get %d: %v %s", i, ok, val)
+		}
+	}
+}
+
+type memExporter struct {
+	lock  sync.Mutex
+	spans []Span
+}
+
+func (e *memExporter) ExportSpan(span Span) {
+	e.lock.Lock()
+	e.spans = append(e.spans, span)
+	e.lock.Unlock()
+}
+
+func (e *memExporter) Close() error { return nil }
+
+func TestTracing(t *testing.T) {
+	exporter := &memExporter{}
+	nodes := startRing(t, 4, WithSpanExporter(exporter), WithReplication(2))
+	if !nodes[1].Put("traced", "value") {
+		t.Fatal("put failed")
+	}
+	// the spans of the trace of the Put by name, nil before the span of the Put is exported
+	trace := func() map[string]int {
+		exporter.lock.Lock()
+		defer exporter.lock.Unlock()
+		var root *Span
+		for i := range exporter.spans {
+			if s := exporter.spans[i]; s.Name == "Put" && s.Attrs["dht.key"] == "traced" {
+				root = &exporter.spans[i]
+			}
+		}
+		if root == nil {
+			return nil
+		}
+		names := make(map[string]int)
+		for _, s := range exporter.spans {
+			if s.TraceID == root.TraceID {
+				names[s.Name]++
+			}
+		}
+		return names
+	}
+	// the backups are written after the Put returns
+	waitFor(2*time.Second, func() bool { return trace()["PutData"] == 3 })
+	names := trace()
+	if names == nil {
+		t.Fatal("no span for Put")
+	}
+	if names["FindSuccessor"] == 0 || names["PutData"] != 3 {
+		t.Errorf("spans of the Put trace: %v", names)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var posted int
+	var lock sync.Mutex
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		posted++
+		lock.Unlock()
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+	e := NewOTLPExporter(collector.URL, "test")
+	e.ExportSpan(Span{Name: "Put"})
+	if err := e.Close(); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("close should report the rejected batch: %v", err)
+	}
+	// spans after Close are dropped
+	e.ExportSpan(Span{Name: "Get"})
+	e.Close()
+	lock.Lock()
+	defer lock.Unlock()
+	if posted != 1 {
+		t.Errorf("%d batches posted", posted)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	const N = 3
+	nodes := startRing(t, N)
+	adminAddr := makeLocalAddr(101)
+	if err := nodes[0].ServeAdmin(adminAddr); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		nodes[1].Put(fmt.Sprint(i), fmt.Sprint(i))
+	}
+	base := "http://" + adminAddr + "/admin/"
+	var info NodeInfo
+	resp, err := http.Get(base + "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if info.Addr != makeLocalAddr(0) || !info.Online {
+		t.Errorf("node info: %+v", info)
+	}
+	resp, err = http.Get(base + "health")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("health: %v %v", resp.StatusCode, err)
+	}
+	resp.Body.Close()
+	resp, err = http.Post(base+"fix-fingers", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixed struct {
+		Failed  int
+		Routing RoutingInfo
+	}
+	json.NewDecoder(resp.Body).Decode(&fixed)
+	resp.Body.Close()
+	if fixed.Failed != 0 || len(fixed.Routing.Fingers) == 0 || fixed.Routing.Predecessor == "" {
+		t.Errorf("fix-fingers: %+v", fixed)
+	}
+	if resp, err = http.Get(base + "quit"); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("quit should only accept POST")
+	}
+	resp.Body.Close()
+	resp, err = http.Post(base+"quit", "", nil)
+	if err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("quit: %v", err)
+	}
+	resp.Body.Close()
+	keys := func() int {
+		keys := 0
+		for i := 1; i < N; i++ {
+			keys += nodes[i].StorageInfo().DataKeys
+		}
+		return keys
+	}
+	waitFor(2*time.Second, func() bool { return !nodes[0].online.Load() && keys() == 10 })
+	if nodes[0].online.Load() {
+		t.Errorf("node should quit")
+	}
+	if keys := keys(); keys != 10 {
+		t.Errorf("%d keys left after quit", keys)
+	}
+}
+
+func TestCrawl(t *testing.T) {
+	const N, M = 5, 40
+	nodes := startRing(t, N, WithReplication(2))
+	for i := 0; i < N; i++ {
+		nodes[i].RefreshFingers()
+	}
+	for i := 0; i < M; i++ {
+		nodes[i%N].Put(fmt.Sprint(i), fmt.Sprint(i))
+	}
+	// the backups are written after the Puts return
+	var report *RingReport
+	var err error
+	waitFor(2*time.Second, func() bool {
+		report, err = Crawl(makeLocalAddr(2))
+		return err == nil && report.Healthy() && report.Ownership.Keys == M
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	report.WriteText(&buf)
+	if !report.Healthy() || len(report.Order) != N || report.Ownership.Keys != M {
+		t.Errorf("ring should be consistent:\n%s", buf.String())
+	}
+	buf.Reset()
+	report.WriteDOT(&buf)
+	if strings.Count(buf.String(), "style=dashed") != N {
+		t.Errorf("DOT should have a predecessor edge per node:\n%s", buf.String())
+	}
+
+	// the start is told by its id, however its address is written
+	if report, err = Crawl(strings.Replace(makeLocalAddr(2), "127.0.0.1", "localhost", 1)); err != nil || !report.Closed {
+		t.Errorf("crawl from localhost should close the ring: %v", err)
+	}
+	var link chordLink
+	if err := link.Dial(makeLocalAddr(0), &nodes[0].cfg); err != nil {
+		t.Fatal(err)
+	}
+	request, paged := KeysRequest{Limit: 3}, 0
+	for {
+		var reply KeysReply
+		if err := link.InspectKeys(request, &reply); err != nil {
+			t.Fatal(err)
+		}
+		paged += len(reply.Keys)
+		if !reply.More {
+			break
+		}
+		request.Scan, request.After = reply.Scan, reply.Keys[len(reply.Keys)-1]
+	}
+	link.close()
+	if paged != nodes[0].data.Len() {
+		t.Errorf("paged %d keys of %d", paged, nodes[0].data.Len())
+	}
+
+	remote, err := DialRemote(makeLocalAddr(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, path, err := remote.Lookup("7")
+	remote.Close()
+	if err != nil || len(path) == 0 || path[0] != makeLocalAddr(3) {
+		t.Errorf("lookup path %v: %v", path, err)
+	}
+	if remote, err = DialRemote(owner); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := remote.Get("7")
+	if _, value := splitVersion(stored); err != nil || value != "7" {
+		t.Errorf("get from owner %s: %s %v", owner, value, err)
+	}
+	remote.Close()
+
+	ring := append([]*ChordNode(nil), nodes...)
+	sort.Slice(ring, func(i, j int) bool { return ring[i].Id < ring[j].Id })
+	ring[1].ForceQuit()
+	report, err = Crawl(ring[0].Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Healthy() || len(report.Unreachable) != 1 {
+		t.Errorf("crawl should find the failed node unreachable, got %v", report.Unreachable)
+	}
+}
+
+func TestGateway(t *testing.T) {
+	nodes := startRing(t, 3)
+	server := httptest.NewServer(nodes[1].GatewayHandler())
+	defer server.Close()
+	do := func(method, path, body string, header ...string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	expect := func(resp *http.Response, status int, what string) {
+		if resp.StatusCode != status {
+			t.Errorf("%s: status %d, want %d", what, resp.StatusCode, status)
+		}
+	}
+	expect(do("GET", "/kv/a%2Fb", ""), http.StatusNotFound, "get missing")
+	put := do("PUT", "/kv/a%2Fb", "v1")
+	expect(put, http.StatusNoContent, "put")
+	etag1 := put.Header.Get("ETag")
+	expect(do("PUT", "/kv/a%2Fb", "v2", "If-None-Match", "*"), http.StatusPreconditionFailed, "create existing")
+	expect(do("PUT", "/kv/a%2Fb", "v2", "If-Match", `"1"`), http.StatusPreconditionFailed, "put with wrong etag")
+	put = do("PUT", "/kv/a%2Fb", "v2", "If-Match", etag1)
+	expect(put, http.StatusNoContent, "put with etag")
+	etag2 := put.Header.Get("ETag")
+	if value, err := nodes[2].Fetch("a/b"); err != nil || value != "v2" {
+		t.Errorf("fetch: %s %v", value, err)
+	}
+	resp := do("GET", "/kv/a%2Fb", "")
+	expect(resp, http.StatusOK, "get")
+	if resp.Header.Get("ETag") != etag2 {
+		t.Errorf("etag %s, put gave %s", resp.Header.Get("ETag"), etag2)
+	}
+	expect(do("GET", "/kv/a%2Fb", "", "If-None-Match", etag2), http.StatusNotModified, "get not modified")
+	expect(do("GET", "/kv/a%2Fb", "", "If-None-Match", etag1+", W/"+etag2), http.StatusNotModified, "get not modified by list")
+	expect(do("GET", "/kv/a%2Fb", "", "If-None-Match", "*"), http.StatusNotModified, "get not modified by *")
+	expect(do("GET", "/kv/a%2Fb", "", "If-None-Match", etag1), http.StatusOK, "get modified")
+	// the value back to v1 is still another version
+	expect(do("PUT", "/kv/a%2Fb", "v1"), http.StatusNoContent, "put back")
+	expect(do("PUT", "/kv/a%2Fb", "v3", "If-Match", etag1), http.StatusPreconditionFailed, "put with the etag of an old equal value")
+	expect(do("DELETE", "/kv/a%2Fb", "", "If-Match", etag2), http.StatusPreconditionFailed, "delete with wrong etag")
+	expect(do("DELETE", "/kv/a%2Fb", ""), http.StatusNoContent, "delete")
+	expect(do("DELETE", "/kv/a%2Fb", ""), http.StatusNotFound, "delete missing")
+
+	expect(do("POST", "/batch/put", `{"x":"1","y":"2"}`), http.StatusOK, "batch put")
+	batch, err := http.Post(server.URL+"/batch/get", "application/json", strings.NewReader(`["x","y","z"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results map[string]BatchResult
+	json.NewDecoder(batch.Body).Decode(&results)
+	batch.Body.Close()
+	if results["x"].Value != "1" || results["y"].Status != http.StatusOK || results["z"].Status != http.StatusNotFound {
+		t.Errorf("batch get: %+v", results)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	const N, M = 5, 200
+	nodes := startRing(t, N, WithReplication(2))
+	pairs := make(map[string]string)
+	for i := 0; i < M; i++ {
+		pairs[fmt.Sprint(i)] = fmt.Sprint(i)
+	}
+	served := nodes[0].Stats().RPCServed
+	for key, err := range nodes[0].PutMany(pairs) {
+		if err != nil {
+			t.Errorf("put %s: %v", key, err)
+		}
+	}
+	// a lookup and a GetPredecessor per owner, instead of a lookup per key
+	if rpcs := nodes[0].Stats().RPCServed - served; rpcs > 4*N {
+		t.Errorf("PutMany served %d RPCs on the calling node", rpcs)
+	}
+	// the backups are written after PutMany returns
+	var report *RingReport
+	var err error
+	waitFor(2*time.Second, func() bool {
+		report, err = Crawl(makeLocalAddr(0))
+		return err == nil && report.Replicas.UnderReplicatedCnt == 0
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Ownership.Keys != M || report.Ownership.ViolationCnt != 0 || report.Replicas.UnderReplicatedCnt != 0 {
+		t.Errorf("keys %d, violations %d, under-replicated %d", report.Ownership.Keys,
+			report.Ownership.ViolationCnt, report.Replicas.UnderReplicatedCnt)
+	}
+	results := nodes[1].GetMany([]string{"1", "2", "missing"})
+	if results["1"].Value != "1" || results["2"].Err != nil || !errors.Is(results["missing"].Err, ErrNotFound) {
+		t.Errorf("get many: %+v", results)
+	}
+	errs := nodes[2].DeleteMany([]string{"1", "2", "missing"})
+	if errs["1"] != nil || errs["2"] != nil || !errors.Is(errs["missing"], ErrNotFound) {
+		t.Errorf("delete many: %v", errs)
+	}
+	if ok, _ := nodes[3].Get("1"); ok {
+		t.Errorf("key 1 should be deleted")
+	}
+}
+
+func TestBinaryData(t *testing.T) {
+	exporter := &memExporter{}
+	nodes := startRing(t, 3, WithSizeLimits(16, 64), WithSpanExporter(exporter))
+	key, value := []byte{0, 0xff, 'k', 0xc3}, []byte{0xfe, 0, 0, 0x80, '\n'}
+	if err := nodes[1].PutBytes(key, value); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := nodes[2].GetBytes(key); err != nil || !bytes.Equal(got, value) {
+		t.Errorf("get bytes: %v %v", got, err)
+	}
+	if err := nodes[0].PutBytes(key, make([]byte, 65)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("large value: %v", err)
+	}
+	if errs := nodes[0].PutMany(map[string]string{"ok": "1", strings.Repeat("k", 17): "2"}); errs["ok"] != nil ||
+		!errors.Is(errs[strings.Repeat("k", 17)], ErrTooLarge) {
+		t.Errorf("put many with a large key: %v", errs)
+	}
+
+	server := httptest.NewServer(nodes[0].GatewayHandler())
+	defer server.Close()
+	resp, err := http.Post(server.URL+"/batch/get?encoding=base64", "application/json",
+		strings.NewReader(`["`+base64.StdEncoding.EncodeToString(key)+`"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results map[string]BatchResult
+	json.NewDecoder(resp.Body).Decode(&results)
+	resp.Body.Close()
+	if res := results[base64.StdEncoding.EncodeToString(key)]; res.Value != base64.StdEncoding.EncodeToString(value) {
+		t.Errorf("batch get in base64: %+v", results)
+	}
+
+	// the key is kept in the spans and in the JSON of a crawl
+	exporter.lock.Lock()
+	traced := false
+	for _, s := range exporter.spans {
+		traced = traced || s.Attrs["dht.key"] == `\x00\xffk\xc3`
+	}
+	exporter.lock.Unlock()
+	if !traced {
+		t.Errorf("no span with the escaped key")
+	}
+	b, _ := json.Marshal(KeyViolation{Key: ReportKey(key)})
+	var v KeyViolation
+	if err := json.Unmarshal(b, &v); err != nil || v.Key != ReportKey(key) {
+		t.Errorf("key in a report: %s %v", b, err)
+	}
+}
+
+func TestChunks(t *testing.T) {
+	nodes := startRing(t, 4, WithChunkSize(64), WithChunkGC(200*time.Millisecond))
+	chunks := func() int {
+		count := 0
+		for _, n := range nodes {
+			for key := range n.LocalData() {
+				if isChunkKey(key) {
+					count++
+				}
+			}
+		}
+		return count
+	}
+
+	var b strings.Builder
+	for i := 0; b.Len() < 1000; i++ {
+		fmt.Fprintf(&b, "line %d\n", i)
+	}
+	large := b.String()
+	if !nodes[1].Put("a", large) || !nodes[1].Put("b", large) {
+		t.Fatal("put large value failed")
+	}
+	if ok, value := nodes[2].Get("a"); !ok || value != large {
+		t.Errorf("get large value: %v %d bytes", ok, len(value))
+	}
+	if n := chunks(); n != (len(large)+63)/64 {
+		t.Errorf("%d chunks for a value of %d bytes", n, len(large))
+	}
+	r, err := nodes[3].Open("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != large || r.Size != int64(len(large)) {
+		t.Errorf("open large value: %v size %d", err, r.Size)
+	}
+	ra, err := nodes[3].Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra.ETag == r.ETag {
+		t.Errorf("keys of equal values should have their own etags")
+	}
+	if err := nodes[0].Store("a", large+"!", Precondition{IfMatch: ra.ETag}); err != nil {
+		t.Errorf("store with the etag of the value: %v", err)
+	}
+	// a small value which looks like a manifest is chunked as well
+	fake := manifestMagic + `{"size":1}`
+	if !nodes[0].Put("c", fake) {
+		t.Error("put fake manifest failed")
+	}
+	if ok, value := nodes[1].Get("c"); !ok || value != fake {
+		t.Errorf("get fake manifest: %q", value)
+	}
+
+	// the chunks are written only by the nodes
+	for key := range nodes[0].LocalData() {
+		if isChunkKey(key) {
+			if err := nodes[1].Store(key, "x", Precondition{}); !errors.Is(err, ErrReservedKey) {
+				t.Errorf("store over a chunk: %v", err)
+			}
+			if err := nodes[1].Remove(key, Precondition{}); !errors.Is(err, ErrReservedKey) {
+				t.Errorf("delete a chunk: %v", err)
+			}
+			break
+		}
+	}
+
+	// the chunks of "a" which are not its last one are shared with "b", and only that of
+	// "c" is left without a manifest
+	nodes[2].Delete("c")
+	before := chunks()
+	waitFor(5*time.Second, func() bool { return chunks() < before })
+	if after := chunks(); after != before-1 {
+		t.Errorf("%d chunks before gc, %d after", before, after)
+	}
+	if ok, value := nodes[0].Get("b"); !ok || value != large {
+		t.Errorf("get large value after gc: %v %d bytes", ok, len(value))
+	}
+}
+
+// The owner refuses the reserved keys in the requests of any caller, not only of the
+// nodes and the clients which check them first.
+func TestReservedKeysAtOwner(t *testing.T) {
+	nodes := startRing(t, 1)
+	r, err := DialRemote(nodes[0].Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	chunk := chunkKey(chunkHash([]byte("x")))
+	for _, key := range []string{LockKey("l"), TopicKey("t"), chunk} {
+		if err := r.Put(key, "y"); !errors.Is(err, ErrReservedKey) {
+			t.Errorf("put %q: %v", key, err)
+		}
+		if err := r.PutBatch(map[string]string{key: "y"}); !errors.Is(err, ErrReservedKey) {
+			t.Errorf("put batch %q: %v", key, err)
+		}
+		if err := r.Delete(key); !errors.Is(err, ErrReservedKey) {
+			t.Errorf("delete %q: %v", key, err)
+		}
+		if err := r.link.DeleteDataBatch([]string{key}, false, 0, TraceContext{}, nil); !errors.Is(err, ErrReservedKey) {
+			t.Errorf("delete batch %q: %v", key, err)
+		}
+	}
+	// a chunk under the hash of its content is taken, as the clients write it
+	if err := r.Put(chunk, "x"); err != nil {
+		t.Errorf("put chunk: %v", err)
+	}
+	if len(nodes[0].LocalData()) != 1 {
+		t.Errorf("data after the refused writes: %v", nodes[0].LocalData())
+	}
+}
+
+func TestSetMerge(t *testing.T) {
+	now := time.Now().UnixNano()
+	base := newSetValue()
+	base.add([]string{"x"}, 0, now)
+	a, _ := parseSet(base.encode())
+	b, _ := parseSet(base.encode())
+	// a removes x and adds it again while b adds y
+	a.remove([]string{"x"}, now)
+	a.add([]string{"x"}, 0, now)
+	b.add([]string{"y"}, now+int64(time.Hour), now)
+	b.merge(a)
+	if got := b.members(now); len(got) != 2 || got[0] != "x" || got[1] != "y" {
+		t.Errorf("add should win over a concurrent remove: %v", got)
+	}
+	a.merge(b)
+	// adding a member again refreshes its tag instead of leaving a tombstone, and the
+	// merge keeps the later expiry
+	tombstones := len(a.Removed)
+	a.add([]string{"y"}, now+2*int64(time.Hour), now)
+	if len(a.Removed) != tombstones || len(a.Adds["y"]) != 1 {
+		t.Errorf("add again: %d tombstones, %d tags", len(a.Removed)-tombstones, len(a.Adds["y"]))
+	}
+	c, _ := parseSet(a.encode())
+	c.add([]string{"y"}, now+3*int64(time.Hour), now)
+	a.merge(c)
+	c.merge(a)
+	for _, set := range []*setValue{a, c} {
+		for _, expire := range set.Adds["y"] {
+			if expire != now+3*int64(time.Hour) {
+				t.Errorf("expiry after merge: %v", time.Duration(expire-now))
+			}
+		}
+	}
+	// b removes y after seeing its add, so y is gone in the merge
+	b.remove([]string{"y"}, now)
+	s := NewMemStorage()
+	s.Put("k", a.encode())
+	mergeData(s, map[string]string{"k": b.encode(), "plain": "v"})
+	stored, _ := s.Get("k")
+	if got, err := SetMembers(stored); err != nil || len(got) != 1 || got[0] != "x" {
+		t.Errorf("merged set: %v %v", got, err)
+	}
+}
+
+func TestStorageSnapshot(t *testing.T) {
+	s := newSizedStorage(NewMemStorage(), nil)
+	s.Merge(map[string]string{"a": "1", "b": "2", "c": "3"})
+	snap := snapshot(s)
+	s.Put("a", "changed")
+	s.Delete("b")
+	s.DeleteFunc(func(key string) bool { return key == "c" })
+	s.Merge(map[string]string{"d": "4"})
+	if len(snap) != 3 || snap["a"] != "1" || snap["b"] != "2" || snap["c"] != "3" {
+		t.Errorf("snapshot changed by the writes: %v", snap)
+	}
+	if got := s.Copy(); len(got) != 2 || got["a"] != "changed" || got["d"] != "4" {
+		t.Errorf("storage after the writes: %v", got)
+	}
+	// the writers go on while snapshots are read, as by the encoding of GetAllData
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			s.Put(fmt.Sprint(i%10), "v")
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		for k := range snapshot(s) {
+			_ = k
+		}
+	}
+	<-done
+}
+
+func TestSizedStorageStats(t *testing.T) {
+	tracked := func(key, value string) bool { return strings.HasPrefix(key, "t") }
+	s := newSizedStorage(NewMemStorage(), tracked)
+	ns := nsKeyPrefix + "ns\x00"
+	s.Merge(map[string]string{"a": "1", "t1": "2", ns + "b": "33"})
+	s.Put(ns+"b", "4")
+	s.Put("t2", "5")
+	s.Delete("a")
+	s.DeleteFunc(func(key string) bool { return key == "t1" })
+	stats := s.NamespaceStats()
+	if len(stats) != 2 || stats[""] != (NamespaceStats{Keys: 1, Bytes: 3}) || stats["ns"] != (NamespaceStats{Keys: 1, Bytes: int64(len(ns) + 2)}) {
+		t.Errorf("namespace stats: %v", stats)
+	}
+	if keys := s.TrackedKeys(); len(keys) != 1 || keys[0] != "t2" {
+		t.Errorf("tracked keys: %v", keys)
+	}
+	if s.Bytes() != int64(3+len(ns)+2) {
+		t.Errorf("bytes: %d", s.Bytes())
+	}
+}
+
+func TestSets(t *testing.T) {
+	const N = 4
+	nodes := startRing(t, N)
+
+	// concurrent adds are not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := nodes[i%N].AddToSet("peers", 0, fmt.Sprintf("peer%02d", i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if members, err := nodes[1].GetSet("peers"); err != nil || len(members) != 20 {
+		t.Errorf("get set after concurrent adds: %v %v", members, err)
+	}
+	if err := nodes[2].RemoveFromSet("peers", "peer00", "peer01"); err != nil {
+		t.Error(err)
+	}
+	if err := nodes[3].AddToSet("peers", 300*time.Millisecond, "short"); err != nil {
+		t.Error(err)
+	}
+	if members, _ := nodes[0].GetSet("peers"); len(members) != 19 || members[0] != "peer02" || members[18] != "short" {
+		t.Errorf("get set: %v", members)
+	}
+	waitFor(2*time.Second, func() bool {
+		members, _ := nodes[0].GetSet("peers")
+		return len(members) == 18
+	})
+	if members, _ := nodes[0].GetSet("peers"); len(members) != 18 {
+		t.Errorf("member with ttl not expired: %v", members)
+	}
+
+	if _, err := nodes[0].Fetch("peers"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("get a set: %v", err)
+	}
+	nodes[0].Put("plain", "v")
+	if err := nodes[1].AddToSet("plain", 0, "m"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("add to a plain value: %v", err)
+	}
+	if _, err := nodes[1].GetSet("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("get missing set: %v", err)
+	}
+
+	// the backups of a set are merged, so that an older one coming late is not kept
+	older, newer := newSetValue(), newSetValue()
+	older.add([]string{"a"}, 0, time.Now().UnixNano())
+	newer.merge(older)
+	newer.add([]string{"b"}, 0, time.Now().UnixNano())
+	var etag string
+	for _, set := range []*setValue{newer, older} {
+		request := PutDataRequest{IsBackup: true, Key: "backup-set", Value: set.encode()}
+		if err := nodes[0].PutData(request, &etag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored, _ := nodes[0].backupLevel(0).Get("backup-set")
+	if members, err := SetMembers(stored); err != nil || len(members) != 2 {
+		t.Errorf("backup set written out of order: %v %v", members, err)
+	}
+
+	owner, _ := nodes[0].lookup("peers", TraceContext{})
+	rest := without(nodes, owner)
+	var ok bool
+	if err := rest[0].UpdateSet(UpdateSetRequest{Key: "peers", Add: []string{"m"}}, &ok); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("update a set at a node not owning it: %v", err)
+	}
+
+	// the set moves to the successor with the owner
+	for _, n := range nodes {
+		if n.Addr == owner {
+			n.Quit()
+		}
+	}
+	waitFor(5*time.Second, func() bool { return ringStable(rest) })
+	if members, err := rest[0].GetSet("peers"); err != nil || len(members) != 18 {
+		t.Errorf("get set after the owner quits: %v %v", members, err)
+	}
+}
+
+func nextEvent(t *testing.T, w *Watcher) Event {
+	t.Helper()
+	select {
+	case ev := <-w.Events:
+		return ev
+	case <-time.After(3 * time.Second):
+		t.Fatal("no event")
+		return Event{}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	nodes := startRing(t, 4)
+	owner, _ := nodes[0].lookup("k", TraceContext{})
+	rest := without(nodes, owner)
+	watching, writer := rest[0], rest[1]
+	w, err := watching.Watch("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	all, err := watching.WatchRange(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Close()
+
+	writer.Put("other", "x")
+	writer.Put("k", "v1")
+	writer.Delete("k")
+	put, del := nextEvent(t, w), nextEvent(t, w)
+	if put.Op != EventPut || put.Key != "k" || put.Value != "v1" || put.Owner != owner {
+		t.Errorf("put event: %+v", put)
+	}
+	if del.Op != EventDelete || del.Version <= put.Version {
+		t.Errorf("delete event: %+v after %+v", del, put)
+	}
+	seen := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		seen[nextEvent(t, all).Key]++
+	}
+	if seen["k"] != 2 || seen["other"] != 1 {
+		t.Errorf("events of the whole ring: %v", seen)
+	}
+
+	// the watch follows the key to the successor of its owner
+	for _, n := range nodes {
+		if n.Addr == owner {
+			n.Quit()
+		}
+	}
+	waitFor(5*time.Second, func() bool { return ringStable(rest) })
+	// the writes before the watch registers at the new owner are missed, which is told
+	// by the EventLost sent once it has registered
+	newOwner, _ := writer.lookup("k", TraceContext{})
+	for ev := nextEvent(t, w); ev.Op != EventLost || ev.Owner != newOwner; ev = nextEvent(t, w) {
+	}
+	writer.Put("k", "v2")
+	var ev Event
+	for ev = nextEvent(t, w); ev.Op == EventLost; ev = nextEvent(t, w) {
+	}
+	if ev.Op != EventPut || ev.Value != "v2" || ev.Owner == owner {
+		t.Errorf("put event after the owner quits: %+v", ev)
+	}
+	// the version is that of the ETag of the key
+	if r, err := writer.Open("k"); err != nil || r.ETag != versionETag(ev.Version) {
+		t.Errorf("etag %v %v of the version %d", r, err, ev.Version)
+	}
+	if w.Err() != nil {
+		t.Errorf("watch error: %v", w.Err())
+	}
+	// a failing lookup of the owner is told
+	var failing atomic.Bool
+	lookupErr := errors.New("no lookup")
+	fw, err := NewWatcher(func(id uint32) (string, error) {
+		if failing.Load() {
+			return "", lookupErr
+		}
+		return writer.findSuccessor(id)
+	}, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing.Store(true)
+	for ev = nextEvent(t, fw); ev.Err == ""; ev = nextEvent(t, fw) {
+	}
+	if ev.Op != EventLost || ev.Err != lookupErr.Error() || !errors.Is(fw.Err(), lookupErr) {
+		t.Errorf("event of a failed lookup: %+v %v", ev, fw.Err())
+	}
+	fw.Close()
+
+	w.Close()
+	// the events already queued may still be read
+	if !waitFor(3*time.Second, func() bool {
+		_, ok := <-w.Events
+		return !ok
+	}) {
+		t.Error("events not closed")
+	}
+}
+
+func nextMessage(t *testing.T, s *Subscription) Message {
+	t.Helper()
+	select {
+	case msg := <-s.Messages:
+		return msg
+	case <-time.After(3 * time.Second):
+		t.Fatal("no message")
+		return Message{}
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	nodes := startRing(t, 5)
+	owner, _ := nodes[0].lookup(TopicKey("t"), TraceContext{})
+	others := without(nodes, owner)
+	s1, err := others[0].Subscribe("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	s2, err := others[1].Subscribe("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := others[2].Publish("t", "hello"); err != nil || count != 2 {
+		t.Errorf("publish: %d %v", count, err)
+	}
+	if m1, m2 := nextMessage(t, s1), nextMessage(t, s2); m1.Data != "hello" || m2.Data != "hello" || m1.Seq != m2.Seq {
+		t.Errorf("messages: %+v %+v", m1, m2)
+	}
+	// a node which does not own the topic does not know its subscribers
+	var count int
+	if err := others[2].PublishTopic(PublishRequest{Topic: "t", Data: "lost"}, &count); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("publish to a node not owning the topic: %d %v", count, err)
+	}
+	// the renewals leave no tombstones
+	for i := 0; i < 3; i++ {
+		s2.lock.Lock()
+		err := s2.renew()
+		s2.lock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range nodes {
+		if n.Addr == owner {
+			stored, _ := n.data.Get(TopicKey("t"))
+			if set, ok := parseSet(stored); !ok || len(set.Removed) != 0 {
+				t.Errorf("tombstones of the renewals: %+v", set)
+			}
+		}
+	}
+	s2.Close()
+	if count, _ := others[2].Publish("t", "again"); count != 1 {
+		t.Errorf("publish after a subscriber left: %d", count)
+	}
+	if msg := nextMessage(t, s1); msg.Data != "again" {
+		t.Errorf("message: %+v", msg)
+	}
+
+	// the subscribers are in the backup of the successor of the owner
+	for _, n := range nodes {
+		if n.Addr == owner {
+			n.ForceQuit()
+		}
+	}
+	waitFor(5*time.Second, func() bool { return ringStable(others) })
+	if count, err := others[2].Publish("t", "after failover"); err != nil || count != 1 {
+		t.Errorf("publish after failover: %d %v", count, err)
+	}
+	if msg := nextMessage(t, s1); msg.Data != "after failover" {
+		t.Errorf("message after failover: %+v", msg)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	nodes := startRing(t, 5)
+	owner, _ := nodes[0].lookup(LockKey("l"), TraceContext{})
+	others := without(nodes, owner)
+	l1, err := others[0].Acquire("l", 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := others[1].Acquire("l", time.Minute); !errors.Is(err, ErrLocked) {
+		t.Errorf("acquire of a held lock: %v", err)
+	}
+	time.Sleep(time.Until(l1.Expire) + 100*time.Millisecond)
+	if err := others[0].Renew(l1, time.Minute); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("renew of an expired lease: %v", err)
+	}
+	l2, err := others[1].Acquire("l", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l2.Token <= l1.Token {
+		t.Errorf("token %d after %d", l2.Token, l1.Token)
+	}
+	if err := others[0].Release(l1); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("release by a former holder: %v", err)
+	}
+	if err := others[1].Renew(l2, time.Minute); err != nil {
+		t.Errorf("renew: %v", err)
+	}
+	// a node not owning the lock does not grant it
+	var token uint64
+	request := LeaseRequest{Op: LeaseAcquire, Name: "l", ID: "other", TTL: time.Minute}
+	if err := others[2].Lease(request, &token); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("lease from a node not owning the lock: %d %v", token, err)
+	}
+
+	// the new owner has the lock from its backup
+	for _, n := range nodes {
+		if n.Addr == owner {
+			n.ForceQuit()
+		}
+	}
+	waitFor(5*time.Second, func() bool { return ringStable(others) })
+	if _, err := others[2].Acquire("l", time.Minute); !errors.Is(err, ErrLocked) {
+		t.Errorf("acquire after failover: %v", err)
+	}
+	if err := others[1].Release(l2); err != nil {
+		t.Errorf("release after failover: %v", err)
+	}
+	l3, err := others[2].Acquire("l", time.Minute)
+	if err != nil || l3.Token <= l2.Token {
+		t.Errorf("acquire after release: %+v %v", l3, err)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	// a failed owner and its successor both counted after the failure
+	a, b := newCounterValue(), newCounterValue()
+	a.add("n1", 5)
+	b.merge(a)
+	a.add("n1", -2)
+	b.add("n2", 10)
+	a.merge(b)
+	b.merge(a)
+	if a.value() != 13 || b.value() != 13 {
+		t.Errorf("merged counters: %d %d", a.value(), b.value())
+	}
+
+	const N = 4
+	nodes := startRing(t, N)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := nodes[i%N].Increment("seeders", 2); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if value, err := nodes[1].Increment("seeders", -5); err != nil || value != 35 {
+		t.Errorf("increment: %d %v", value, err)
+	}
+	nodes[0].Put("plain", "v")
+	if _, err := nodes[1].Increment("plain", 1); !errors.Is(err, ErrWrongType) {
+		t.Errorf("increment a plain value: %v", err)
+	}
+	if _, err := nodes[0].Fetch("seeders"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("get a counter: %v", err)
+	}
+
+	owner, _ := nodes[0].lookup("seeders", TraceContext{})
+	rest := without(nodes, owner)
+	var value int64
+	if err := rest[0].IncrementCounter(IncrementRequest{Key: "seeders", Delta: 1}, &value); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("increment at a node not owning the counter: %d %v", value, err)
+	}
+	// the backups of a counter are merged, so that an older one coming late is not kept
+	older, newer := newCounterValue(), newCounterValue()
+	older.add(owner, 1)
+	newer.merge(older)
+	newer.add(owner, 1)
+	var etag string
+	for _, c := range []*counterValue{newer, older} {
+		request := PutDataRequest{IsBackup: true, Key: "backup-counter", Value: c.encode()}
+		if err := nodes[0].PutData(request, &etag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored, _ := nodes[0].backupLevel(0).Get("backup-counter")
+	if value, err := CounterValue(stored); err != nil || value != 2 {
+		t.Errorf("backup counter written out of order: %d %v", value, err)
+	}
+
+	// the successor keeps counting from the backup
+	for _, n := range nodes {
+		if n.Addr == owner {
+			n.ForceQuit()
+		}
+	}
+	waitFor(5*time.Second, func() bool { return ringStable(rest) })
+	if value, err := rest[0].Increment("seeders", 1); err != nil || value != 36 {
+		t.Errorf("increment after failover: %d %v", value, err)
+	}
+	if value, err := rest[1].GetCounter("seeders"); err != nil || value != 36 {
+		t.Errorf("get counter: %d %v", value, err)
+	}
+}
+
+func TestRestoreStored(t *testing.T) {
+	nodes := startRing(t, 3)
+	nodes[0].Put("k", "new")
+	if err := nodes[1].RestoreStored("k", "old"); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("restore over a newer value: %v", err)
+	}
+	if value, _ := nodes[2].Fetch("k"); value != "new" {
+		t.Errorf("newer value overwritten by %q", value)
+	}
+	if err := nodes[1].RestoreStored("gone", "v"); err != nil {
+		t.Error(err)
+	}
+	if value, _ := nodes[2].Fetch("gone"); value != "v" {
+		t.Errorf("restored %q", value)
+	}
+	// a value saved with its version keeps its ETag
+	if err := nodes[1].RestoreStored("versioned", withVersion(42, "v")); err != nil {
+		t.Error(err)
+	}
+	if r, err := nodes[2].Open("versioned"); err != nil || r.ETag != versionETag(42) {
+		t.Errorf("etag of the restored value: %v %v", r, err)
+	}
+	saved := newCounterValue()
+	saved.add("old", 5)
+	nodes[0].Increment("c", 2)
+	if err := nodes[1].RestoreStored("c", saved.encode()); err != nil {
+		t.Error(err)
+	}
+	if value, err := nodes[2].GetCounter("c"); err != nil || value != 7 {
+		t.Errorf("restored counter should be merged: %d %v", value, err)
+	}
+	if err := nodes[1].RestoreStored(lockKeyPrefix+"l", lockMagic); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("lock restored: %v", err)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	if _, err := NewChordNode(makeLocalAddr(0), WithReplication(2), WithNamespace("ns", NamespaceConfig{Replication: 3})); err == nil {
+		t.Error("namespace with more backups than the node accepted")
+	}
+	nodes := startRing(t, 4, WithReplication(2),
+		WithNamespace("cache", NamespaceConfig{Replication: 1, TTL: 500 * time.Millisecond}))
+	apps, _ := nodes[1].Namespace("apps")
+	cache, _ := nodes[2].Namespace("cache")
+	nodes[0].Put("k", "default")
+	if err := apps.Store("k", "apps", Precondition{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Store("k", "cache", Precondition{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[0].Namespace("a\x00b"); err == nil {
+		t.Error("namespace with a zero byte accepted")
+	}
+	if v, err := apps.Fetch("k"); err != nil || v != "apps" {
+		t.Errorf("get in namespace: %q %v", v, err)
+	}
+	if v, err := cache.Fetch("k"); err != nil || v != "cache" {
+		t.Errorf("get in namespace: %q %v", v, err)
+	}
+	if v, _ := nodes[3].Fetch("k"); v != "default" {
+		t.Errorf("get in the default namespace: %q", v)
+	}
+
+	stats := make(map[string]int)
+	for _, n := range nodes {
+		for ns, s := range n.StorageInfo().Namespaces {
+			stats[ns] += s.Keys
+		}
+	}
+	backupsByNamespace := func() map[string]int {
+		backups := make(map[string]int)
+		for _, n := range nodes {
+			n.backupDataLock.RLock()
+			for _, backup := range n.backupData {
+				for key := range backup.Copy() {
+					ns, _ := splitNamespace(key)
+					backups[ns]++
+				}
+			}
+			n.backupDataLock.RUnlock()
+		}
+		return backups
+	}
+	// the backups are written after the Puts return
+	waitFor(2*time.Second, func() bool { return backupsByNamespace()["apps"] == 2 })
+	backups := backupsByNamespace()
+	if stats["apps"] != 1 || stats["cache"] != 1 || stats[""] != 1 {
+		t.Errorf("namespace stats: %v", stats)
+	}
+	if backups["apps"] != 2 || backups["cache"] != 1 {
+		t.Errorf("backups by namespace: %v", backups)
+	}
+
+	// the keys of cache expire, at the owner and in the backup
+	waitFor(5*time.Second, func() bool {
+		_, err := cache.Fetch("k")
+		return errors.Is(err, ErrNotFound) && backupsByNamespace()["cache"] == 0
+	})
+	if _, err := cache.Fetch("k"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("key past the ttl: %v", err)
+	}
+	if _, err := apps.Fetch("k"); err != nil {
+		t.Errorf("key without ttl: %v", err)
+	}
+	if backups := backupsByNamespace(); backups["cache"] != 0 {
+		t.Errorf("expired key in the backups: %v", backups)
+	}
+
+	// a key moved to a node, never written there, is as old as its version
+	var w keyWrites
+	old := uint64(time.Now().Add(-time.Hour).UnixNano())
+	ttl := func(string) time.Duration { return time.Minute }
+	expired := w.expired([]string{"old", "new"}, map[string]uint64{"old": old}, ttl)
+	if len(expired) != 1 || expired[0] != "old" {
+		t.Errorf("expired keys moved by a join: %v", expired)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	n := startRing(t, 1, WithQuota(3, 100), WithBackupQuota(1, 0))[0]
+	for i := 0; i < 3; i++ {
+		if err := n.Store(fmt.Sprintf("k%d", i), "v", Precondition{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := n.Store("k3", "v", Precondition{}); !errors.Is(err, ErrNodeFull) {
+		t.Errorf("put beyond the key quota: %v", err)
+	}
+	if h := n.Health(); !h.Full || h.QuotaUsage < 1 || n.quotaRatio(false) != 1 {
+		t.Errorf("health of a full node: %+v", h)
+	}
+	if err := n.Store("k0", "w", Precondition{}); err != nil {
+		t.Errorf("overwrite in a full node: %v", err)
+	}
+	if err := n.Remove("k0", Precondition{}); err != nil {
+		t.Error(err)
+	}
+	if err := n.Store("k3", strings.Repeat("v", 100), Precondition{}); !errors.Is(err, ErrNodeFull) {
+		t.Errorf("put beyond the byte quota: %v", err)
+	}
+	if keys, bytes := n.usage(false); keys != 2 || bytes != 6 {
+		t.Errorf("usage: %d keys %d bytes", keys, bytes)
+	}
+	// the backups, here those of the node itself, are not refused once the owner has
+	// acked the write
+	var etag string
+	for _, key := range []string{"b0", "b1"} {
+		if err := n.PutData(PutDataRequest{IsBackup: true, Key: key, Value: "v"}, &etag); err != nil {
+			t.Errorf("backup beyond the quota: %v", err)
+		}
+	}
+	if h := n.Health(); h.Full || !h.BackupOverQuota || n.metrics.overBackupQuota.Load() == 0 {
+		t.Errorf("health of a node with backups beyond the quota: %+v", h)
+	}
+}
+
+func TestDump(t *testing.T) {
+	nodes := startRing(t, 3, WithChunkSize(1<<10))
+	want := make(map[string]string)
+	pairs := make(map[string]string)
+	for i := 0; i < 600; i++ {
+		pairs[fmt.Sprintf("key%d", i)] = fmt.Sprintf("value%d", i)
+	}
+	pairs["binary\x00\xff"] = "\x00\x01\xfe"
+	for k, v := range pairs {
+		want[k] = v
+	}
+	for k, err := range nodes[0].PutMany(pairs) {
+		if err != nil {
+			t.Fatal(k, err)
+		}
+	}
+	large := strings.Repeat("0123456789", 500)
+	nodes[1].Put("large", large)
+	want["large"] = large
+	nodes[2].AddToSet("set", 0, "a", "b")
+	nodes[2].Increment("counter", 7)
+
+	var dump bytes.Buffer
+	count, err := ExportRing(makeLocalAddr(0), &dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified, err := VerifyDump(bytes.NewReader(dump.Bytes())); err != nil || verified != count {
+		t.Fatalf("verify: %d of %d, %v", verified, count, err)
+	}
+	corrupt := bytes.Replace(dump.Bytes(), []byte(`"etag":"\"`), []byte(`"etag":"\"9`), 1)
+	if _, err := VerifyDump(bytes.NewReader(corrupt)); !errors.Is(err, ErrBadDump) {
+		t.Errorf("verify a corrupt dump: %v", err)
+	}
+	etags := make(map[string]string)
+	dr, _ := NewDumpReader(bytes.NewReader(dump.Bytes()))
+	for e, err := dr.Next(); err == nil; e, err = dr.Next() {
+		etags[string(e.Key)] = e.ETag
+		switch string(e.Key) {
+		case "key1":
+			if e.Version == 0 || e.ETag != versionETag(e.Version) {
+				t.Errorf("version %d and etag %s in the dump", e.Version, e.ETag)
+			}
+		case "set":
+			if e.Version != 0 {
+				t.Errorf("version %d of a set in the dump", e.Version)
+			}
+		}
+	}
+
+	// the pages of a node are of one snapshot
+	first, err := nodes[0].exportPage(ExportRequest{Limit: 1})
+	if err != nil || !first.More || first.Scan == 0 {
+		t.Fatalf("first page: %+v %v", first, err)
+	}
+	for k := range nodes[0].LocalData() {
+		nodes[0].data.Delete(k)
+	}
+	rest, err := nodes[0].exportPage(ExportRequest{Scan: first.Scan, After: string(first.Entries[0].Key)})
+	if err != nil || rest.More || len(rest.Entries) == 0 {
+		t.Errorf("pages after the data changed: %d entries %v", len(rest.Entries), err)
+	}
+	if _, err := nodes[0].exportPage(ExportRequest{Scan: first.Scan}); err == nil {
+		t.Error("scan still open after the last page")
+	}
+	for _, n := range nodes {
+		n.Quit()
+	}
+
+	// an import stopped after the first batch is resumed from there, the sets and the
+	// counters merge with those written in the new ring, and the other keys written there
+	// are kept
+	nodes = startRing(t, 3, WithChunkSize(1<<10))
+	nodes[0].AddToSet("set", 0, "c")
+	nodes[0].Increment("counter", -2)
+	nodes[0].Put("key2", "newer")
+	want["key2"] = "newer"
+	d, _ := NewDumpReader(bytes.NewReader(dump.Bytes()))
+	stop := errors.New("stop")
+	done, err := ImportDump(d, makeLocalAddr(1), 0, func(int) error { return stop }, WithDialTimeout(time.Second))
+	if !errors.Is(err, stop) || done != importBatchKeys {
+		t.Fatalf("interrupted import: %d %v", done, err)
+	}
+	d, _ = NewDumpReader(bytes.NewReader(dump.Bytes()))
+	if done, err = ImportDump(d, makeLocalAddr(2), done, nil); err != nil || done != count {
+		t.Fatalf("resumed import: %d of %d, %v", done, count, err)
+	}
+	for k, v := range want {
+		if got, err := nodes[0].Fetch(k); err != nil || got != v {
+			t.Errorf("%q after import: %v", k, err)
+		}
+	}
+	// the keys keep their ETags across the export and the import
+	for _, k := range []string{"key1", "large", "binary\x00\xff"} {
+		if r, err := nodes[1].Open(k); err != nil || r.ETag != etags[k] {
+			t.Errorf("etag of %q after import: %v %v, %s in the dump", k, r, err, etags[k])
+		}
+	}
+	if members, err := nodes[1].GetSet("set"); err != nil || len(members) != 3 {
+		t.Errorf("set after import: %v %v", members, err)
+	}
+	if value, err := nodes[2].GetCounter("counter"); err != nil || value != 5 {
+		t.Errorf("counter after import: %d %v", value, err)
+	}
+}
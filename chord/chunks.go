@@ -0,0 +1,475 @@
+package chord
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A value larger than the chunk size is not stored as it is. It is cut into chunks stored
+// under the hash of their content, spread over the ring like any key, and the key of the
+// value keeps a manifest of the chunks. Joins, quits and backups then move pieces of
+// bounded size, and equal chunks are stored once.
+const (
+	chunkKeyPrefix = "\x00chunk:"
+	// the values kept by the nodes in place of a plain value start with reservedPrefix
+	reservedPrefix = "\x00chord-"
+	manifestMagic  = reservedPrefix + "manifest\n"
+	// versionMagic starts a plain value or a manifest written by the owner, followed by
+	// the version of the key, see withVersion
+	versionMagic = reservedPrefix + "version\n"
+	// a chunk no manifest refers to is deleted after this many rounds of the gc
+	chunkGraceRounds = 3
+)
+
+// Manifest is stored under the key of a chunked value.
+type Manifest struct {
+	Size int64 `json:"size"`
+	// ETag of the content of the whole value
+	ETag string `json:"etag"`
+	// Chunks are the hex SHA-256 of the chunks in order
+	Chunks []string `json:"chunks"`
+}
+
+func isChunkKey(key string) bool {
+	return strings.HasPrefix(key, chunkKeyPrefix)
+}
+
+func chunkKey(hash string) string {
+	return chunkKeyPrefix + hash
+}
+
+func chunkHash(chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *Manifest) encode() string {
+	b, _ := json.Marshal(m)
+	return manifestMagic + string(b)
+}
+
+// withVersion is what the owner of a key stores for a plain value or a manifest, so that
+// the version is copied to the backups and to the next owner with the value, and the
+// ETag of the key changes with every write even if the value comes back to an old one.
+func withVersion(version uint64, value string) string {
+	return versionMagic + strconv.FormatUint(version, 10) + "\n" + value
+}
+
+// splitVersion returns the version of stored and the value under it, or 0 and stored if
+// it has no version.
+func splitVersion(stored string) (uint64, string) {
+	rest, ok := strings.CutPrefix(stored, versionMagic)
+	if !ok {
+		return 0, stored
+	}
+	digits, value, ok := strings.Cut(rest, "\n")
+	if !ok {
+		return 0, stored
+	}
+	version, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return 0, stored
+	}
+	return version, value
+}
+
+// nextVersion is the version of a write to the key with the value old: the time of the
+// write, unless that is not after the version of old, e.g. with the clocks of a previous
+// owner ahead.
+func nextVersion(old string) uint64 {
+	version := uint64(time.Now().UnixNano())
+	if last, _ := splitVersion(old); version <= last {
+		version = last + 1
+	}
+	return version
+}
+
+// versionable tells whether the owner gives a version to value, which it does for the
+// plain values and the manifests, and not for the chunks, the sets, the counters and the
+// locks, which have no ETag.
+func versionable(key, value string) bool {
+	if isChunkKey(key) {
+		return false
+	}
+	_, value = splitVersion(value)
+	return !strings.HasPrefix(value, reservedPrefix) || strings.HasPrefix(value, manifestMagic)
+}
+
+// versioned returns what the owner stores for value written over old.
+func versioned(key, value, old string) string {
+	if !versionable(key, value) {
+		return value
+	}
+	_, value = splitVersion(value)
+	return withVersion(nextVersion(old), value)
+}
+
+// ParseManifest returns the manifest if stored, the value kept under a key, is one.
+func ParseManifest(stored string) (*Manifest, bool) {
+	_, stored = splitVersion(stored)
+	if !strings.HasPrefix(stored, manifestMagic) {
+		return nil, false
+	}
+	var m Manifest
+	if err := json.Unmarshal([]byte(stored[len(manifestMagic):]), &m); err != nil {
+		return nil, false
+	}
+	return &m, true
+}
+
+// storedETag is the ETag of the value stored as stored: that of its version, or else that
+// of its content.
+func storedETag(stored string) string {
+	if version, _ := splitVersion(stored); version > 0 {
+		return versionETag(version)
+	}
+	if m, ok := ParseManifest(stored); ok {
+		return m.ETag
+	}
+	return contentETag(stored)
+}
+
+// SplitValue reads a value from r and returns what to store under its key: the value
+// itself if it fits in chunkSize bytes, or else a manifest, once putChunk has stored every
+// chunk. A value which starts like a manifest or a set is always chunked, so that plain
+// values are never taken for them. etag is the ETag of the content of the value, the
+// owner gives the key its own ETag when the value is written.
+func SplitValue(r io.Reader, chunkSize int, putChunk func(key, chunk string) error) (stored, etag string, err error) {
+	buf := make([]byte, chunkSize+1)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", "", err
+	}
+	if err != nil && !bytes.HasPrefix(buf[:n], []byte(reservedPrefix)) {
+		value := string(buf[:n])
+		return value, contentETag(value), nil
+	}
+	r = io.MultiReader(bytes.NewReader(buf[:n]), r)
+	buf = buf[:chunkSize]
+	hash := sha1.New()
+	m := &Manifest{}
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			m.Size += int64(n)
+			h := chunkHash(buf[:n])
+			if err := putChunk(chunkKey(h), string(buf[:n])); err != nil {
+				return "", "", err
+			}
+			m.Chunks = append(m.Chunks, h)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", "", err
+		}
+	}
+	m.ETag = formatETag(hash.Sum(nil))
+	return m.encode(), m.ETag, nil
+}
+
+// ValueReader reads a value, fetching the chunks of a chunked one as they are needed.
+type ValueReader struct {
+	Size int64
+	ETag string
+
+	cur      *strings.Reader
+	chunks   []string
+	next     int
+	getChunk func(key string) (string, error)
+}
+
+// OpenValue returns a reader of the value stored as stored, which gets the chunks of it
+// with getChunk. It fails with ErrWrongType for a set or a lock.
+func OpenValue(stored string, getChunk func(key string) (string, error)) (*ValueReader, error) {
+	etag := storedETag(stored)
+	_, stored = splitVersion(stored)
+	m, ok := ParseManifest(stored)
+	if !ok {
+		if strings.HasPrefix(stored, reservedPrefix) {
+			return nil, ErrWrongType
+		}
+		return &ValueReader{Size: int64(len(stored)), ETag: etag, cur: strings.NewReader(stored)}, nil
+	}
+	return &ValueReader{Size: m.Size, ETag: etag, cur: strings.NewReader(""), chunks: m.Chunks, getChunk: getChunk}, nil
+}
+
+func (v *ValueReader) Read(p []byte) (int, error) {
+	for v.cur.Len() == 0 {
+		if v.next == len(v.chunks) {
+			return 0, io.EOF
+		}
+		h := v.chunks[v.next]
+		chunk, err := v.getChunk(chunkKey(h))
+		if err != nil {
+			return 0, fmt.Errorf("chunk %d of %d: %w", v.next+1, len(v.chunks), err)
+		}
+		if chunkHash([]byte(chunk)) != h {
+			return 0, fmt.Errorf("chunk %d of %d does not match its hash", v.next+1, len(v.chunks))
+		}
+		v.next++
+		v.cur = strings.NewReader(chunk)
+	}
+	return v.cur.Read(p)
+}
+
+func (v *ValueReader) readAll() (string, error) {
+	var b strings.Builder
+	b.Grow(int(v.Size))
+	_, err := io.Copy(&b, v)
+	return b.String(), err
+}
+
+// StoreReader is Store for a value read from r, which is cut into chunks while it is read
+// if it is larger than ChunkSize. It returns the ETag of the value.
+func (n *ChordNode) StoreReader(key string, r io.Reader, cond Precondition) (string, error) {
+	sp := n.startSpan("Put", TraceContext{})
+	sp.set("dht.key", key)
+	etag, err := n.putValue(key, r, cond, sp.context())
+	sp.finish(err)
+	return etag, err
+}
+
+func (n *ChordNode) putValue(key string, r io.Reader, cond Precondition, trace TraceContext) (string, error) {
+	if err := CheckKey(key); err != nil {
+		n.logger.Error(n.Addr, " Put: ", err)
+		return "", err
+	}
+	if err := n.cfg.checkSize(key, ""); err != nil {
+		n.logger.Error(n.Addr, " Put: ", err)
+		return "", err
+	}
+	r = &limitReader{r: r, left: int64(n.cfg.MaxValueSize)}
+	stored, _, err := SplitValue(r, n.cfg.ChunkSize, func(chunkKey, chunk string) error {
+		return n.put(chunkKey, chunk, Precondition{}, trace)
+	})
+	if err != nil {
+		n.logger.Error(n.Addr, " Put: failed to store chunks ", err)
+		return "", err
+	}
+	return n.putData(PutDataRequest{Key: key, Value: stored, Cond: cond, Trace: trace})
+}
+
+// PutStored puts the pair as the nodes keep it, e.g. a manifest or a chunk from
+// LocalData, without chunking it again.
+func (n *ChordNode) PutStored(key, stored string) error {
+	sp := n.startSpan("Put", TraceContext{})
+	sp.set("dht.key", key)
+	err := n.put(key, stored, Precondition{}, sp.context())
+	sp.finish(err)
+	return err
+}
+
+// RestoreStored puts back a pair saved as the nodes keep it, like PutStored, without
+// overwriting a newer value, see restoreValue. It fails with ErrPreconditionFailed if the
+// key is kept as it is. The locks are never restored, their leases having ended, nor the
+// subscribers of the topics, which renew themselves.
+func (n *ChordNode) RestoreStored(key, stored string) error {
+	if !restorable(key) {
+		return fmt.Errorf("%w: %s is a lock or a topic", ErrPreconditionFailed, key)
+	}
+	sp := n.startSpan("Put", TraceContext{})
+	sp.set("dht.key", key)
+	_, err := n.putData(PutDataRequest{Key: key, Value: stored, Restore: true, Trace: sp.context()})
+	sp.finish(err)
+	return err
+}
+
+// restorable tells whether a saved pair is put back by RestoreStored and ImportDump.
+func restorable(key string) bool {
+	return !strings.HasPrefix(key, lockKeyPrefix) && !strings.HasPrefix(key, topicKeyPrefix)
+}
+
+// restoreValue returns what the owner stores for a pair put back as the nodes keep it,
+// over old if the key exists, or false if the key keeps old: a set or a counter is merged
+// into old, any other value is written with the version it was saved with, so that its
+// ETag is kept, and only if there is no such key.
+func restoreValue(key, stored, old string, exists bool) (string, bool) {
+	if !exists {
+		if version, _ := splitVersion(stored); version == 0 {
+			return versioned(key, stored, ""), true
+		}
+		return stored, true
+	}
+	if _, ok := parseSet(stored); ok {
+		return mergeValue(old, stored), true
+	}
+	if _, ok := parseCounter(stored); ok {
+		return mergeValue(old, stored), true
+	}
+	return old, false
+}
+
+// limitReader fails with ErrTooLarge once more than left bytes are read.
+type limitReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if l.left -= int64(n); l.left < 0 {
+		return n, fmt.Errorf("%w: value over the limit", ErrTooLarge)
+	}
+	return n, err
+}
+
+// Open returns a reader of the value of key, which gets the chunks of a chunked value as
+// they are read.
+func (n *ChordNode) Open(key string) (*ValueReader, error) {
+	sp := n.startSpan("Get", TraceContext{})
+	sp.set("dht.key", key)
+	stored, err := n.get(key, sp.context())
+	if err != nil {
+		sp.finish(err)
+		return nil, err
+	}
+	value, err := n.openValue(stored, sp.context())
+	sp.finish(err)
+	return value, err
+}
+
+func (n *ChordNode) openValue(stored string, trace TraceContext) (*ValueReader, error) {
+	return OpenValue(stored, func(key string) (string, error) {
+		return n.get(key, trace)
+	})
+}
+
+// readValue returns the value stored as stored, with the chunks of it if it is chunked.
+func (n *ChordNode) readValue(stored string, trace TraceContext) (string, error) {
+	_, stored = splitVersion(stored)
+	if _, ok := ParseManifest(stored); !ok {
+		if strings.HasPrefix(stored, reservedPrefix) {
+			return "", ErrWrongType
+		}
+		return stored, nil
+	}
+	value, err := n.openValue(stored, trace)
+	if err != nil {
+		return "", err
+	}
+	return value.readAll()
+}
+
+// chunkLeases records when the chunks of the node were last known to be referred to.
+type chunkLeases struct {
+	seen map[string]time.Time
+	lock sync.Mutex
+}
+
+func (l *chunkLeases) touch(keys ...string) {
+	now := time.Now()
+	l.lock.Lock()
+	if l.seen == nil {
+		l.seen = make(map[string]time.Time)
+	}
+	for _, key := range keys {
+		l.seen[key] = now
+	}
+	l.lock.Unlock()
+}
+
+func (l *chunkLeases) reset() {
+	l.lock.Lock()
+	l.seen = nil
+	l.lock.Unlock()
+}
+
+// expired returns the chunks among keys not touched within grace. A chunk never seen is
+// taken as touched now, and the chunks not in keys any more are forgotten.
+func (l *chunkLeases) expired(keys []string, grace time.Duration) []string {
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	seen := make(map[string]time.Time, len(keys))
+	var expired []string
+	for _, key := range keys {
+		t, ok := l.seen[key]
+		if !ok {
+			t = now
+		}
+		seen[key] = t
+		if now.Sub(t) > grace {
+			expired = append(expired, key)
+		}
+	}
+	l.seen = seen
+	return expired
+}
+
+func (l *chunkLeases) stale(key string, grace time.Duration) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	t, ok := l.seen[key]
+	return ok && time.Since(t) > grace
+}
+
+// collectChunks is one round of the garbage collection of chunks. The node touches the
+// chunks its manifests refer to at their owners, and deletes its own chunks untouched for
+// chunkGraceRounds rounds. The grace also covers a value being written, whose chunks are
+// stored before the manifest. No chunk is deleted in a round in which an owner did not
+// answer: the ring is then likely changing, and other nodes may fail to touch the chunks
+// of this one as well.
+func (n *ChordNode) collectChunks() {
+	if !n.online.Load() {
+		return
+	}
+	var refs, chunks []string
+	for key, stored := range n.trackedPairs(n.data) {
+		if isChunkKey(key) {
+			chunks = append(chunks, key)
+		} else if m, ok := ParseManifest(stored); ok {
+			for _, h := range m.Chunks {
+				refs = append(refs, chunkKey(h))
+			}
+		}
+	}
+	if len(refs) > 0 {
+		groups, errs := n.groupByOwner(refs, TraceContext{})
+		n.eachOwner(groups, errs, func(link *chordLink, keys []string) error {
+			return link.TouchChunks(keys)
+		})
+		for _, err := range errs {
+			if err != nil {
+				n.logger.Warn(n.Addr, " collectChunks: an owner of chunks did not answer, none is deleted this round")
+				return
+			}
+		}
+	}
+	grace := chunkGraceRounds * n.cfg.ChunkGCInterval
+	for _, key := range n.chunks.expired(chunks, grace) {
+		n.dropChunk(key, grace)
+	}
+}
+
+// dropChunk deletes an expired chunk unless it has been written or touched meanwhile.
+func (n *ChordNode) dropChunk(key string, grace time.Duration) {
+	n.writeLock.Lock()
+	if !n.chunks.stale(key, grace) {
+		n.writeLock.Unlock()
+		return
+	}
+	n.data.Delete(key)
+	n.writeLock.Unlock()
+	n.logger.Info(n.Addr, " collectChunks: deleted orphaned chunk ", strings.TrimPrefix(key, chunkKeyPrefix))
+	succ := n.getOnlineSucc()
+	if succ == nil {
+		return
+	}
+	defer succ.close()
+	if err := succ.DeleteData(key, true, 0, TraceContext{}); err != nil && !errors.Is(err, ErrNotFound) {
+		n.logger.Error(n.Addr, " collectChunks: delete succ backup chunk: ", err)
+	}
+}
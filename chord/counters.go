@@ -0,0 +1,141 @@
+package chord
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strings"
+)
+
+// A counter is kept under its key as a PN-counter: every owner which has incremented it
+// keeps its own sums of the increments and of the decrements, and the value is the
+// difference of their totals. Two versions of a counter, e.g. the data of a node back
+// after a failure and the backup promoted by its successor meanwhile, are merged by
+// taking the larger sums of each owner, so that no increment is lost or counted twice.
+const counterMagic = reservedPrefix + "counter\n"
+
+// counterValue is gob encoded like setValue.
+type counterValue struct {
+	// Inc[owner] and Dec[owner] are the sums of the increments and decrements made by owner
+	Inc map[string]uint64
+	Dec map[string]uint64
+}
+
+func newCounterValue() *counterValue {
+	return &counterValue{Inc: make(map[string]uint64), Dec: make(map[string]uint64)}
+}
+
+func parseCounter(stored string) (*counterValue, bool) {
+	if !strings.HasPrefix(stored, counterMagic) {
+		return nil, false
+	}
+	c := newCounterValue()
+	if err := gob.NewDecoder(strings.NewReader(stored[len(counterMagic):])).Decode(c); err != nil {
+		return nil, false
+	}
+	if c.Inc == nil {
+		c.Inc = make(map[string]uint64)
+	}
+	if c.Dec == nil {
+		c.Dec = make(map[string]uint64)
+	}
+	return c, true
+}
+
+func (c *counterValue) encode() string {
+	var b bytes.Buffer
+	b.WriteString(counterMagic)
+	gob.NewEncoder(&b).Encode(c)
+	return b.String()
+}
+
+func (c *counterValue) add(owner string, delta int64) {
+	if delta >= 0 {
+		c.Inc[owner] += uint64(delta)
+	} else {
+		c.Dec[owner] += uint64(-delta)
+	}
+}
+
+func (c *counterValue) merge(o *counterValue) {
+	for owner, sum := range o.Inc {
+		if sum > c.Inc[owner] {
+			c.Inc[owner] = sum
+		}
+	}
+	for owner, sum := range o.Dec {
+		if sum > c.Dec[owner] {
+			c.Dec[owner] = sum
+		}
+	}
+}
+
+func (c *counterValue) value() int64 {
+	var v uint64
+	for _, sum := range c.Inc {
+		v += sum
+	}
+	for _, sum := range c.Dec {
+		v -= sum
+	}
+	return int64(v)
+}
+
+// CounterValue returns the value of the counter stored as stored, or ErrWrongType if it
+// is not a counter.
+func CounterValue(stored string) (int64, error) {
+	c, ok := parseCounter(stored)
+	if !ok {
+		return 0, ErrWrongType
+	}
+	return c.value(), nil
+}
+
+// Increment adds delta to the counter under key, which is created if there is no such
+// key, and returns the new value. It fails with ErrWrongType if the key has another value.
+func (n *ChordNode) Increment(key string, delta int64) (int64, error) {
+	if err := CheckKey(key); err != nil {
+		return 0, err
+	}
+	sp := n.startSpan("Increment", TraceContext{})
+	sp.set("dht.key", key)
+	request := IncrementRequest{Key: key, Delta: delta, Trace: sp.context()}
+	var value int64
+	err := n.toOwner(func() (err error) {
+		value, err = n.sendIncrement(request)
+		return err
+	})
+	sp.finish(err)
+	return value, err
+}
+
+func (n *ChordNode) sendIncrement(request IncrementRequest) (int64, error) {
+	targetAddr, err := n.lookup(request.Key, request.Trace)
+	if err != nil {
+		n.logger.Error(n.Addr, " Increment: failed in FindSuccessor ", err)
+		return 0, err
+	}
+	var link chordLink
+	if err := link.Dial(targetAddr, &n.cfg); err != nil {
+		n.logger.Error(n.Addr, " Increment: failed to dial target ", err)
+		return 0, err
+	}
+	defer link.close()
+	value, err := link.Increment(request)
+	if err != nil {
+		n.logger.Error(n.Addr, " Increment: failed to increment ", err)
+	}
+	return value, err
+}
+
+// GetCounter returns the value of the counter under key.
+func (n *ChordNode) GetCounter(key string) (int64, error) {
+	sp := n.startSpan("GetCounter", TraceContext{})
+	sp.set("dht.key", key)
+	stored, err := n.get(key, sp.context())
+	var value int64
+	if err == nil {
+		value, err = CounterValue(stored)
+	}
+	sp.finish(err)
+	return value, err
+}
@@ -0,0 +1,369 @@
+package chord
+
+import (
+	"dht/internal"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// maxCrawlNodes stops a crawl which never gets back to where it started
+const maxCrawlNodes = 1 << 16
+
+// at most this many keys are listed for each kind of problem in a report
+const maxReportedKeys = 20
+
+// a node sends its keys to the crawler in pages of this many
+const inspectPageLen = 4096
+
+// RingReport is the result of walking the ring from one node, see Crawl.
+type RingReport struct {
+	Start string `json:"start"`
+	// Nodes in the order the successor lists were followed
+	Nodes []NodeState `json:"-"`
+	// Order is Nodes sorted by id, which is what the ring should look like
+	Order       []RingMember   `json:"order"`
+	Closed      bool           `json:"closed"`
+	Unreachable []string       `json:"unreachable,omitempty"`
+	Gaps        []RingGap      `json:"gaps,omitempty"`
+	Fingers     FingerReport   `json:"fingers"`
+	Ownership   OwnerReport    `json:"ownership"`
+	Replicas    ReplicaReport  `json:"replicas"`
+	Successors  []SuccessorErr `json:"successorErrors,omitempty"`
+}
+
+type RingMember struct {
+	ID          uint32 `json:"id"`
+	Addr        string `json:"addr"`
+	Predecessor string `json:"predecessor"`
+	Successor   string `json:"successor"`
+	DataKeys    int    `json:"dataKeys"`
+	BackupKeys  []int  `json:"backupKeys"`
+}
+
+// RingGap is a node whose successor does not take it as the predecessor.
+type RingGap struct {
+	Node                 string `json:"node"`
+	Successor            string `json:"successor"`
+	SuccessorPredecessor string `json:"successorPredecessor"`
+}
+
+// SuccessorErr is a node whose first successor is not the next node of the ring.
+type SuccessorErr struct {
+	Node     string `json:"node"`
+	Actual   string `json:"actual"`
+	Expected string `json:"expected"`
+}
+
+type FingerReport struct {
+	Correct int `json:"correct"`
+	Wrong   int `json:"wrong"`
+	Missing int `json:"missing"`
+	// Nodes with wrong fingers and how many of them are wrong
+	WrongByNode map[string]int `json:"wrongByNode,omitempty"`
+}
+
+// ReportKey is a key listed in a RingReport. Since a key may be any bytes, it is in
+// base64 in JSON, like in a dump.
+type ReportKey string
+
+func (k ReportKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]byte(k))
+}
+
+func (k *ReportKey) UnmarshalJSON(b []byte) error {
+	var raw []byte
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*k = ReportKey(raw)
+	return nil
+}
+
+type OwnerReport struct {
+	Keys       int            `json:"keys"`
+	Violations []KeyViolation `json:"violations,omitempty"`
+	// ViolationCnt may be larger than len(Violations), which is cut at maxReportedKeys
+	ViolationCnt int `json:"violationCnt"`
+}
+
+// KeyViolation is a key stored by a node other than its owner.
+type KeyViolation struct {
+	Key   ReportKey `json:"key"`
+	Node  string    `json:"node"`
+	Owner string    `json:"owner"`
+}
+
+type ReplicaReport struct {
+	Expected           int         `json:"expected"`
+	Present            int         `json:"present"`
+	UnderReplicated    []ReportKey `json:"underReplicated,omitempty"`
+	UnderReplicatedCnt int         `json:"underReplicatedCnt"`
+}
+
+func (r *ReplicaReport) Coverage() float64 {
+	if r.Expected == 0 {
+		return 1
+	}
+	return float64(r.Present) / float64(r.Expected)
+}
+
+// Healthy tells whether the crawl found no problem at all.
+func (r *RingReport) Healthy() bool {
+	return r.Closed && len(r.Unreachable) == 0 && len(r.Gaps) == 0 && len(r.Successors) == 0 &&
+		r.Fingers.Wrong == 0 && r.Fingers.Missing == 0 && r.Ownership.ViolationCnt == 0 &&
+		r.Replicas.UnderReplicatedCnt == 0
+}
+
+func inspectNode(addr string, c *Config) (NodeState, error) {
+	var link chordLink
+	var state NodeState
+	if err := link.Dial(addr, c); err != nil {
+		return state, err
+	}
+	defer link.close()
+	if err := link.Inspect(&state); err != nil {
+		return state, err
+	}
+	var err error
+	if state.DataKeys, err = inspectKeys(&link, 0); err != nil {
+		return state, err
+	}
+	for level := range state.BackupCnt {
+		keys, err := inspectKeys(&link, level+1)
+		if err != nil {
+			return state, err
+		}
+		state.BackupKeys = append(state.BackupKeys, keys)
+	}
+	return state, nil
+}
+
+// inspectKeys pages through the keys of a node, see KeysRequest.
+func inspectKeys(link *chordLink, level int) ([]string, error) {
+	request := KeysRequest{Level: level, Limit: inspectPageLen}
+	var keys []string
+	for {
+		var reply KeysReply
+		if err := link.InspectKeys(request, &reply); err != nil {
+			return keys, err
+		}
+		keys = append(keys, reply.Keys...)
+		if !reply.More || len(reply.Keys) == 0 {
+			return keys, nil
+		}
+		request.Scan, request.After = reply.Scan, reply.Keys[len(reply.Keys)-1]
+	}
+}
+
+// Crawl starts from the node at addr, follows the successor lists around the ring and
+// checks the state of every node against the ring made up of all the nodes found.
+func Crawl(addr string, opts ...Option) (*RingReport, error) {
+	var c Config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	c.setDefaults()
+	start, err := inspectNode(addr, &c)
+	if err != nil {
+		return nil, err
+	}
+	r := &RingReport{Start: addr, Nodes: []NodeState{start}}
+	// the nodes are told apart by their ids, since the same node may be reached by
+	// addresses written differently, e.g. localhost and 127.0.0.1
+	visited := map[uint32]bool{start.Info.ID: true}
+	unreachable := make(map[string]bool)
+	cur := start
+	for len(r.Nodes) < maxCrawlNodes {
+		var next *NodeState
+		for _, succ := range cur.SuccList {
+			if succ == "" || unreachable[succ] {
+				continue
+			}
+			if id := internal.Str_uint32_sha1(succ); visited[id] {
+				r.Closed = id == start.Info.ID
+				break
+			}
+			state, err := inspectNode(succ, &c)
+			if err != nil {
+				unreachable[succ] = true
+				r.Unreachable = append(r.Unreachable, succ)
+				continue
+			}
+			next = &state
+			break
+		}
+		if next == nil {
+			break
+		}
+		visited[next.Info.ID] = true
+		r.Nodes = append(r.Nodes, *next)
+		cur = *next
+	}
+	r.check()
+	return r, nil
+}
+
+func (r *RingReport) check() {
+	sorted := append([]NodeState(nil), r.Nodes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Info.ID < sorted[j].Info.ID })
+	cnt := len(sorted)
+	index := make(map[string]int, cnt)
+	for i := range sorted {
+		index[sorted[i].Info.Addr] = i
+	}
+	// successorOf finds the node responsible for id on the true ring
+	successorOf := func(id uint32) *NodeState {
+		i := sort.Search(cnt, func(i int) bool { return sorted[i].Info.ID >= id })
+		return &sorted[i%cnt]
+	}
+
+	for i := range sorted {
+		node, succ := &sorted[i], &sorted[(i+1)%cnt]
+		r.Order = append(r.Order, RingMember{
+			ID:          node.Info.ID,
+			Addr:        node.Info.Addr,
+			Predecessor: node.Routing.Predecessor,
+			Successor:   node.SuccList[0],
+			DataKeys:    node.DataCnt,
+			BackupKeys:  node.BackupCnt,
+		})
+		if node.SuccList[0] != succ.Info.Addr {
+			r.Successors = append(r.Successors, SuccessorErr{node.Info.Addr, node.SuccList[0], succ.Info.Addr})
+		}
+		if succ.Routing.Predecessor != node.Info.Addr {
+			r.Gaps = append(r.Gaps, RingGap{node.Info.Addr, succ.Info.Addr, succ.Routing.Predecessor})
+		}
+	}
+
+	for i := range sorted {
+		node := &sorted[i]
+		fingers := make(map[int]string, len(node.Routing.Fingers))
+		for _, fin := range node.Routing.Fingers {
+			fingers[fin.Index] = fin.Addr
+		}
+		for k := 0; k < ChordM; k++ {
+			actual, ok := fingers[k]
+			switch {
+			case !ok:
+				r.Fingers.Missing++
+			case actual == successorOf(node.Info.ID+(1<<k)).Info.Addr:
+				r.Fingers.Correct++
+			default:
+				r.Fingers.Wrong++
+				if r.Fingers.WrongByNode == nil {
+					r.Fingers.WrongByNode = make(map[string]int)
+				}
+				r.Fingers.WrongByNode[node.Info.Addr]++
+			}
+		}
+	}
+
+	backups := make([][]map[string]bool, cnt)
+	for i := range sorted {
+		for _, keys := range sorted[i].BackupKeys {
+			set := make(map[string]bool, len(keys))
+			for _, k := range keys {
+				set[k] = true
+			}
+			backups[i] = append(backups[i], set)
+		}
+	}
+	for i := range sorted {
+		node := &sorted[i]
+		for _, key := range node.DataKeys {
+			r.Ownership.Keys++
+			owner := successorOf(internal.Str_uint32_sha1(key))
+			if owner.Info.Addr != node.Info.Addr {
+				r.Ownership.ViolationCnt++
+				if len(r.Ownership.Violations) < maxReportedKeys {
+					r.Ownership.Violations = append(r.Ownership.Violations, KeyViolation{ReportKey(key), node.Info.Addr, owner.Info.Addr})
+				}
+				continue
+			}
+			under := false
+			// the j-th successor keeps the key in its backup of level j-1
+			for j := 1; j <= node.Info.replication(key) && j < cnt; j++ {
+				r.Replicas.Expected++
+				levels := backups[(i+j)%cnt]
+				if j-1 < len(levels) && levels[j-1][key] {
+					r.Replicas.Present++
+				} else {
+					under = true
+				}
+			}
+			if under {
+				r.Replicas.UnderReplicatedCnt++
+				if len(r.Replicas.UnderReplicated) < maxReportedKeys {
+					r.Replicas.UnderReplicated = append(r.Replicas.UnderReplicated, ReportKey(key))
+				}
+			}
+		}
+	}
+}
+
+func (r *RingReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (r *RingReport) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Ring crawled from %s: %d nodes, closed: %v\n", r.Start, len(r.Order), r.Closed)
+	fmt.Fprintf(w, "%-12s %-22s %-22s %8s  %s\n", "id", "addr", "predecessor", "keys", "backup keys")
+	for _, m := range r.Order {
+		fmt.Fprintf(w, "%-12d %-22s %-22s %8d  %v\n", m.ID, m.Addr, m.Predecessor, m.DataKeys, m.BackupKeys)
+	}
+	for _, addr := range r.Unreachable {
+		fmt.Fprintf(w, "unreachable: %s\n", addr)
+	}
+	for _, e := range r.Successors {
+		fmt.Fprintf(w, "successor of %s is %s, should be %s\n", e.Node, e.Actual, e.Expected)
+	}
+	for _, g := range r.Gaps {
+		fmt.Fprintf(w, "gap: predecessor of %s (successor of %s) is %q\n", g.Successor, g.Node, g.SuccessorPredecessor)
+	}
+	fmt.Fprintf(w, "fingers: %d correct, %d wrong, %d missing\n", r.Fingers.Correct, r.Fingers.Wrong, r.Fingers.Missing)
+	fmt.Fprintf(w, "keys: %d, stored outside their owner: %d\n", r.Ownership.Keys, r.Ownership.ViolationCnt)
+	for _, v := range r.Ownership.Violations {
+		fmt.Fprintf(w, "  %q on %s, owned by %s\n", v.Key, v.Node, v.Owner)
+	}
+	fmt.Fprintf(w, "replicas: %d/%d (%.2f%%), under-replicated keys: %d\n",
+		r.Replicas.Present, r.Replicas.Expected, r.Replicas.Coverage()*100, r.Replicas.UnderReplicatedCnt)
+	for _, key := range r.Replicas.UnderReplicated {
+		fmt.Fprintf(w, "  %q\n", key)
+	}
+	if r.Healthy() {
+		fmt.Fprintln(w, "ring is consistent")
+	}
+}
+
+// WriteDOT draws the ring in the Graphviz format: the successor edges are solid, the
+// predecessor edges dashed, and the edges of the gaps red.
+func (r *RingReport) WriteDOT(w io.Writer) {
+	gaps := make(map[string]bool)
+	for _, g := range r.Gaps {
+		gaps[g.Node] = true
+	}
+	fmt.Fprintln(w, "digraph ring {")
+	fmt.Fprintln(w, "  layout=circo;")
+	fmt.Fprintln(w, "  node [shape=box];")
+	for _, m := range r.Order {
+		fmt.Fprintf(w, "  %q [label=\"%s\\n%d\\nkeys: %d\"];\n", m.Addr, m.Addr, m.ID, m.DataKeys)
+	}
+	for _, addr := range r.Unreachable {
+		fmt.Fprintf(w, "  %q [style=filled, fillcolor=gray];\n", addr)
+	}
+	for _, m := range r.Order {
+		attrs := ""
+		if gaps[m.Addr] {
+			attrs = " [color=red]"
+		}
+		fmt.Fprintf(w, "  %q -> %q%s;\n", m.Addr, m.Successor, attrs)
+		if m.Predecessor != "" {
+			fmt.Fprintf(w, "  %q -> %q [style=dashed];\n", m.Addr, m.Predecessor)
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
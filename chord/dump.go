@@ -0,0 +1,427 @@
+package chord
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"dht/internal"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"time"
+)
+
+// A dump is the contents of a ring in a file of JSON lines: a header, one line for each
+// pair as the nodes store it, so that chunked values, sets and counters are kept as they
+// are, and a trailer with the number of pairs and the SHA-256 of their lines. The keys and
+// values are in base64, so binary data is kept.
+const (
+	dumpFormat  = "chord-dump"
+	dumpVersion = 1
+	// a node sends its pairs to the exporter in pages of this many
+	exportPageLen = 1024
+	// the importer writes the pairs in batches of up to this many keys or bytes
+	importBatchKeys  = 512
+	importBatchBytes = 4 << 20
+)
+
+// ErrBadDump is returned when a dump is not well formed or does not match its checksum.
+var ErrBadDump = errors.New("bad dump")
+
+// DumpEntry is a pair of a dump.
+type DumpEntry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	// ETag is that of the key for the conditional writes, see storedETag
+	ETag string `json:"etag"`
+	// Version is that of the key, zero for the values without one, e.g. the sets
+	Version uint64 `json:"version,omitempty"`
+	// Expires is set for the keys of a namespace with a TTL
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type dumpHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+type dumpTrailer struct {
+	Count  int    `json:"count"`
+	SHA256 string `json:"sha256"`
+}
+
+// DumpWriter writes a dump.
+type DumpWriter struct {
+	w     *bufio.Writer
+	hash  hash.Hash
+	count int
+}
+
+// NewDumpWriter writes the header of a dump to w.
+func NewDumpWriter(w io.Writer) (*DumpWriter, error) {
+	d := &DumpWriter{w: bufio.NewWriter(w), hash: sha256.New()}
+	if err := d.line(dumpHeader{Format: dumpFormat, Version: dumpVersion, Created: time.Now().UTC()}, nil); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DumpWriter) line(v interface{}, h hash.Hash) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if h != nil {
+		h.Write(b)
+	}
+	_, err = d.w.Write(b)
+	return err
+}
+
+func (d *DumpWriter) Write(e DumpEntry) error {
+	d.count++
+	return d.line(e, d.hash)
+}
+
+// Close writes the trailer and flushes the dump, but does not close the underlying writer.
+func (d *DumpWriter) Close() error {
+	if err := d.line(dumpTrailer{Count: d.count, SHA256: hex.EncodeToString(d.hash.Sum(nil))}, nil); err != nil {
+		return err
+	}
+	return d.w.Flush()
+}
+
+// DumpReader reads a dump, and checks it against the trailer at the end.
+type DumpReader struct {
+	Created time.Time
+
+	r     *bufio.Reader
+	hash  hash.Hash
+	count int
+}
+
+// IsDump tells whether r starts with the header of a dump, without consuming it.
+func IsDump(r *bufio.Reader) bool {
+	b, _ := r.Peek(64)
+	return bytes.Contains(b, []byte(`"format":"`+dumpFormat+`"`))
+}
+
+// NewDumpReader reads the header of a dump from r.
+func NewDumpReader(r io.Reader) (*DumpReader, error) {
+	d := &DumpReader{r: bufio.NewReader(r), hash: sha256.New()}
+	b, err := d.r.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%w: no header: %v", ErrBadDump, err)
+	}
+	var h dumpHeader
+	if err := json.Unmarshal(b, &h); err != nil || h.Format != dumpFormat {
+		return nil, fmt.Errorf("%w: no header", ErrBadDump)
+	}
+	if h.Version != dumpVersion {
+		return nil, fmt.Errorf("%w: version %d", ErrBadDump, h.Version)
+	}
+	d.Created = h.Created
+	return d, nil
+}
+
+// Next returns the next pair, or io.EOF after the last one if the dump is complete and
+// matches its checksum.
+func (d *DumpReader) Next() (DumpEntry, error) {
+	var e DumpEntry
+	b, err := d.r.ReadBytes('\n')
+	if err != nil {
+		return e, fmt.Errorf("%w: cut after %d pairs", ErrBadDump, d.count)
+	}
+	var line struct {
+		DumpEntry
+		dumpTrailer
+	}
+	if err := json.Unmarshal(b, &line); err != nil {
+		return e, fmt.Errorf("%w: line %d: %v", ErrBadDump, d.count+2, err)
+	}
+	if line.SHA256 != "" {
+		if line.Count != d.count || line.SHA256 != hex.EncodeToString(d.hash.Sum(nil)) {
+			return e, fmt.Errorf("%w: checksum or count of %d pairs does not match", ErrBadDump, d.count)
+		}
+		return e, io.EOF
+	}
+	d.hash.Write(b)
+	d.count++
+	return line.DumpEntry, nil
+}
+
+// VerifyDump reads the whole dump in r, and returns the number of pairs in it.
+func VerifyDump(r io.Reader) (int, error) {
+	d, err := NewDumpReader(r)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		if _, err := d.Next(); err == io.EOF {
+			return d.count, nil
+		} else if err != nil {
+			return d.count, err
+		}
+	}
+}
+
+// ExportRequest asks for the pairs of the primary data after the key After in order. The
+// first page opens a scan of the data with Scan 0, the next ones give the Scan of the
+// reply, so that the pages are of one snapshot, see KeysRequest.
+type ExportRequest struct {
+	Scan  uint64
+	After string
+	Limit int
+}
+
+type ExportReply struct {
+	Scan    uint64
+	Entries []DumpEntry
+	More    bool
+}
+
+// exportPage returns the entries of the primary data for the request.
+func (n *ChordNode) exportPage(request ExportRequest) (ExportReply, error) {
+	var reply ExportReply
+	var sc *keyScan
+	if request.Scan == 0 {
+		reply.Scan, sc = n.scans.start(n.data)
+	} else {
+		var err error
+		if sc, err = n.scans.get(request.Scan); err != nil {
+			return reply, err
+		}
+		reply.Scan = request.Scan
+	}
+	var keys []string
+	keys, reply.More = sc.page(request.After, request.Limit)
+	if !reply.More {
+		n.scans.close(reply.Scan)
+	}
+	now := time.Now()
+	for _, k := range keys {
+		stored := sc.data[k]
+		e := DumpEntry{Key: []byte(k), Value: []byte(stored), ETag: storedETag(stored)}
+		e.Version, _ = splitVersion(stored)
+		if ttl := n.cfg.keyTTL(k); ttl > 0 {
+			expires := now.Add(ttl)
+			n.writes.lock.Lock()
+			if at, ok := n.writes.at[k]; ok {
+				expires = at.Add(ttl)
+			}
+			n.writes.lock.Unlock()
+			e.Expires = &expires
+		}
+		reply.Entries = append(reply.Entries, e)
+	}
+	return reply, nil
+}
+
+// ExportRing writes a dump of the ring reached through the node at addr to w, and returns
+// the number of pairs. Every node found by Crawl sends its primary data in pages, all of
+// one snapshot of the node; the export fails if a node cannot be reached, since the dump
+// would miss its keys. The dump is not of one point in time across the nodes: the nodes
+// are exported one after another, and a key written meanwhile is in the dump with its
+// value at the time its node was exported, or missed or twice in the dump if it was moved
+// by a join or a quit during the export.
+func ExportRing(addr string, w io.Writer, opts ...Option) (int, error) {
+	report, err := Crawl(addr, opts...)
+	if err != nil {
+		return 0, err
+	}
+	if len(report.Unreachable) > 0 {
+		return 0, fmt.Errorf("unreachable nodes %v", report.Unreachable)
+	}
+	d, err := NewDumpWriter(w)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range report.Order {
+		r, err := DialRemote(m.Addr, opts...)
+		if err != nil {
+			return d.count, err
+		}
+		err = r.exportTo(d)
+		r.Close()
+		if err != nil {
+			return d.count, fmt.Errorf("%s: %w", m.Addr, err)
+		}
+	}
+	return d.count, d.Close()
+}
+
+func (r *Remote) exportTo(d *DumpWriter) error {
+	request := ExportRequest{Limit: exportPageLen}
+	for {
+		reply, err := r.Export(request)
+		if err != nil {
+			return err
+		}
+		for _, e := range reply.Entries {
+			if err := d.Write(e); err != nil {
+				return err
+			}
+		}
+		if !reply.More || len(reply.Entries) == 0 {
+			return nil
+		}
+		request.Scan = reply.Scan
+		request.After = string(reply.Entries[len(reply.Entries)-1].Key)
+	}
+}
+
+// ImportDump puts the pairs of a dump back into the ring reached through the node at addr,
+// as they are stored, in batches grouped by owner. The owners restore them like
+// ChordNode.RestoreStored: the sets and the counters are merged into those of the ring,
+// the other values keep their versions and ETags and are written only if there is no such
+// key, and the locks and the subscribers of the topics are left out. The first skip pairs
+// are left out, and progress is called with the number of pairs done after each batch, so
+// that an import which failed can be resumed from there. The pairs expired since the
+// export are left out, the others get the TTL of their namespace anew. ImportDump returns
+// the number of pairs done, including those skipped.
+func ImportDump(d *DumpReader, addr string, skip int, progress func(done int) error, opts ...Option) (int, error) {
+	im := &importer{addr: addr, opts: opts, remotes: make(map[string]*Remote)}
+	defer im.close()
+	done := 0
+	batch := make(map[string]string)
+	var size, count int
+	flush := func() error {
+		if count == 0 {
+			return nil
+		}
+		if err := im.put(batch); err != nil {
+			return err
+		}
+		done += count
+		batch, size, count = make(map[string]string), 0, 0
+		if progress != nil {
+			return progress(done)
+		}
+		return nil
+	}
+	now := time.Now()
+	for {
+		e, err := d.Next()
+		if err == io.EOF {
+			return done, flush()
+		}
+		if err != nil {
+			return done, err
+		}
+		if done+count < skip {
+			done++
+			continue
+		}
+		count++
+		if restorable(string(e.Key)) && (e.Expires == nil || e.Expires.After(now)) {
+			batch[string(e.Key)] = string(e.Value)
+			size += len(e.Key) + len(e.Value)
+		}
+		if count >= importBatchKeys || size >= importBatchBytes {
+			if err := flush(); err != nil {
+				return done, err
+			}
+		}
+	}
+}
+
+// importer writes batches to the owners of the keys, found on the ring as crawled.
+type importer struct {
+	addr    string
+	opts    []Option
+	ring    []RingMember
+	remotes map[string]*Remote
+}
+
+func (im *importer) close() {
+	for _, r := range im.remotes {
+		r.Close()
+	}
+}
+
+func (im *importer) remote(addr string) (*Remote, error) {
+	if r, ok := im.remotes[addr]; ok {
+		return r, nil
+	}
+	r, err := DialRemote(addr, im.opts...)
+	if err == nil {
+		im.remotes[addr] = r
+	}
+	return r, err
+}
+
+func (im *importer) crawl() error {
+	report, err := Crawl(im.addr, im.opts...)
+	if err != nil {
+		return err
+	}
+	im.ring = report.Order
+	for addr, r := range im.remotes {
+		r.Close()
+		delete(im.remotes, addr)
+	}
+	return nil
+}
+
+// owner returns the member of the ring responsible for id.
+func (im *importer) owner(id uint32) RingMember {
+	i := sort.Search(len(im.ring), func(i int) bool { return im.ring[i].ID >= id })
+	return im.ring[i%len(im.ring)]
+}
+
+// put writes the batch, and crawls the ring again once if it has changed since the last
+// crawl. Each owner is asked for its predecessor first, so that no key is written to a
+// node which does not own it any more.
+func (im *importer) put(batch map[string]string) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	var err error
+	for try := 0; try < 2; try++ {
+		if im.ring == nil || try > 0 {
+			if err = im.crawl(); err != nil {
+				return err
+			}
+		}
+		if err = im.putOnce(batch); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (im *importer) putOnce(batch map[string]string) error {
+	groups := make(map[string]map[string]string)
+	for k, v := range batch {
+		addr := im.owner(internal.Str_uint32_sha1(k)).Addr
+		if groups[addr] == nil {
+			groups[addr] = make(map[string]string)
+		}
+		groups[addr][k] = v
+	}
+	for addr, pairs := range groups {
+		r, err := im.remote(addr)
+		if err != nil {
+			return err
+		}
+		// a node without a predecessor yet is taken to own what the crawl found
+		if pred, err := r.Predecessor(); err == nil {
+			predID, ownerID := internal.Str_uint32_sha1(pred), internal.Str_uint32_sha1(addr)
+			for k := range pairs {
+				if !inRange(predID+1, ownerID+1, internal.Str_uint32_sha1(k)) {
+					return fmt.Errorf("%s does not own %q any more", addr, k)
+				}
+			}
+		}
+		if err := r.RestoreBatch(pairs); err != nil {
+			return fmt.Errorf("%s: %w", addr, err)
+		}
+	}
+	return nil
+}
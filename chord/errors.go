@@ -0,0 +1,111 @@
+package chord
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned when the owner does not have the key
+	ErrNotFound = errors.New("key not found")
+	// ErrPreconditionFailed is returned when a conditional write does not match the current value
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrTooLarge is returned when a key or a value is beyond the size limits of the owner
+	ErrTooLarge = errors.New("key or value too large")
+	// ErrWrongType is returned for an operation on a value of another type, e.g. a set
+	// operation on a plain value, or a Get of a counter
+	ErrWrongType = errors.New("wrong type of value")
+	// ErrLocked is returned by Acquire when another holder has the lock
+	ErrLocked = errors.New("lock is held")
+	// ErrLeaseLost is returned by Renew and Release when the lease has expired, or the
+	// lock has been acquired by another holder since
+	ErrLeaseLost = errors.New("lease lost")
+	// ErrNodeFull is returned when a write would take the owner of the key beyond its
+	// quota of keys or bytes; the backups are never refused
+	ErrNodeFull = errors.New("node full")
+	// ErrNotOwner is returned by a node asked to write a key outside (predecessor, node],
+	// e.g. through an out of date route, so that the owner is looked up again
+	ErrNotOwner = errors.New("not the owner of the key")
+	// ErrReservedKey is returned for a key under one of the prefixes the nodes keep their
+	// own data under, see CheckKey
+	ErrReservedKey = errors.New("reserved key")
+)
+
+// reservedKeyPrefixes are those of the chunks, the locks and the topics, which are
+// written only through their own operations.
+var reservedKeyPrefixes = []string{chunkKeyPrefix, lockKeyPrefix, topicKeyPrefix}
+
+// CheckKey fails with ErrReservedKey if key may not be written or deleted as a plain key.
+// The keys of the namespaces are not reserved.
+func CheckKey(key string) error {
+	for _, prefix := range reservedKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return fmt.Errorf("%w: %q", ErrReservedKey, key)
+		}
+	}
+	return nil
+}
+
+// checkStoredKey is CheckKey at the owner, which also takes a chunk written under the
+// hash of its content, as SplitValue does, so that a chunk cannot be replaced.
+func checkStoredKey(key, value string) error {
+	if isChunkKey(key) && key == chunkKey(chunkHash([]byte(value))) {
+		return nil
+	}
+	return CheckKey(key)
+}
+
+// remoteError turns the errors sent back by net/rpc, which keep only the message, into
+// the errors above when they are.
+func remoteError(err error) error {
+	serverErr, ok := err.(rpc.ServerError)
+	if !ok {
+		return err
+	}
+	msg := string(serverErr)
+	for _, known := range []error{ErrNotFound, ErrPreconditionFailed, ErrTooLarge, ErrWrongType, ErrLocked, ErrLeaseLost, ErrNodeFull, ErrNotOwner, ErrReservedKey} {
+		if strings.HasPrefix(msg, known.Error()) {
+			return fmt.Errorf("%w%s", known, strings.TrimPrefix(msg, known.Error()))
+		}
+	}
+	return err
+}
+
+// contentETag is the ETag of a value by its content, which the values without a version
+// have, e.g. the chunks.
+func contentETag(value string) string {
+	sum := sha1.Sum([]byte(value))
+	return formatETag(sum[:])
+}
+
+// versionETag is the ETag of a value of the given version, see withVersion.
+func versionETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+func formatETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// Precondition of a write, checked by the owner of the key.
+type Precondition struct {
+	// IfMatch is the ETag the current value must have, or "*" for any existing value
+	IfMatch string
+	// IfNoneMatch requires the key not to exist
+	IfNoneMatch bool
+}
+
+func (p Precondition) check(value string, exists bool) bool {
+	if p.IfNoneMatch && exists {
+		return false
+	}
+	if p.IfMatch != "" && (!exists || (p.IfMatch != "*" && p.IfMatch != storedETag(value))) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,293 @@
+package chord
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxGatewayBody limits the size of a batch sent to the gateway, and maxGatewayValue
+// that of a value, which is cut into chunks while it is read
+const (
+	maxGatewayBody  = 8 << 20
+	maxGatewayValue = 1 << 30
+)
+
+type chordGateway struct {
+	server httpEndpoint
+}
+
+// BatchResult is the result of one key of a batch request. Status is the HTTP status
+// the same request on /kv/{key} would get.
+type BatchResult struct {
+	Status int    `json:"status"`
+	Value  string `json:"value,omitempty"`
+	ETag   string `json:"etag,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// gatewayStatus maps the errors of Fetch, Store and Remove to HTTP status codes
+func gatewayStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrReservedKey):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrWrongType):
+		return http.StatusConflict
+	case errors.Is(err, ErrNodeFull):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+func gatewayError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), gatewayStatus(err))
+}
+
+// precondition reads the If-Match and If-None-Match headers of a write. Only one ETag is
+// accepted in If-Match, and only "*" in If-None-Match.
+func precondition(r *http.Request) (Precondition, bool) {
+	var cond Precondition
+	if m := strings.TrimSpace(r.Header.Get("If-Match")); m != "" {
+		if strings.Contains(m, ",") {
+			return cond, false
+		}
+		cond.IfMatch = m
+	}
+	if m := strings.TrimSpace(r.Header.Get("If-None-Match")); m != "" {
+		if m != "*" {
+			return cond, false
+		}
+		cond.IfNoneMatch = true
+	}
+	return cond, true
+}
+
+// matchETag tells whether the If-None-Match header of a read, "*" or a list of ETags,
+// matches etag. The ETags are compared weakly, as for the reads.
+func matchETag(header, etag string) bool {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+	for _, m := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(m), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *ChordNode) serveKey(w http.ResponseWriter, r *http.Request) {
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/kv/"))
+	if err != nil || key == "" {
+		http.Error(w, "bad key", http.StatusBadRequest)
+		return
+	}
+	var cond Precondition
+	if r.Method == http.MethodPut || r.Method == http.MethodDelete {
+		var ok bool
+		if cond, ok = precondition(r); !ok {
+			http.Error(w, "unsupported precondition", http.StatusBadRequest)
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		value, err := n.Open(key)
+		if err != nil {
+			gatewayError(w, err)
+			return
+		}
+		w.Header().Set("ETag", value.ETag)
+		if matchETag(r.Header.Get("If-None-Match"), value.ETag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(value.Size, 10))
+		if r.Method == http.MethodGet {
+			if _, err := io.Copy(w, value); err != nil {
+				n.logger.Error(n.Addr, " gateway: failed to send value of ", key, " ", err)
+			}
+		}
+	case http.MethodPut:
+		body := &bodyReader{r: http.MaxBytesReader(w, r.Body, maxGatewayValue)}
+		etag, err := n.StoreReader(key, body, cond)
+		if body.err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(body.err, &tooLarge) {
+				http.Error(w, body.err.Error(), http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, body.err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		if err != nil {
+			gatewayError(w, err)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := n.Remove(key, cond); err != nil {
+			gatewayError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// bodyReader keeps the error of reading a request body, to tell it from those of the ring
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// batchEncoding is how the keys and values are written in the JSON of the batch
+// requests, as they are or in base64 for binary ones
+type batchEncoding bool
+
+func (b64 batchEncoding) decode(s string) (string, error) {
+	if !b64 {
+		return s, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(s)
+	return string(raw), err
+}
+
+func (b64 batchEncoding) encode(s string) string {
+	if !b64 {
+		return s
+	}
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// serveBatch handles POST /batch/get and /batch/delete with a JSON array of keys, and
+// /batch/put with a JSON object of the pairs, through GetMany, DeleteMany and PutMany,
+// and answers a JSON object of BatchResult. With ?encoding=base64 the keys and values
+// in both are in base64.
+func (n *ChordNode) serveBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	op := strings.TrimPrefix(r.URL.Path, "/batch/")
+	enc := batchEncoding(r.URL.Query().Get("encoding") == "base64")
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGatewayBody))
+	results := make(map[string]BatchResult)
+	switch op {
+	case "get", "delete":
+		var keys []string
+		if err := dec.Decode(&keys); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for i, key := range keys {
+			var err error
+			if keys[i], err = enc.decode(key); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if op == "get" {
+			for key, res := range n.GetMany(keys) {
+				results[enc.encode(key)] = batchResult(res.Err, http.StatusOK)
+				if res.Err == nil {
+					results[enc.encode(key)] = BatchResult{Status: http.StatusOK, Value: enc.encode(res.Value), ETag: res.ETag}
+				}
+			}
+		} else {
+			for key, err := range n.DeleteMany(keys) {
+				results[enc.encode(key)] = batchResult(err, http.StatusNoContent)
+			}
+		}
+	case "put":
+		var encoded map[string]string
+		if err := dec.Decode(&encoded); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pairs := make(map[string]string, len(encoded))
+		for k, v := range encoded {
+			key, err := enc.decode(k)
+			if err == nil {
+				pairs[key], err = enc.decode(v)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		errs, etags := n.putMany(pairs)
+		for key, err := range errs {
+			res := batchResult(err, http.StatusNoContent)
+			if err == nil {
+				res.ETag = etags[key]
+			}
+			results[enc.encode(key)] = res
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func batchResult(err error, okStatus int) BatchResult {
+	if err != nil {
+		return BatchResult{Status: gatewayStatus(err), Error: err.Error()}
+	}
+	return BatchResult{Status: okStatus}
+}
+
+// GatewayHandler serves the data of the ring over HTTP: GET, PUT and DELETE on
+// /kv/{key} go through Fetch, Store and Remove of the node, and the responses carry the
+// ETag of the value for If-Match and If-None-Match.
+func (n *ChordNode) GatewayHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv/", n.serveKey)
+	mux.HandleFunc("/batch/", n.serveBatch)
+	return mux
+}
+
+// ServeGateway exposes the gateway on addr until the node quits.
+func (n *ChordNode) ServeGateway(addr string) error {
+	if err := n.gateway.server.serve(n, addr, n.GatewayHandler()); err != nil {
+		n.logger.Error(n.Addr, " ServeGateway: listen error: ", err)
+		return err
+	}
+	return nil
+}
+
+func (n *ChordNode) closeGateway() {
+	n.gateway.server.close()
+}
@@ -0,0 +1,166 @@
+package chord
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A lock is kept by the owner of its key, lockKeyPrefix and the name. Every change of it
+// is written to the first backup with PutData before the owner applies it and replies, so
+// the successor which takes the data over after a ForceQuit of the owner knows about
+// every lease granted; the change fails if no successor can be reached. A node which does
+// not own the key rejects the changes with ErrNotOwner, so that two nodes never grant the
+// same lock while a join moves it. Each grant gets a fencing token larger than all the earlier ones
+// of the lock, which the holder passes to the resources it protects, so that they can
+// reject the writes of a holder whose lease has expired meanwhile.
+const (
+	lockKeyPrefix = "\x00lock:"
+	lockMagic     = reservedPrefix + "lock\n"
+)
+
+// Lease is a lock held until Expire, as seen by the holder.
+type Lease struct {
+	Name string
+	// ID identifies the holder
+	ID     string
+	Token  uint64
+	Expire time.Time
+}
+
+type lockState struct {
+	Holder string
+	Token  uint64
+	// Expire in unix nanoseconds
+	Expire int64
+}
+
+// LockKey is the key of the lock name, whose owner grants it.
+func LockKey(name string) string {
+	return lockKeyPrefix + name
+}
+
+func parseLock(stored string) (*lockState, bool) {
+	if !strings.HasPrefix(stored, lockMagic) {
+		return nil, false
+	}
+	var l lockState
+	if err := gob.NewDecoder(strings.NewReader(stored[len(lockMagic):])).Decode(&l); err != nil {
+		return nil, false
+	}
+	return &l, true
+}
+
+func (l *lockState) encode() string {
+	var b bytes.Buffer
+	b.WriteString(lockMagic)
+	gob.NewEncoder(&b).Encode(l)
+	return b.String()
+}
+
+type LeaseOp int
+
+const (
+	LeaseAcquire LeaseOp = iota
+	LeaseRenew
+	LeaseRelease
+)
+
+// apply changes l by the request made at now.
+func (l *lockState) apply(request LeaseRequest, now time.Time) error {
+	held := l.Holder != "" && now.UnixNano() < l.Expire
+	switch request.Op {
+	case LeaseAcquire:
+		if held && l.Holder != request.ID {
+			return fmt.Errorf("%w: %s until %v", ErrLocked, request.Name, time.Unix(0, l.Expire))
+		}
+		l.Holder = request.ID
+		l.Token++
+		l.Expire = now.Add(request.TTL).UnixNano()
+	case LeaseRenew:
+		if !held || l.Holder != request.ID || l.Token != request.Token {
+			return fmt.Errorf("%w: %s", ErrLeaseLost, request.Name)
+		}
+		l.Expire = now.Add(request.TTL).UnixNano()
+	case LeaseRelease:
+		if l.Holder != request.ID || l.Token != request.Token {
+			return fmt.Errorf("%w: %s", ErrLeaseLost, request.Name)
+		}
+		l.Holder, l.Expire = "", 0
+	default:
+		return fmt.Errorf("unknown lease op %d", request.Op)
+	}
+	return nil
+}
+
+// Acquire takes the lock name for ttl, or fails with ErrLocked if another holder has it.
+func (n *ChordNode) Acquire(name string, ttl time.Duration) (*Lease, error) {
+	return acquireLease(name, ttl, n.leaseOp)
+}
+
+// Renew extends the lease to ttl from now, or fails with ErrLeaseLost if it has expired.
+func (n *ChordNode) Renew(lease *Lease, ttl time.Duration) error {
+	return renewLease(lease, ttl, n.leaseOp)
+}
+
+// Release gives the lock up before the lease expires.
+func (n *ChordNode) Release(lease *Lease) error {
+	return releaseLease(lease, n.leaseOp)
+}
+
+// The holder counts the ttl from before the request, so that its lease never ends after
+// the one of the owner.
+func acquireLease(name string, ttl time.Duration, send func(LeaseRequest) (uint64, error)) (*Lease, error) {
+	lease := &Lease{Name: name, ID: newTag()}
+	start := time.Now()
+	token, err := send(LeaseRequest{Op: LeaseAcquire, Name: name, ID: lease.ID, TTL: ttl})
+	if err != nil {
+		return nil, err
+	}
+	lease.Token, lease.Expire = token, start.Add(ttl)
+	return lease, nil
+}
+
+func renewLease(lease *Lease, ttl time.Duration, send func(LeaseRequest) (uint64, error)) error {
+	start := time.Now()
+	_, err := send(LeaseRequest{Op: LeaseRenew, Name: lease.Name, ID: lease.ID, Token: lease.Token, TTL: ttl})
+	if err == nil {
+		lease.Expire = start.Add(ttl)
+	}
+	return err
+}
+
+func releaseLease(lease *Lease, send func(LeaseRequest) (uint64, error)) error {
+	_, err := send(LeaseRequest{Op: LeaseRelease, Name: lease.Name, ID: lease.ID, Token: lease.Token})
+	return err
+}
+
+func (n *ChordNode) leaseOp(request LeaseRequest) (uint64, error) {
+	sp := n.startSpan("Lease", TraceContext{})
+	sp.set("chord.lock", request.Name)
+	request.Trace = sp.context()
+	var token uint64
+	err := n.toOwner(func() (err error) {
+		token, err = n.leaseOnce(request)
+		return err
+	})
+	sp.finish(err)
+	return token, err
+}
+
+func (n *ChordNode) leaseOnce(request LeaseRequest) (uint64, error) {
+	targetAddr, err := n.lookup(LockKey(request.Name), request.Trace)
+	if err != nil {
+		n.logger.Error(n.Addr, " Lease: failed in FindSuccessor ", err)
+		return 0, err
+	}
+	var link chordLink
+	if err := link.Dial(targetAddr, &n.cfg); err != nil {
+		n.logger.Error(n.Addr, " Lease: failed to dial target ", err)
+		return 0, err
+	}
+	defer link.close()
+	return link.Lease(request)
+}
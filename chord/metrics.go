@@ -0,0 +1,104 @@
+package chord
+
+import (
+	"dht/internal"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+type chordMetrics struct {
+	stabilizeOK     atomic.Int64
+	stabilizeFail   atomic.Int64
+	succListChanges atomic.Int64
+	rejectedFull    atomic.Int64
+	overBackupQuota atomic.Int64
+
+	server httpEndpoint
+}
+
+// httpEndpoint is an optional http server of the node, closed when the node quits.
+type httpEndpoint struct {
+	server *http.Server
+	lock   sync.Mutex
+}
+
+func (e *httpEndpoint) serve(n *ChordNode, addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: handler}
+	e.lock.Lock()
+	e.server = server
+	e.lock.Unlock()
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			n.logger.Error(n.Addr, " http server on ", addr, ": ", err)
+		}
+	}()
+	return nil
+}
+
+func (e *httpEndpoint) close() {
+	e.lock.Lock()
+	if e.server != nil {
+		e.server.Close()
+		e.server = nil
+	}
+	e.lock.Unlock()
+}
+
+// MetricsHandler serves the metrics of the node in the Prometheus text format.
+func (n *ChordNode) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		n.stats.WriteMetrics(w, "chord_")
+		internal.WriteCounter(w, "chord_stabilize_success_total", "Successful stabilize rounds.", n.metrics.stabilizeOK.Load())
+		internal.WriteCounter(w, "chord_stabilize_failure_total", "Failed stabilize rounds.", n.metrics.stabilizeFail.Load())
+		internal.WriteCounter(w, "chord_succ_list_changes_total", "Changes of the successor list.", n.metrics.succListChanges.Load())
+		dataCnt := n.data.Len()
+		backupCnt := 0
+		n.backupDataLock.RLock()
+		for _, backup := range n.backupData {
+			backupCnt += backup.Len()
+		}
+		n.backupDataLock.RUnlock()
+		n.activeConnLock.Lock()
+		connCnt := len(n.activeConn)
+		n.activeConnLock.Unlock()
+		internal.WriteGauge(w, "chord_data_keys", "Keys in the primary data.", int64(dataCnt))
+		internal.WriteGauge(w, "chord_backup_keys", "Keys in the backup data.", int64(backupCnt))
+		_, dataBytes := n.usage(false)
+		_, backupBytes := n.usage(true)
+		internal.WriteGauge(w, "chord_data_bytes", "Bytes of the keys and values in the primary data.", dataBytes)
+		internal.WriteGauge(w, "chord_backup_bytes", "Bytes of the keys and values in the backup data.", backupBytes)
+		internal.WriteGaugeFloat(w, "chord_quota_usage_ratio", "Largest fraction of a storage quota in use.", n.quotaUsage())
+		internal.WriteCounter(w, "chord_node_full_rejections_total", "Writes rejected because the node is full.", n.metrics.rejectedFull.Load())
+		internal.WriteCounter(w, "chord_backup_over_quota_total", "Backup writes beyond the backup quota, which are not refused.", n.metrics.overBackupQuota.Load())
+		nsKeys, nsBytes := make(map[string]int64), make(map[string]int64)
+		for ns, stats := range n.NamespaceStats() {
+			nsKeys[ns], nsBytes[ns] = int64(stats.Keys), stats.Bytes
+		}
+		internal.WriteGaugeVec(w, "chord_namespace_keys", "Keys in the primary data by namespace.", "namespace", nsKeys)
+		internal.WriteGaugeVec(w, "chord_namespace_bytes", "Bytes of the primary data by namespace.", "namespace", nsBytes)
+		internal.WriteGauge(w, "chord_active_connections", "Active incoming RPC connections.", int64(connCnt))
+	})
+}
+
+// ServeMetrics exposes /metrics on addr until the node quits.
+func (n *ChordNode) ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", n.MetricsHandler())
+	if err := n.metrics.server.serve(n, addr, mux); err != nil {
+		n.logger.Error(n.Addr, " ServeMetrics: listen error: ", err)
+		return err
+	}
+	return nil
+}
+
+func (n *ChordNode) closeMetrics() {
+	n.metrics.server.close()
+}
@@ -0,0 +1,290 @@
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A namespace is a key space of its own on the ring. The key of a namespace is stored as
+// nsKeyPrefix, the name, a zero byte and the key, so it is hashed apart from the same key
+// in other namespaces, and it is carried by every request and moved by the joins, quits
+// and backups like any key. The namespaces need no setup; the config of the nodes may
+// give a namespace fewer backups or a TTL for its keys, which must then be the same on all
+// of them like Replication. The chunks of a large value are shared by all the keys with
+// the same content, so they have the backups of the node whatever the namespace, and no
+// TTL: they are collected once no manifest refers to them any more, see collectChunks.
+const (
+	nsKeyPrefix = "\x00ns:"
+	// the keys of the namespaces with a TTL are checked this often
+	nsExpireInterval = time.Second
+)
+
+// NamespaceConfig is the config of a namespace. Zero fields take the values of the node.
+type NamespaceConfig struct {
+	// Replication is the number of backups of the keys, at most that of the node
+	Replication int `json:"replication"`
+	// TTL is how long a key lives after its last write, forever if zero
+	TTL time.Duration `json:"ttl"`
+}
+
+// NamespaceStats are the primary data of a namespace at a node.
+type NamespaceStats struct {
+	Keys  int   `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// NamespaceKey is the key stored for key in namespace ns, key itself if ns is empty.
+func NamespaceKey(ns, key string) string {
+	if ns == "" {
+		return key
+	}
+	return nsKeyPrefix + ns + "\x00" + key
+}
+
+// splitNamespace returns the namespace of a stored key, empty for the default one.
+func splitNamespace(stored string) (ns, key string) {
+	if !strings.HasPrefix(stored, nsKeyPrefix) {
+		return "", stored
+	}
+	ns, key, ok := strings.Cut(stored[len(nsKeyPrefix):], "\x00")
+	if !ok {
+		return "", stored
+	}
+	return ns, key
+}
+
+func checkNamespace(ns string) error {
+	if strings.Contains(ns, "\x00") {
+		return errors.New("namespace with a zero byte")
+	}
+	return nil
+}
+
+// replication is the number of backups of key.
+func (c *Config) replication(key string) int {
+	ns, _ := splitNamespace(key)
+	if r := c.Namespaces[ns].Replication; r > 0 {
+		return r
+	}
+	return c.Replication
+}
+
+func (info *NodeInfo) replication(key string) int {
+	c := Config{Replication: info.Replication, Namespaces: info.Namespaces}
+	return c.replication(key)
+}
+
+func (c *Config) keyTTL(key string) time.Duration {
+	ns, _ := splitNamespace(key)
+	if ns == "" {
+		return 0
+	}
+	return c.Namespaces[ns].TTL
+}
+
+func (c *Config) hasKeyTTL() bool {
+	for ns, nc := range c.Namespaces {
+		if ns != "" && nc.TTL > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// backedUp returns the pairs of data with a backup at the level.
+func (c *Config) backedUp(data map[string]string, level int) map[string]string {
+	if len(c.Namespaces) == 0 {
+		return data
+	}
+	kept := make(map[string]string, len(data))
+	for k, v := range data {
+		if level < c.replication(k) {
+			kept[k] = v
+		}
+	}
+	return kept
+}
+
+// Namespace gives the operations of the node on the keys of namespace name.
+type Namespace struct {
+	node *ChordNode
+	name string
+}
+
+// Namespace returns the namespace name of the ring, the default key space if it is empty.
+func (n *ChordNode) Namespace(name string) (*Namespace, error) {
+	if err := checkNamespace(name); err != nil {
+		return nil, err
+	}
+	return &Namespace{node: n, name: name}, nil
+}
+
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+func (ns *Namespace) Store(key, value string, cond Precondition) error {
+	return ns.node.Store(NamespaceKey(ns.name, key), value, cond)
+}
+
+func (ns *Namespace) Fetch(key string) (string, error) {
+	return ns.node.Fetch(NamespaceKey(ns.name, key))
+}
+
+func (ns *Namespace) Remove(key string, cond Precondition) error {
+	return ns.node.Remove(NamespaceKey(ns.name, key), cond)
+}
+
+// NamespaceStats returns the stats of the namespaces in the primary data of the node, of
+// the default one under "".
+func (n *ChordNode) NamespaceStats() map[string]NamespaceStats {
+	if sized, ok := n.data.(*sizedStorage); ok {
+		return sized.NamespaceStats()
+	}
+	stats := make(map[string]NamespaceStats)
+	for key, value := range snapshot(n.data) {
+		ns, _ := splitNamespace(key)
+		s := stats[ns]
+		s.Keys++
+		s.Bytes += pairSize(key, value)
+		stats[ns] = s
+	}
+	return stats
+}
+
+// keyWrites records when the keys with a TTL were last written, in the primary data or
+// in a backup, so that a successor taking over the keys knows their age.
+type keyWrites struct {
+	at   map[string]time.Time
+	lock sync.Mutex
+}
+
+func (w *keyWrites) touch(keys ...string) {
+	now := time.Now()
+	w.lock.Lock()
+	if w.at == nil {
+		w.at = make(map[string]time.Time)
+	}
+	for _, key := range keys {
+		w.at[key] = now
+	}
+	w.lock.Unlock()
+}
+
+func (w *keyWrites) reset() {
+	w.lock.Lock()
+	w.at = nil
+	w.lock.Unlock()
+}
+
+// expired returns the keys among keys written longer than their ttl ago. A key never seen,
+// e.g. moved to the node by a join, is taken as written at the time of its version in
+// versions if it has one, which the owner gives from its clock, or else now. The keys not
+// in keys any more are forgotten.
+func (w *keyWrites) expired(keys []string, versions map[string]uint64, ttl func(key string) time.Duration) []string {
+	now := time.Now()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	at := make(map[string]time.Time, len(keys))
+	var expired []string
+	for _, key := range keys {
+		t, ok := w.at[key]
+		if !ok {
+			t = now
+			if written := time.Unix(0, int64(versions[key])); versions[key] > 0 && written.Before(now) {
+				t = written
+			}
+		}
+		at[key] = t
+		if now.Sub(t) > ttl(key) {
+			expired = append(expired, key)
+		}
+	}
+	w.at = at
+	return expired
+}
+
+func (w *keyWrites) stale(key string, ttl time.Duration) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	t, ok := w.at[key]
+	return ok && time.Since(t) > ttl
+}
+
+// touchWritten records a write of keys with a TTL.
+func (n *ChordNode) touchWritten(keys ...string) {
+	if !n.cfg.hasKeyTTL() {
+		return
+	}
+	for _, key := range keys {
+		if n.cfg.keyTTL(key) > 0 {
+			n.writes.touch(key)
+		}
+	}
+}
+
+// expireKeys deletes the keys of the primary data past the TTL of their namespace, and
+// their backups.
+func (n *ChordNode) expireKeys() {
+	if !n.online.Load() {
+		return
+	}
+	var keys []string
+	versions := make(map[string]uint64)
+	collect := func(s Storage) {
+		for key, stored := range n.trackedPairs(s) {
+			if _, seen := versions[key]; !seen && n.cfg.keyTTL(key) > 0 {
+				versions[key], _ = splitVersion(stored)
+				keys = append(keys, key)
+			}
+		}
+	}
+	collect(n.data)
+	n.backupDataLock.RLock()
+	backups := append([]Storage(nil), n.backupData...)
+	n.backupDataLock.RUnlock()
+	for _, backup := range backups {
+		collect(backup)
+	}
+	for _, key := range n.writes.expired(keys, versions, n.cfg.keyTTL) {
+		n.expireKey(key)
+	}
+}
+
+func (n *ChordNode) expireKey(key string) {
+	n.writeLock.Lock()
+	value, exists := n.data.Get(key)
+	if !exists || !n.writes.stale(key, n.cfg.keyTTL(key)) || !n.data.Delete(key) {
+		n.writeLock.Unlock()
+		return
+	}
+	n.notifyWatches(EventDelete, key, value)
+	n.writeLock.Unlock()
+	succ := n.getOnlineSucc()
+	if succ == nil {
+		return
+	}
+	defer succ.close()
+	if err := succ.DeleteData(key, true, 0, TraceContext{}); err != nil && !errors.Is(err, ErrNotFound) {
+		n.logger.Error(n.Addr, " expireKeys: delete succ backup KV: ", err)
+	}
+}
+
+func (c *Config) validateNamespaces() error {
+	for ns, nc := range c.Namespaces {
+		switch {
+		case ns == "":
+			return errors.New("config of the default namespace, use the config of the node")
+		case checkNamespace(ns) != nil:
+			return fmt.Errorf("namespace %q: %w", ns, checkNamespace(ns))
+		case nc.Replication < 0 || nc.Replication > c.Replication:
+			return fmt.Errorf("replication %d of namespace %s should be in [0, %d], 0 for that of the node", nc.Replication, ns, c.Replication)
+		case nc.TTL < 0:
+			return fmt.Errorf("ttl %v of namespace %s should not be negative, 0 for none", nc.TTL, ns)
+		}
+	}
+	return nil
+}
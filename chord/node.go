@@ -2,78 +2,95 @@ package chord
 
 import (
 	"dht/internal"
-
-	"github.com/sirupsen/logrus"
+	"errors"
+	"strings"
 )
 
+// notOwnerRetries is how many times a write is sent again, a round of stabilization
+// later, when the node found for the key does not own it
+const notOwnerRetries = 3
+
 // Impl. of DHT interface
 
+// Run listens before it returns, so that the node can be quit right after.
 func (n *ChordNode) Run() {
-	go n.RunRPCServer()
+	n.Start()
+}
+
+// Start is like Run, but reports the error if it cannot listen.
+func (n *ChordNode) Start() error {
+	if err := n.listen(); err != nil {
+		return err
+	}
+	n.routines.Add(1)
+	go n.serve(n.server, n.listener)
+	return nil
 }
 
 func (n *ChordNode) Create() {
 	n.succList[0] = n.Addr
-	n.fingers[0].Dial(n.Addr)
-	n.predecessor.Dial(n.Addr)
-	logrus.Infof("%s, %d Join new network", n.Addr, n.Id)
+	n.fingers[0].Dial(n.Addr, &n.cfg)
+	n.predecessor.Dial(n.Addr, &n.cfg)
+	n.logger.Infof("%s, %d Join new network", n.Addr, n.Id)
 	n.online.Store(true)
 	n.maintain()
 }
 
 func (n *ChordNode) Join(addr string) bool {
-	logrus.Infof("%s, %d Join %s ...", n.Addr, n.Id, addr)
+	n.logger.Infof("%s, %d Join %s ...", n.Addr, n.Id, addr)
 	n.fingersLock.Lock()
 	defer n.fingersLock.Unlock()
 	link := &n.fingers[0]
-	err := link.Dial(addr)
+	err := link.Dial(addr, &n.cfg)
 	if err != nil {
-		logrus.Error(n.Addr, " Join: fialed to dial ", addr, err)
+		n.logger.Error(n.Addr, " Join: fialed to dial ", addr, err)
 		return false
 	}
-	var succAddr string
-	err = link.FindSuccessor(n.Id, ChordTTL, &succAddr)
+	sp := n.startSpan("Join", TraceContext{})
+	defer sp.finish(nil)
+	var reply FindSuccessorReply
+	err = link.FindSuccessor(n.Id, n.cfg.TTL, sp.context(), &reply)
 	link.close()
 	if err != nil {
-		logrus.Error(n.Addr, " Join: failed in FindSuccessor ", err)
+		n.logger.Error(n.Addr, " Join: failed in FindSuccessor ", err)
 		return false
 	}
-	err = link.Dial(succAddr)
+	succAddr := reply.Addr
+	err = link.Dial(succAddr, &n.cfg)
 	if err != nil {
-		logrus.Error(n.Addr, " Join: fail to dial successor ", succAddr, err)
+		n.logger.Error(n.Addr, " Join: fail to dial successor ", succAddr, err)
 		return false
 	}
 	if n.Id == link.id {
-		logrus.Error(n.Addr, " Join: conflict ID with ", link.remoteAddr, " , ", n.Id)
+		n.logger.Error(n.Addr, " Join: conflict ID with ", link.remoteAddr, " , ", n.Id)
 		link.close()
 		return false
 	}
-	var newSuccList [ChordK]string
+	var newSuccList []string
 	err = link.GetSuccList(&newSuccList)
 	if err != nil {
-		logrus.Error(n.Addr, " Join: get succList failed with ", err)
+		n.logger.Error(n.Addr, " Join: get succList failed with ", err)
 		return false
 	}
 	n.succListLock.Lock()
 	n.succList[0] = succAddr
-	for i := 1; i < ChordK; i++ {
+	for i := 1; i < len(n.succList) && i-1 < len(newSuccList); i++ {
 		n.succList[i] = newSuccList[i-1]
 	}
 	n.succListLock.Unlock()
 	var data map[string]string
 	err = link.GetAllData(&data)
 	if err != nil {
-		logrus.Error(n.Addr, " Join: fail to get data from successor ", err)
+		n.logger.Error(n.Addr, " Join: fail to get data from successor ", err)
 		return false
 	}
-	n.dataLock.Lock()
-	for k, v := range data {
+	for k := range data {
 		dataID := internal.Str_uint32_sha1(k)
-		if inRange(link.id+1, n.Id+1, dataID) {
-			n.data[k] = v
+		if !inRange(link.id+1, n.Id+1, dataID) {
+			delete(data, k)
 		}
 	}
-	n.dataLock.Unlock()
+	n.mergePrimary(data)
 	n.online.Store(true)
 	n.maintain()
 	return true
@@ -83,23 +100,29 @@ func (n *ChordNode) Quit() {
 	if !n.online.Load() {
 		return
 	}
-	logrus.Info(n.Addr, " start Quit")
+	n.logger.Info(n.Addr, " start Quit")
 	n.online.Store(false)
+	sp := n.startSpan("Quit", TraceContext{})
 	succ := n.getOnlineSucc()
 	if succ != nil {
 		if succ.remoteAddr != n.Addr {
-			succ.SuccInformExit(n.Addr, n.predecessor.remoteAddr, &n.data)
+			data := snapshot(n.data)
+			succ.SuccInformExit(n.Addr, n.predecessor.remoteAddr, &data, sp.context())
 		}
 		n.predecsorLock.RLock()
 		if n.predecessor.isConnected() && n.predecessor.remoteAddr != n.Addr {
-			n.predecessor.PredInformExit(n.Addr, succ.remoteAddr)
+			n.predecessor.PredInformExit(n.Addr, succ.remoteAddr, sp.context())
 		}
 		n.predecsorLock.RUnlock()
 		succ.close()
 	} else {
-		logrus.Error(n.Addr, " Quit: failed to get online")
+		n.logger.Error(n.Addr, " Quit: failed to get online")
 	}
-	n.listener.Close()
+	sp.finish(nil)
+	n.stop()
+	n.closeMetrics()
+	n.closeAdmin()
+	n.closeGateway()
 	n.CloseRPCLinks()
 	n.Clear()
 }
@@ -108,80 +131,183 @@ func (n *ChordNode) ForceQuit() {
 	if !n.online.Load() {
 		return
 	}
-	logrus.Warn(n.Addr, " start ForceQuit")
+	n.logger.Warn(n.Addr, " start ForceQuit")
 	n.online.Store(false)
-	if err := n.listener.Close(); err != nil {
-		logrus.Error(n.Addr, " ForceQuit: close listener with error: ", err)
-	}
+	n.stop()
+	n.closeMetrics()
+	n.closeAdmin()
+	n.closeGateway()
 	n.CloseRPCLinks()
 	n.Clear()
 }
 
 func (n *ChordNode) Put(key string, value string) bool {
+	return n.Store(key, value, Precondition{}) == nil
+}
+
+// Store is like Put, but the owner writes only if cond holds, otherwise it fails with
+// ErrPreconditionFailed.
+func (n *ChordNode) Store(key, value string, cond Precondition) error {
+	_, err := n.StoreReader(key, strings.NewReader(value), cond)
+	return err
+}
+
+func (n *ChordNode) put(key, value string, cond Precondition, trace TraceContext) error {
+	_, err := n.putData(PutDataRequest{Key: key, Value: value, Cond: cond, Trace: trace})
+	return err
+}
+
+// toOwner runs f, which looks up the owner of a key and writes to it, again while the
+// node found does not own the key, as happens while the ring stabilizes.
+func (n *ChordNode) toOwner(f func() error) error {
+	err := f()
+	for try := 0; try < notOwnerRetries && errors.Is(err, ErrNotOwner); try++ {
+		if !n.sleep(n.cfg.StabilizeInterval) {
+			return err
+		}
+		err = f()
+	}
+	return err
+}
+
+// putData sends the request to the owner of its key, and returns the ETag the owner has
+// given to the key.
+func (n *ChordNode) putData(request PutDataRequest) (etag string, err error) {
+	err = n.toOwner(func() (err error) {
+		etag, err = n.putDataOnce(request)
+		return err
+	})
+	return etag, err
+}
+
+func (n *ChordNode) putDataOnce(request PutDataRequest) (string, error) {
+	key, trace := request.Key, request.Trace
+	if err := n.cfg.checkSize(key, request.Value); err != nil {
+		n.logger.Error(n.Addr, " Put: ", err)
+		return "", err
+	}
 	targetID := internal.Str_uint32_sha1(key)
 	var link chordLink
-	var targetAddr string
-	err := n.FindSuccessor(FindSuccessorRequest{targetID, ChordTTL}, &targetAddr)
+	targetAddr, err := n.lookup(key, trace)
 	if err != nil {
-		logrus.Error(n.Addr, " Put: failed in FindSuccessor ", err)
-		return false
+		n.logger.Error(n.Addr, " Put: failed in FindSuccessor ", err)
+		return "", err
 	}
-	logrus.Infof("%s Put: putting %s [%d] to %s", n.Addr, key, targetID, targetAddr)
-	err = link.Dial(targetAddr)
+	n.logger.Infof("%s Put: putting %s [%d] to %s", n.Addr, key, targetID, targetAddr)
+	err = link.Dial(targetAddr, &n.cfg)
 	if err != nil {
-		logrus.Error(n.Addr, " Put: failed to dial target ", err)
-		return false
+		n.logger.Error(n.Addr, " Put: failed to dial target ", err)
+		return "", err
 	}
-	err = link.PutData(key, value, false)
+	defer link.close()
+	etag, err := link.SendPutData(request)
 	if err != nil {
-		logrus.Error(n.Addr, " Put: failed to put data ", err)
-		return false
+		n.logger.Error(n.Addr, " Put: failed to put data ", err)
+		return "", err
 	}
-	return true
+	return etag, nil
 }
 
 func (n *ChordNode) Get(key string) (bool, string) {
+	value, err := n.Fetch(key)
+	return err == nil, value
+}
+
+// Fetch is like Get, but tells ErrNotFound from the failures of the ring.
+func (n *ChordNode) Fetch(key string) (string, error) {
+	sp := n.startSpan("Get", TraceContext{})
+	sp.set("dht.key", key)
+	value, err := n.get(key, sp.context())
+	if err == nil {
+		value, err = n.readValue(value, sp.context())
+	}
+	sp.finish(err)
+	return value, err
+}
+
+func (n *ChordNode) get(key string, trace TraceContext) (string, error) {
 	targetID := internal.Str_uint32_sha1(key)
-	var value, targetAddr string
-	err := n.FindSuccessor(FindSuccessorRequest{targetID, ChordTTL}, &targetAddr)
+	targetAddr, err := n.lookup(key, trace)
 	if err != nil {
-		logrus.Error(n.Addr, " Get: failed in FindSuccessor ", err)
-		return false, ""
+		n.logger.Error(n.Addr, " Get: failed in FindSuccessor ", err)
+		return "", err
 	}
-	logrus.Info(n.Addr, " Get: asking ", targetAddr, " for key ", key, " ", targetID)
+	n.logger.Info(n.Addr, " Get: asking ", targetAddr, " for key ", key, " ", targetID)
 	var link chordLink
-	err = link.Dial(targetAddr)
+	err = link.Dial(targetAddr, &n.cfg)
 	if err != nil {
-		logrus.Error(n.Addr, " Get: failed to dial target ", err)
-		return false, ""
+		n.logger.Error(n.Addr, " Get: failed to dial target ", err)
+		return "", err
 	}
-	value, err = link.GetDataByKey(key)
+	defer link.close()
+	value, err := link.GetDataByKey(key, trace)
 	if err != nil {
-		logrus.Error(n.Addr, " Get: failed to get data ", err)
-		return false, ""
+		n.logger.Error(n.Addr, " Get: failed to get data ", err)
+		return "", err
 	}
-	return true, value
+	return value, nil
 }
 
 func (n *ChordNode) Delete(key string) bool {
+	return n.Remove(key, Precondition{}) == nil
+}
+
+// Remove is like Delete, but the owner deletes only if cond holds. It fails with
+// ErrNotFound if there is no such key.
+func (n *ChordNode) Remove(key string, cond Precondition) error {
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	sp := n.startSpan("Delete", TraceContext{})
+	sp.set("dht.key", key)
+	err := n.delete(key, cond, sp.context())
+	sp.finish(err)
+	return err
+}
+
+func (n *ChordNode) delete(key string, cond Precondition, trace TraceContext) error {
+	return n.toOwner(func() error {
+		return n.deleteOnce(key, cond, trace)
+	})
+}
+
+func (n *ChordNode) deleteOnce(key string, cond Precondition, trace TraceContext) error {
 	targetID := internal.Str_uint32_sha1(key)
-	var targetAddr string
-	err := n.FindSuccessor(FindSuccessorRequest{targetID, ChordTTL}, &targetAddr)
+	targetAddr, err := n.lookup(key, trace)
 	if err != nil {
-		logrus.Error(n.Addr, " Delete: failed in FindSuccessor ", err)
-		return false
+		n.logger.Error(n.Addr, " Delete: failed in FindSuccessor ", err)
+		return err
 	}
-	logrus.Info(n.Addr, " Delete: asking ", targetAddr, " to delete key ", key, " ", targetID)
+	n.logger.Info(n.Addr, " Delete: asking ", targetAddr, " to delete key ", key, " ", targetID)
 	var link chordLink
-	err = link.Dial(targetAddr)
+	err = link.Dial(targetAddr, &n.cfg)
 	if err != nil {
-		logrus.Error(n.Addr, " Delete: failed to dial target ", err)
-		return false
+		n.logger.Error(n.Addr, " Delete: failed to dial target ", err)
+		return err
 	}
-	err = link.DeleteData(key, false)
+	defer link.close()
+	err = link.DeleteDataIf(key, cond, false, 0, trace)
 	if err != nil {
-		logrus.Error(n.Addr, " Delete: failed to delete data ", err)
-		return false
+		n.logger.Error(n.Addr, " Delete: failed to delete data ", err)
+		return err
 	}
-	return true
+	return nil
+}
+
+// PutBytes, GetBytes and DeleteBytes are Store, Fetch and Remove for binary keys and
+// values. Any byte sequence is kept as it is.
+func (n *ChordNode) PutBytes(key, value []byte) error {
+	return n.Store(string(key), string(value), Precondition{})
+}
+
+func (n *ChordNode) GetBytes(key []byte) ([]byte, error) {
+	value, err := n.Fetch(string(key))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+func (n *ChordNode) DeleteBytes(key []byte) error {
+	return n.Remove(string(key), Precondition{})
 }
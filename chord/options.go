@@ -0,0 +1,327 @@
+package chord
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// default values of Config
+const (
+	defaultStabilizeInterval = time.Millisecond * 200
+	defaultFixFingerInterval = time.Millisecond * 200
+	defaultFixPredInterval   = time.Millisecond * 200
+	defaultDialTimeout       = time.Second * 10
+	defaultReplication       = 1
+	defaultMaxKeySize        = 1 << 10
+	defaultMaxValueSize      = 4 << 20
+	defaultChunkSize         = 256 << 10
+	defaultChunkGCInterval   = time.Minute
+)
+
+// Transport creates the connections between nodes. The default one uses TCP.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (tcpTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// Config tunes a node. Zero fields take the default values.
+type Config struct {
+	// SuccListLen is the length of the successor list, ChordK by default
+	SuccListLen int
+	// TTL is the max hops of FindSuccessor, ChordTTL by default
+	TTL               int16
+	StabilizeInterval time.Duration
+	FixFingerInterval time.Duration
+	FixPredInterval   time.Duration
+	DialTimeout       time.Duration
+	// Replication is the number of successors keeping a backup of the data of a node,
+	// which should not be larger than SuccListLen
+	Replication int
+	// MaxKeySize and MaxValueSize limit in bytes the pairs a node writes or accepts as
+	// their owner
+	MaxKeySize   int
+	MaxValueSize int
+	// values larger than ChunkSize are cut into chunks, see SplitValue, and the chunks no
+	// manifest refers to are deleted after a few rounds of ChunkGCInterval. ChunkSize is at
+	// most MaxValueSize, which is then the size of the whole value.
+	ChunkSize       int
+	ChunkGCInterval time.Duration
+	// MaxKeys and MaxBytes limit the primary data of the node, unlimited if zero. The
+	// backups are never refused, going over MaxBackupKeys or MaxBackupBytes, for all of
+	// them together, is only counted. The bytes are those of the keys and values.
+	MaxKeys        int64
+	MaxBytes       int64
+	MaxBackupKeys  int64
+	MaxBackupBytes int64
+	// Namespaces are the configs of the namespaces which differ from the node, see
+	// NamespaceKey
+	Namespaces map[string]NamespaceConfig
+
+	// NewStorage creates the storage of the primary data and of each level of backup
+	NewStorage func() Storage
+	Transport  Transport
+	// SpanExporter receives the trace spans of the node, no span is recorded if it is nil
+	SpanExporter SpanExporter
+
+	Logger       *logrus.Logger
+	logLevel     *logrus.Level
+	logOutput    io.Writer
+	logFormatter logrus.Formatter
+}
+
+func DefaultConfig() Config {
+	c := Config{}
+	c.setDefaults()
+	return c
+}
+
+func (c *Config) setDefaults() {
+	if c.SuccListLen == 0 {
+		c.SuccListLen = ChordK
+	}
+	if c.TTL == 0 {
+		c.TTL = ChordTTL
+	}
+	if c.StabilizeInterval == 0 {
+		c.StabilizeInterval = defaultStabilizeInterval
+	}
+	if c.FixFingerInterval == 0 {
+		c.FixFingerInterval = defaultFixFingerInterval
+	}
+	if c.FixPredInterval == 0 {
+		c.FixPredInterval = defaultFixPredInterval
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = defaultDialTimeout
+	}
+	if c.Replication == 0 {
+		c.Replication = defaultReplication
+	}
+	if c.MaxKeySize == 0 {
+		c.MaxKeySize = defaultMaxKeySize
+	}
+	if c.MaxValueSize == 0 {
+		c.MaxValueSize = defaultMaxValueSize
+	}
+	if c.ChunkSize == 0 {
+		c.ChunkSize = defaultChunkSize
+		if c.ChunkSize > c.MaxValueSize {
+			c.ChunkSize = c.MaxValueSize
+		}
+	}
+	if c.ChunkGCInterval == 0 {
+		c.ChunkGCInterval = defaultChunkGCInterval
+	}
+	if c.NewStorage == nil {
+		c.NewStorage = NewMemStorage
+	}
+	if c.Transport == nil {
+		c.Transport = tcpTransport{}
+	}
+}
+
+// Validate checks the config with the defaults taken by its zero fields.
+func (c *Config) Validate() error {
+	d := *c
+	d.setDefaults()
+	switch {
+	case d.SuccListLen < 1:
+		return fmt.Errorf("successor list length %d should be positive", d.SuccListLen)
+	case d.TTL < 1:
+		return fmt.Errorf("TTL %d should be positive", d.TTL)
+	case d.StabilizeInterval <= 0 || d.FixFingerInterval <= 0 || d.FixPredInterval <= 0:
+		return fmt.Errorf("maintenance intervals should be positive")
+	case d.DialTimeout <= 0:
+		return fmt.Errorf("dial timeout %v should be positive", d.DialTimeout)
+	case d.Replication < 1 || d.Replication > d.SuccListLen:
+		return fmt.Errorf("replication %d should be in [1, %d]", d.Replication, d.SuccListLen)
+	case d.MaxKeySize < 1 || d.MaxValueSize < 1:
+		return fmt.Errorf("size limits should be positive")
+	case d.ChunkSize < 1 || d.ChunkSize > d.MaxValueSize:
+		return fmt.Errorf("chunk size %d should be in [1, %d]", d.ChunkSize, d.MaxValueSize)
+	case d.MaxKeys < 0 || d.MaxBytes < 0 || d.MaxBackupKeys < 0 || d.MaxBackupBytes < 0:
+		return fmt.Errorf("quotas should not be negative, zero is unlimited")
+	case d.ChunkGCInterval <= 0:
+		return fmt.Errorf("chunk gc interval %v should be positive", d.ChunkGCInterval)
+	}
+	return d.validateNamespaces()
+}
+
+// checkSize fails with ErrTooLarge if the pair is beyond the limits of c.
+func (c *Config) checkSize(key, value string) error {
+	if len(key) > c.MaxKeySize {
+		return fmt.Errorf("%w: key of %d bytes, limit %d", ErrTooLarge, len(key), c.MaxKeySize)
+	}
+	if len(value) > c.MaxValueSize {
+		return fmt.Errorf("%w: value of %d bytes, limit %d", ErrTooLarge, len(value), c.MaxValueSize)
+	}
+	return nil
+}
+
+type Option func(*Config)
+
+// WithConfig replaces the config set by the previous options, except the log options
+// WithLogLevel, WithLogOutput and WithJSONLog, which a Config cannot carry.
+func WithConfig(config Config) Option {
+	return func(c *Config) {
+		config.logLevel, config.logOutput, config.logFormatter = c.logLevel, c.logOutput, c.logFormatter
+		*c = config
+	}
+}
+
+func WithSuccListLen(length int) Option {
+	return func(c *Config) {
+		c.SuccListLen = length
+	}
+}
+
+func WithTTL(ttl int16) Option {
+	return func(c *Config) {
+		c.TTL = ttl
+	}
+}
+
+func WithIntervals(stabilize, fixFinger, fixPred time.Duration) Option {
+	return func(c *Config) {
+		c.StabilizeInterval = stabilize
+		c.FixFingerInterval = fixFinger
+		c.FixPredInterval = fixPred
+	}
+}
+
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.DialTimeout = timeout
+	}
+}
+
+func WithReplication(replication int) Option {
+	return func(c *Config) {
+		c.Replication = replication
+	}
+}
+
+func WithSizeLimits(maxKey, maxValue int) Option {
+	return func(c *Config) {
+		c.MaxKeySize = maxKey
+		c.MaxValueSize = maxValue
+	}
+}
+
+func WithChunkSize(size int) Option {
+	return func(c *Config) {
+		c.ChunkSize = size
+	}
+}
+
+func WithChunkGC(interval time.Duration) Option {
+	return func(c *Config) {
+		c.ChunkGCInterval = interval
+	}
+}
+
+// WithQuota limits the keys and bytes of the primary data of the node.
+func WithQuota(maxKeys, maxBytes int64) Option {
+	return func(c *Config) {
+		c.MaxKeys = maxKeys
+		c.MaxBytes = maxBytes
+	}
+}
+
+// WithBackupQuota sets the keys and bytes of all the backups of the node together over
+// which the node counts the backups it takes, see HealthInfo.BackupOverQuota.
+func WithBackupQuota(maxKeys, maxBytes int64) Option {
+	return func(c *Config) {
+		c.MaxBackupKeys = maxKeys
+		c.MaxBackupBytes = maxBytes
+	}
+}
+
+// WithNamespace sets the config of namespace name.
+func WithNamespace(name string, nc NamespaceConfig) Option {
+	return func(c *Config) {
+		if c.Namespaces == nil {
+			c.Namespaces = make(map[string]NamespaceConfig)
+		}
+		c.Namespaces[name] = nc
+	}
+}
+
+func WithStorage(newStorage func() Storage) Option {
+	return func(c *Config) {
+		c.NewStorage = newStorage
+	}
+}
+
+func WithTransport(t Transport) Option {
+	return func(c *Config) {
+		c.Transport = t
+	}
+}
+
+func WithSpanExporter(e SpanExporter) Option {
+	return func(c *Config) {
+		c.SpanExporter = e
+	}
+}
+
+// WithLogger makes the node log to l. The other log options are ignored if it is given.
+func WithLogger(l *logrus.Logger) Option {
+	return func(c *Config) {
+		c.Logger = l
+	}
+}
+
+// WithLogLevel, WithLogOutput and WithJSONLog give the node its own logger. By default
+// it logs to the standard logger of logrus.
+func WithLogLevel(level logrus.Level) Option {
+	return func(c *Config) {
+		c.logLevel = &level
+	}
+}
+
+func WithLogOutput(w io.Writer) Option {
+	return func(c *Config) {
+		c.logOutput = w
+	}
+}
+
+func WithJSONLog() Option {
+	return func(c *Config) {
+		c.logFormatter = &logrus.JSONFormatter{}
+	}
+}
+
+func (c *Config) newLogger() *logrus.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	if c.logLevel == nil && c.logOutput == nil && c.logFormatter == nil {
+		return logrus.StandardLogger()
+	}
+	l := logrus.New()
+	if c.logLevel != nil {
+		l.SetLevel(*c.logLevel)
+	}
+	if c.logOutput != nil {
+		l.SetOutput(c.logOutput)
+	}
+	if c.logFormatter != nil {
+		l.SetFormatter(c.logFormatter)
+	}
+	return l
+}
@@ -0,0 +1,285 @@
+package chord
+
+import (
+	"dht/internal"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A topic is owned by the owner of its key, topicKeyPrefix and the name. The subscribers
+// are kept under that key as a set whose members expire unless renewed, so they are
+// backed up and handed to the successor with the data like any key, and survive the
+// failure of the owner. A renewal only refreshes the expiry of the member, see
+// setValue.add, so the renewals leave no tombstones in the set. The subscriber looks up
+// the owner every watchRefresh, and moves when the topic has moved because of a join.
+// The owner queues the messages published to the topic for each subscriber until it
+// takes them with a long poll. The queues are not backed up: the
+// messages not yet taken when the owner fails are lost, and so are those published while
+// a subscriber looks for the new owner.
+const (
+	topicKeyPrefix = "\x00topic:"
+	// a subscriber renews its membership every subscribeLease/3
+	subscribeLease = 30 * time.Second
+	topicQueueLen  = 1024
+)
+
+// errNotSubscribed is returned by PollTopic when the subscriber is not in the set of the
+// topic, e.g. after its lease expired.
+var errNotSubscribed = errors.New("not subscribed")
+
+type Message struct {
+	Topic string
+	Data  string
+	// Seq increases with the messages of the owner
+	Seq uint64
+}
+
+// TopicKey is the key of the subscribers of topic, whose owner owns the topic.
+func TopicKey(topic string) string {
+	return topicKeyPrefix + topic
+}
+
+type topicQueue struct {
+	msgs []Message
+	wake chan struct{}
+}
+
+// chordTopics are the queues of the subscribers of the topics owned by the node.
+type chordTopics struct {
+	queues map[string]map[string]*topicQueue
+	lock   sync.Mutex
+	seq    versionClock
+}
+
+// queue returns the queue of subscriber id, created if there is none.
+func (t *chordTopics) queue(topic, id string) *topicQueue {
+	if t.queues == nil {
+		t.queues = make(map[string]map[string]*topicQueue)
+	}
+	if t.queues[topic] == nil {
+		t.queues[topic] = make(map[string]*topicQueue)
+	}
+	q := t.queues[topic][id]
+	if q == nil {
+		q = &topicQueue{wake: make(chan struct{}, 1)}
+		t.queues[topic][id] = q
+	}
+	return q
+}
+
+// publish queues msg for the subscribers, and drops the queues of the others. A full
+// queue loses its oldest message.
+func (t *chordTopics) publish(msg Message, subscribers []string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	msg.Seq = t.seq.next()
+	current := make(map[string]bool, len(subscribers))
+	for _, id := range subscribers {
+		current[id] = true
+		q := t.queue(msg.Topic, id)
+		if len(q.msgs) >= topicQueueLen {
+			q.msgs = q.msgs[1:]
+		}
+		q.msgs = append(q.msgs, msg)
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+	for id := range t.queues[msg.Topic] {
+		if !current[id] {
+			delete(t.queues[msg.Topic], id)
+		}
+	}
+}
+
+func (t *chordTopics) reset() {
+	t.lock.Lock()
+	t.queues = nil
+	t.lock.Unlock()
+}
+
+// subscribers returns the live subscribers of topic in the primary data.
+func (n *ChordNode) subscribers(topic string) []string {
+	stored, ok := n.data.Get(TopicKey(topic))
+	if !ok {
+		return nil
+	}
+	members, _ := SetMembers(stored)
+	return members
+}
+
+// Publish sends data to the subscribers of topic, and returns how many there are.
+func (n *ChordNode) Publish(topic, data string) (int, error) {
+	sp := n.startSpan("Publish", TraceContext{})
+	sp.set("chord.topic", topic)
+	var count int
+	err := n.toOwner(func() (err error) {
+		count, err = n.publishOnce(topic, data, sp.context())
+		return err
+	})
+	sp.finish(err)
+	return count, err
+}
+
+func (n *ChordNode) publishOnce(topic, data string, trace TraceContext) (int, error) {
+	targetAddr, err := n.lookup(TopicKey(topic), trace)
+	if err != nil {
+		n.logger.Error(n.Addr, " Publish: failed in FindSuccessor ", err)
+		return 0, err
+	}
+	var link chordLink
+	if err := link.Dial(targetAddr, &n.cfg); err != nil {
+		n.logger.Error(n.Addr, " Publish: failed to dial target ", err)
+		return 0, err
+	}
+	defer link.close()
+	return link.Publish(topic, data)
+}
+
+// Subscription receives the messages of a topic in Messages until it is closed.
+type Subscription struct {
+	Messages <-chan Message
+
+	messages chan Message
+	topic    string
+	id       string
+	lookup   func(id uint32) (string, error)
+	cfg      Config
+	link     chordLink
+	lock     sync.Mutex
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Subscribe subscribes to topic.
+func (n *ChordNode) Subscribe(topic string) (*Subscription, error) {
+	return newSubscription(n.cfg, n.findSuccessor, topic)
+}
+
+// NewSubscription is Subscribe for a program outside the ring, lookup finds the owner of
+// an id, e.g. Remote.LookupID.
+func NewSubscription(lookup func(id uint32) (string, error), topic string, opts ...Option) (*Subscription, error) {
+	return newSubscription(remoteConfig(opts), lookup, topic)
+}
+
+func newSubscription(cfg Config, lookup func(id uint32) (string, error), topic string) (*Subscription, error) {
+	s := &Subscription{
+		messages: make(chan Message, 256),
+		topic:    topic,
+		id:       newTag(),
+		lookup:   lookup,
+		cfg:      cfg,
+		done:     make(chan struct{}),
+	}
+	s.Messages = s.messages
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+// connect joins the set of subscribers at the owner of the topic.
+func (s *Subscription) connect() error {
+	owner, err := s.lookup(internal.Str_uint32_sha1(TopicKey(s.topic)))
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.done:
+		return errors.New("subscription closed")
+	default:
+	}
+	if err := s.link.Dial(owner, &s.cfg); err != nil {
+		return err
+	}
+	if err := s.renew(); err != nil {
+		s.link.rpcClient.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *Subscription) renew() error {
+	return s.link.UpdateSet(UpdateSetRequest{Key: TopicKey(s.topic), Add: []string{s.id}, TTL: subscribeLease})
+}
+
+func (s *Subscription) run() {
+	for s.receive() {
+		s.link.rpcClient.Close()
+		// the owner is gone, has lost the subscription or is not the owner any more
+		for connected := false; !connected; {
+			select {
+			case <-s.done:
+				return
+			case <-time.After(watchRefresh):
+			}
+			connected = s.connect() == nil
+		}
+	}
+}
+
+// receive polls the owner and renews the membership until it fails, and returns false
+// once s is closed.
+func (s *Subscription) receive() bool {
+	renewAt := time.Now().Add(subscribeLease / 3)
+	checkAt := time.Now().Add(watchRefresh)
+	for {
+		msgs, err := s.link.PollTopic(s.topic, s.id, time.Until(checkAt))
+		for _, msg := range msgs {
+			select {
+			case s.messages <- msg:
+			case <-s.done:
+				return false
+			}
+		}
+		if err == nil && time.Now().After(checkAt) {
+			var owner string
+			owner, err = s.lookup(internal.Str_uint32_sha1(TopicKey(s.topic)))
+			if err == nil && owner != s.link.remoteAddr {
+				err = errors.New("topic moved")
+			}
+			checkAt = time.Now().Add(watchRefresh)
+		}
+		if err == nil && time.Now().After(renewAt) {
+			err = s.renew()
+			renewAt = time.Now().Add(subscribeLease / 3)
+		}
+		if err != nil {
+			select {
+			case <-s.done:
+				return false
+			default:
+				return true
+			}
+		}
+	}
+}
+
+// Close leaves the set of subscribers. No message is sent to Messages after it returns.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.lock.Lock()
+		if s.link.isConnected() {
+			s.link.UpdateSet(UpdateSetRequest{Key: TopicKey(s.topic), Remove: []string{s.id}})
+			s.link.rpcClient.Close()
+		}
+		s.lock.Unlock()
+	})
+}
+
+// checkSubscriber fails unless id is a live subscriber of topic at the node.
+func (n *ChordNode) checkSubscriber(topic, id string) error {
+	for _, member := range n.subscribers(topic) {
+		if member == id {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s of %s", errNotSubscribed, id, topic)
+}
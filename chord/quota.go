@@ -0,0 +1,296 @@
+package chord
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+// The quotas of a node limit the keys and bytes of its primary data, and of all its
+// backups together. A write which would grow the primary data beyond them is rejected
+// with ErrNodeFull; deletes and writes which do not grow the data are always accepted,
+// and so is the data taken over from another node, which must not be lost. The backups
+// are written after the owner has accepted the write, or before it for a lock, so they
+// are never refused either: a backup beyond its quota is only counted, and told by Health
+// and the metrics. The usage is in Health and the metrics, so that nodes can be added
+// before the ring is full.
+
+// sizedStorage counts the bytes of the keys and values of a Storage, and the keys and
+// bytes of each namespace. It also keeps the set of the keys for which tracked is true,
+// those the node goes through periodically, so that these rounds and the stats take no
+// snapshot of the whole data, which the next write would have to copy.
+type sizedStorage struct {
+	s       Storage
+	tracked func(key, value string) bool
+	bytes   int64
+	ns      map[string]NamespaceStats
+	keys    map[string]struct{}
+	lock    sync.Mutex
+}
+
+// newSizedStorage wraps s, tracked may be nil to track no key.
+func newSizedStorage(s Storage, tracked func(key, value string) bool) *sizedStorage {
+	sized := &sizedStorage{s: s, tracked: tracked, ns: make(map[string]NamespaceStats), keys: make(map[string]struct{})}
+	for k, v := range snapshot(s) {
+		sized.add(k, v)
+	}
+	return sized
+}
+
+// pairSize does not count the version the owner keeps with a value, see withVersion.
+func pairSize(key, value string) int64 {
+	_, value = splitVersion(value)
+	return int64(len(key) + len(value))
+}
+
+// add counts the pair written, under lock.
+func (s *sizedStorage) add(key, value string) {
+	size := pairSize(key, value)
+	s.bytes += size
+	ns, _ := splitNamespace(key)
+	stats := s.ns[ns]
+	stats.Keys++
+	stats.Bytes += size
+	s.ns[ns] = stats
+	if s.tracked != nil && s.tracked(key, value) {
+		s.keys[key] = struct{}{}
+	}
+}
+
+// remove uncounts the pair deleted or overwritten, under lock.
+func (s *sizedStorage) remove(key, value string) {
+	size := pairSize(key, value)
+	s.bytes -= size
+	ns, _ := splitNamespace(key)
+	stats := s.ns[ns]
+	stats.Keys--
+	stats.Bytes -= size
+	if stats.Keys == 0 {
+		delete(s.ns, ns)
+	} else {
+		s.ns[ns] = stats
+	}
+	delete(s.keys, key)
+}
+
+func (s *sizedStorage) Get(key string) (string, bool) {
+	return s.s.Get(key)
+}
+
+func (s *sizedStorage) Put(key, value string) {
+	s.lock.Lock()
+	if old, ok := s.s.Get(key); ok {
+		s.remove(key, old)
+	}
+	s.s.Put(key, value)
+	s.add(key, value)
+	s.lock.Unlock()
+}
+
+func (s *sizedStorage) Delete(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old, ok := s.s.Get(key)
+	if ok {
+		s.remove(key, old)
+	}
+	return s.s.Delete(key)
+}
+
+func (s *sizedStorage) Len() int {
+	return s.s.Len()
+}
+
+func (s *sizedStorage) Copy() map[string]string {
+	return s.s.Copy()
+}
+
+func (s *sizedStorage) Snapshot() map[string]string {
+	return snapshot(s.s)
+}
+
+func (s *sizedStorage) Merge(data map[string]string) {
+	s.lock.Lock()
+	for k, v := range data {
+		if old, ok := s.s.Get(k); ok {
+			s.remove(k, old)
+		}
+		s.add(k, v)
+	}
+	s.s.Merge(data)
+	s.lock.Unlock()
+}
+
+func (s *sizedStorage) DeleteFunc(del func(key string) bool) {
+	s.lock.Lock()
+	deleted := make(map[string]bool)
+	for k, v := range snapshot(s.s) {
+		if del(k) {
+			deleted[k] = true
+			s.remove(k, v)
+		}
+	}
+	s.s.DeleteFunc(func(key string) bool { return deleted[key] })
+	s.lock.Unlock()
+}
+
+func (s *sizedStorage) Bytes() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.bytes
+}
+
+func (s *sizedStorage) NamespaceStats() map[string]NamespaceStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := make(map[string]NamespaceStats, len(s.ns))
+	for ns, st := range s.ns {
+		stats[ns] = st
+	}
+	return stats
+}
+
+// TrackedKeys returns the keys for which tracked is true.
+func (s *sizedStorage) TrackedKeys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := make([]string, 0, len(s.keys))
+	for k := range s.keys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// storageBytes returns the bytes of the keys and values in s.
+func storageBytes(s Storage) int64 {
+	if sized, ok := s.(interface{ Bytes() int64 }); ok {
+		return sized.Bytes()
+	}
+	var bytes int64
+	for k, v := range snapshot(s) {
+		bytes += pairSize(k, v)
+	}
+	return bytes
+}
+
+func (n *ChordNode) newStorage() Storage {
+	return newSizedStorage(n.cfg.NewStorage(), n.tracked)
+}
+
+// tracked tells whether the node goes through the key periodically: the keys with a TTL
+// in expireKeys, the chunks and the manifests in collectChunks.
+func (n *ChordNode) tracked(key, value string) bool {
+	if isChunkKey(key) || n.cfg.keyTTL(key) > 0 {
+		return true
+	}
+	_, value = splitVersion(value)
+	return strings.HasPrefix(value, manifestMagic)
+}
+
+// trackedPairs returns the pairs of s for which tracked is true, without a snapshot of s
+// if it is a sizedStorage.
+func (n *ChordNode) trackedPairs(s Storage) map[string]string {
+	sized, ok := s.(*sizedStorage)
+	if !ok {
+		pairs := make(map[string]string)
+		for k, v := range snapshot(s) {
+			if n.tracked(k, v) {
+				pairs[k] = v
+			}
+		}
+		return pairs
+	}
+	keys := sized.TrackedKeys()
+	pairs := make(map[string]string, len(keys))
+	for _, k := range keys {
+		if v, ok := sized.Get(k); ok {
+			pairs[k] = v
+		}
+	}
+	return pairs
+}
+
+// usage returns the keys and bytes of the primary data, or with backup of all the
+// backups.
+func (n *ChordNode) usage(backup bool) (keys, bytes int64) {
+	if !backup {
+		return int64(n.data.Len()), storageBytes(n.data)
+	}
+	n.backupDataLock.RLock()
+	defer n.backupDataLock.RUnlock()
+	for _, s := range n.backupData {
+		keys += int64(s.Len())
+		bytes += storageBytes(s)
+	}
+	return keys, bytes
+}
+
+// checkRoom fails with ErrNodeFull if writing pairs into the primary data would take the
+// node beyond its quota. It is called under writeLock with the write, so that the writes
+// checked one after another do not overshoot the quota together, except by Lease, which
+// writes under leaseLock after the backup and may overshoot it by a lock.
+func (n *ChordNode) checkRoom(pairs map[string]string) error {
+	if keys, bytes, over := n.overQuota(n.data, false, pairs); over {
+		n.metrics.rejectedFull.Add(1)
+		return fmt.Errorf("%w: primary data of %d keys and %d bytes at %s", ErrNodeFull, keys, bytes, n.Addr)
+	}
+	return nil
+}
+
+// noteBackupRoom counts a write of pairs into backup which takes the backups beyond their
+// quota. The write is done all the same.
+func (n *ChordNode) noteBackupRoom(backup Storage, pairs map[string]string) {
+	if keys, bytes, over := n.overQuota(backup, true, pairs); over {
+		n.metrics.overBackupQuota.Add(1)
+		n.logger.Warn(n.Addr, " backup of ", keys, " keys and ", bytes, " bytes beyond the quota")
+	}
+}
+
+// overQuota tells whether writing pairs into s, the primary data or a level of backup,
+// would take it beyond its quota, with the keys and bytes in use.
+func (n *ChordNode) overQuota(s Storage, backup bool, pairs map[string]string) (keys, bytes int64, over bool) {
+	maxKeys, maxBytes := n.cfg.MaxKeys, n.cfg.MaxBytes
+	if backup {
+		maxKeys, maxBytes = n.cfg.MaxBackupKeys, n.cfg.MaxBackupBytes
+	}
+	if maxKeys == 0 && maxBytes == 0 {
+		return 0, 0, false
+	}
+	var addKeys, addBytes int64
+	for k, v := range pairs {
+		if old, ok := s.Get(k); ok {
+			addBytes += pairSize(k, v) - pairSize(k, old)
+		} else {
+			addKeys++
+			addBytes += pairSize(k, v)
+		}
+	}
+	keys, bytes = n.usage(backup)
+	over = (addKeys > 0 && maxKeys > 0 && keys+addKeys > maxKeys) || (addBytes > 0 && maxBytes > 0 && bytes+addBytes > maxBytes)
+	return keys, bytes, over
+}
+
+// quotaUsage is the largest fraction of a quota in use, zero without quotas.
+func (n *ChordNode) quotaUsage() float64 {
+	return math.Max(n.quotaRatio(false), n.quotaRatio(true))
+}
+
+// quotaRatio is the largest fraction of the quota of the primary data, or with backup of
+// the backups, in use.
+func (n *ChordNode) quotaRatio(backup bool) float64 {
+	maxKeys, maxBytes := n.cfg.MaxKeys, n.cfg.MaxBytes
+	if backup {
+		maxKeys, maxBytes = n.cfg.MaxBackupKeys, n.cfg.MaxBackupBytes
+	}
+	var usage float64
+	ratio := func(used, limit int64) {
+		if limit > 0 && float64(used)/float64(limit) > usage {
+			usage = float64(used) / float64(limit)
+		}
+	}
+	keys, bytes := n.usage(backup)
+	ratio(keys, maxKeys)
+	ratio(bytes, maxBytes)
+	return usage
+}
@@ -0,0 +1,161 @@
+package chord
+
+import (
+	"dht/internal"
+	"time"
+)
+
+// Remote calls the RPC methods of a running node from outside the ring, e.g. in dhtctl.
+// It may be used by several goroutines at once.
+// Put, Get and Delete act on the data of that very node, use Lookup first to find the
+// owner of a key.
+type Remote struct {
+	cfg  Config
+	link chordLink
+}
+
+func DialRemote(addr string, opts ...Option) (*Remote, error) {
+	r := &Remote{cfg: remoteConfig(opts)}
+	if err := r.link.Dial(addr, &r.cfg); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// remoteConfig is the config of the programs outside the ring, of which only the dial
+// options matter.
+func remoteConfig(opts []Option) Config {
+	var c Config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	c.setDefaults()
+	return c
+}
+
+func (r *Remote) Addr() string {
+	return r.link.remoteAddr
+}
+
+// Close may be called while other goroutines use r, whose calls then fail.
+func (r *Remote) Close() {
+	r.link.rpcClient.Close()
+}
+
+// Lookup returns the owner of key and the nodes the request passed through.
+func (r *Remote) Lookup(key string) (string, []string, error) {
+	var reply FindSuccessorReply
+	err := r.link.FindSuccessor(internal.Str_uint32_sha1(key), r.cfg.TTL, TraceContext{}, &reply)
+	return reply.Addr, reply.Path, err
+}
+
+// LookupID returns the owner of id, e.g. for NewWatcher.
+func (r *Remote) LookupID(id uint32) (string, error) {
+	var reply FindSuccessorReply
+	err := r.link.FindSuccessor(id, r.cfg.TTL, TraceContext{}, &reply)
+	return reply.Addr, err
+}
+
+func (r *Remote) Get(key string) (string, error) {
+	return r.link.GetDataByKey(key, TraceContext{})
+}
+
+// Put writes the pair into the primary data of the node, which backs it up to its successors.
+func (r *Remote) Put(key, value string) error {
+	return r.PutIf(key, value, Precondition{})
+}
+
+func (r *Remote) PutIf(key, value string, cond Precondition) error {
+	_, err := r.Store(key, value, cond)
+	return err
+}
+
+// Store is PutIf which returns the ETag the node has given to the key.
+func (r *Remote) Store(key, value string, cond Precondition) (string, error) {
+	return r.link.SendPutData(PutDataRequest{Key: key, Value: value, Cond: cond})
+}
+
+func (r *Remote) Delete(key string) error {
+	return r.DeleteIf(key, Precondition{})
+}
+
+func (r *Remote) DeleteIf(key string, cond Precondition) error {
+	return r.link.DeleteDataIf(key, cond, false, 0, TraceContext{})
+}
+
+// UpdateSet adds and removes members of the set under key, see ChordNode.AddToSet.
+func (r *Remote) UpdateSet(key string, add, remove []string, ttl time.Duration) error {
+	return r.link.UpdateSet(UpdateSetRequest{Key: key, Add: add, Remove: remove, TTL: ttl})
+}
+
+// Publish sends a message to the subscribers of topic. It fails with ErrNotOwner unless the
+// node owns the topic.
+func (r *Remote) Publish(topic, data string) (int, error) {
+	return r.link.Publish(topic, data)
+}
+
+// Increment adds delta to the counter under key, see ChordNode.Increment.
+func (r *Remote) Increment(key string, delta int64) (int64, error) {
+	return r.link.Increment(IncrementRequest{Key: key, Delta: delta})
+}
+
+// Acquire, Renew and Release are those of ChordNode, if the node is the owner of the lock.
+func (r *Remote) Acquire(name string, ttl time.Duration) (*Lease, error) {
+	return acquireLease(name, ttl, r.link.Lease)
+}
+
+func (r *Remote) Renew(lease *Lease, ttl time.Duration) error {
+	return renewLease(lease, ttl, r.link.Lease)
+}
+
+func (r *Remote) Release(lease *Lease) error {
+	return releaseLease(lease, r.link.Lease)
+}
+
+// PutBatch writes the pairs into the primary data of the node as they are, like PutStored.
+func (r *Remote) PutBatch(pairs map[string]string) error {
+	_, err := r.link.PutDataBatch(pairs, false, 0, TraceContext{})
+	return err
+}
+
+// RestoreBatch puts back pairs saved as the nodes keep them into the primary data of the
+// node, like ChordNode.RestoreStored, leaving the keys with newer values as they are.
+func (r *Remote) RestoreBatch(pairs map[string]string) error {
+	_, err := r.link.SendPutDataBatch(PutDataBatchRequest{Pairs: pairs, Restore: true})
+	return err
+}
+
+// Export returns a page of the primary data of the node, see ExportRing.
+func (r *Remote) Export(request ExportRequest) (ExportReply, error) {
+	var reply ExportReply
+	err := r.link.ExportData(request, &reply)
+	return reply, err
+}
+
+// Predecessor returns the address of the predecessor of the node, the keys between which
+// and the node are owned by the node.
+func (r *Remote) Predecessor() (string, error) {
+	var addr string
+	err := r.link.GetPredecessor(&addr)
+	return addr, err
+}
+
+// Data returns the primary data of the node.
+func (r *Remote) Data() (map[string]string, error) {
+	var data map[string]string
+	err := r.link.GetAllData(&data)
+	return data, err
+}
+
+func (r *Remote) Stats() (NodeStatsReply, error) {
+	var reply NodeStatsReply
+	err := r.link.GetStats(&reply)
+	return reply, err
+}
+
+// Inspect returns the state of the node with the numbers of its keys, see NodeState.
+func (r *Remote) Inspect() (NodeState, error) {
+	var state NodeState
+	err := r.link.Inspect(&state)
+	return state, err
+}
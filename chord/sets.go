@@ -0,0 +1,274 @@
+package chord
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A set is kept under its key as an observed-remove set. The add of a member not in the
+// set gets a unique tag, and a remove drops the tags of the member seen by the owner, so
+// that when two versions of a set meet in a merge, e.g. the data of a quitting node and
+// the backup already promoted by its successor, a member added in either and not removed
+// after that add is kept: adds win over concurrent removes. Adding a member again only
+// refreshes its tag, so such an add loses to a concurrent remove.
+const (
+	setMagic = reservedPrefix + "set\n"
+	// the tags of removed adds are kept this long, for the merges with older versions
+	setTombstoneTTL = time.Hour
+)
+
+// setValue is gob encoded, so that the members may be any bytes.
+type setValue struct {
+	// Adds[member][tag] is the expiry of an add in unix nanoseconds, zero for none
+	Adds map[string]map[string]int64
+	// Removed are the tags of the removed adds, with the time of removal
+	Removed map[string]int64
+}
+
+func newSetValue() *setValue {
+	return &setValue{Adds: make(map[string]map[string]int64), Removed: make(map[string]int64)}
+}
+
+func parseSet(stored string) (*setValue, bool) {
+	if !strings.HasPrefix(stored, setMagic) {
+		return nil, false
+	}
+	s := newSetValue()
+	if err := gob.NewDecoder(strings.NewReader(stored[len(setMagic):])).Decode(s); err != nil {
+		return nil, false
+	}
+	if s.Adds == nil {
+		s.Adds = make(map[string]map[string]int64)
+	}
+	if s.Removed == nil {
+		s.Removed = make(map[string]int64)
+	}
+	return s, true
+}
+
+func (s *setValue) encode() string {
+	var b bytes.Buffer
+	b.WriteString(setMagic)
+	gob.NewEncoder(&b).Encode(s)
+	return b.String()
+}
+
+func newTag() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// add adds members, which expire at expire. A member already in the set keeps one of its
+// tags with the new expiry, so that adding it again, as the renewals of the subscribers
+// do, leaves no tombstone. Only when the new expiry is earlier does the member get a new
+// tag, since merge keeps the later expiry of a tag.
+func (s *setValue) add(members []string, expire, now int64) {
+	for _, m := range members {
+		keep := ""
+		for tag, old := range s.Adds[m] {
+			if !outlives(old, expire) && (keep == "" || tag < keep) {
+				keep = tag
+			}
+		}
+		if keep == "" {
+			s.remove([]string{m}, now)
+			s.Adds[m] = map[string]int64{newTag(): expire}
+			continue
+		}
+		for tag := range s.Adds[m] {
+			if tag != keep {
+				s.Removed[tag] = now
+				delete(s.Adds[m], tag)
+			}
+		}
+		s.Adds[m][keep] = expire
+	}
+}
+
+// outlives tells whether an add expiring at a is dropped after one expiring at b, zero
+// being never.
+func outlives(a, b int64) bool {
+	return b != 0 && (a == 0 || a > b)
+}
+
+func (s *setValue) remove(members []string, now int64) {
+	for _, m := range members {
+		for tag := range s.Adds[m] {
+			s.Removed[tag] = now
+		}
+		delete(s.Adds, m)
+	}
+}
+
+// merge adds the adds and removes of o to s, with the later expiry of the tags in both.
+func (s *setValue) merge(o *setValue) {
+	for tag, t := range o.Removed {
+		if t > s.Removed[tag] {
+			s.Removed[tag] = t
+		}
+	}
+	for m, tags := range o.Adds {
+		for tag, expire := range tags {
+			if s.Adds[m] == nil {
+				s.Adds[m] = make(map[string]int64)
+			}
+			if cur, ok := s.Adds[m][tag]; !ok || outlives(expire, cur) {
+				s.Adds[m][tag] = expire
+			}
+		}
+	}
+	for m, tags := range s.Adds {
+		for tag := range tags {
+			if _, ok := s.Removed[tag]; ok {
+				delete(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			delete(s.Adds, m)
+		}
+	}
+}
+
+// prune drops the expired adds and the old tombstones.
+func (s *setValue) prune(now int64) {
+	for m, tags := range s.Adds {
+		for tag, expire := range tags {
+			if expire != 0 && expire <= now {
+				delete(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			delete(s.Adds, m)
+		}
+	}
+	for tag, t := range s.Removed {
+		if now-t > int64(setTombstoneTTL) {
+			delete(s.Removed, tag)
+		}
+	}
+}
+
+func (s *setValue) members(now int64) []string {
+	members := make([]string, 0, len(s.Adds))
+	for m, tags := range s.Adds {
+		for _, expire := range tags {
+			if expire == 0 || expire > now {
+				members = append(members, m)
+				break
+			}
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// SetMembers returns the members of the set stored as stored, or ErrWrongType if it is
+// not a set.
+func SetMembers(stored string) ([]string, error) {
+	s, ok := parseSet(stored)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return s.members(time.Now().UnixNano()), nil
+}
+
+// mergeData merges data into s like Storage.Merge, but merges the sets and the counters
+// in both instead of replacing them.
+func mergeData(s Storage, data map[string]string) {
+	merged := make(map[string]string, len(data))
+	for k, v := range data {
+		merged[k] = v
+		if old, ok := s.Get(k); ok {
+			merged[k] = mergeValue(old, v)
+		}
+	}
+	s.Merge(merged)
+}
+
+// mergeValue returns the value kept when v comes in for a key with the value old: the
+// merge of both if they are sets or counters, or else v.
+func mergeValue(old, v string) string {
+	if incoming, ok := parseSet(v); ok {
+		if set, ok := parseSet(old); ok {
+			set.merge(incoming)
+			return set.encode()
+		}
+	} else if incoming, ok := parseCounter(v); ok {
+		if counter, ok := parseCounter(old); ok {
+			counter.merge(incoming)
+			return counter.encode()
+		}
+	}
+	return v
+}
+
+// mergePrimary merges the data taken over from another node into the primary data.
+func (n *ChordNode) mergePrimary(data map[string]string) {
+	n.writeLock.Lock()
+	mergeData(n.data, data)
+	n.writeLock.Unlock()
+}
+
+// AddToSet adds members to the set under key, which is created if there is no such key.
+// With a positive ttl the members are dropped after it, unless they are added again.
+// It fails with ErrWrongType if the key has a plain value.
+func (n *ChordNode) AddToSet(key string, ttl time.Duration, members ...string) error {
+	return n.updateSet("AddToSet", UpdateSetRequest{Key: key, Add: members, TTL: ttl})
+}
+
+// RemoveFromSet removes members from the set under key.
+func (n *ChordNode) RemoveFromSet(key string, members ...string) error {
+	return n.updateSet("RemoveFromSet", UpdateSetRequest{Key: key, Remove: members})
+}
+
+func (n *ChordNode) updateSet(name string, request UpdateSetRequest) error {
+	if err := CheckKey(request.Key); err != nil {
+		return err
+	}
+	sp := n.startSpan(name, TraceContext{})
+	sp.set("dht.key", request.Key)
+	request.Trace = sp.context()
+	err := n.toOwner(func() error {
+		return n.sendUpdateSet(request)
+	})
+	sp.finish(err)
+	return err
+}
+
+func (n *ChordNode) sendUpdateSet(request UpdateSetRequest) error {
+	targetAddr, err := n.lookup(request.Key, request.Trace)
+	if err != nil {
+		n.logger.Error(n.Addr, " UpdateSet: failed in FindSuccessor ", err)
+		return err
+	}
+	var link chordLink
+	if err := link.Dial(targetAddr, &n.cfg); err != nil {
+		n.logger.Error(n.Addr, " UpdateSet: failed to dial target ", err)
+		return err
+	}
+	defer link.close()
+	if err := link.UpdateSet(request); err != nil {
+		n.logger.Error(n.Addr, " UpdateSet: failed to update set ", err)
+		return err
+	}
+	return nil
+}
+
+// GetSet returns the members of the set under key in order.
+func (n *ChordNode) GetSet(key string) ([]string, error) {
+	sp := n.startSpan("GetSet", TraceContext{})
+	sp.set("dht.key", key)
+	stored, err := n.get(key, sp.context())
+	var members []string
+	if err == nil {
+		members, err = SetMembers(stored)
+	}
+	sp.finish(err)
+	return members, err
+}
@@ -0,0 +1,207 @@
+package chord
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Storage keeps key-value pairs of a node. A node uses one for its primary data and one
+// for each level of backup, and all methods may be called concurrently.
+type Storage interface {
+	Get(key string) (string, bool)
+	Put(key, value string)
+	// Delete returns whether the key existed
+	Delete(key string) bool
+	Len() int
+	// Copy returns all pairs in a map owned by the caller
+	Copy() map[string]string
+	Merge(data map[string]string)
+	// DeleteFunc deletes the keys for which del returns true
+	DeleteFunc(del func(key string) bool)
+}
+
+// Snapshotter is a Storage which can give a point-in-time view of its pairs without
+// copying them, so that a node can send its data to another while it is being written.
+type Snapshotter interface {
+	// Snapshot returns all pairs in a map which is never modified afterwards, and must not
+	// be modified by the caller
+	Snapshot() map[string]string
+}
+
+// snapshot returns the pairs of s at one point in time, read only. It falls back to Copy
+// for the Storage which is not a Snapshotter.
+func snapshot(s Storage) map[string]string {
+	if ss, ok := s.(Snapshotter); ok {
+		return ss.Snapshot()
+	}
+	return s.Copy()
+}
+
+// scanTTL is how long a node keeps a scan which is not paged through any more
+const scanTTL = time.Minute
+
+// keyScan is a snapshot with its keys in order, which a client pages through, so that
+// listing many keys costs the node one snapshot and one sort rather than one per page.
+type keyScan struct {
+	data map[string]string
+	keys []string
+	used time.Time
+}
+
+// page returns up to limit keys after the key after, and whether there are more.
+func (sc *keyScan) page(after string, limit int) ([]string, bool) {
+	i := sort.SearchStrings(sc.keys, after)
+	if i < len(sc.keys) && sc.keys[i] == after {
+		i++
+	}
+	keys := sc.keys[i:]
+	if limit > 0 && len(keys) > limit {
+		return keys[:limit], true
+	}
+	return keys, false
+}
+
+// keyScans are the scans open on a node by their id.
+type keyScans struct {
+	open map[uint64]*keyScan
+	last uint64
+	lock sync.Mutex
+}
+
+// start opens a scan of s, and closes the scans not used for scanTTL.
+func (ss *keyScans) start(s Storage) (uint64, *keyScan) {
+	sc := &keyScan{data: snapshot(s), used: time.Now()}
+	sc.keys = make([]string, 0, len(sc.data))
+	for k := range sc.data {
+		sc.keys = append(sc.keys, k)
+	}
+	sort.Strings(sc.keys)
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if ss.open == nil {
+		ss.open = make(map[uint64]*keyScan)
+	}
+	for id, old := range ss.open {
+		if sc.used.Sub(old.used) > scanTTL {
+			delete(ss.open, id)
+		}
+	}
+	ss.last++
+	ss.open[ss.last] = sc
+	return ss.last, sc
+}
+
+func (ss *keyScans) get(id uint64) (*keyScan, error) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	sc, ok := ss.open[id]
+	if !ok {
+		return nil, fmt.Errorf("scan %d expired", id)
+	}
+	sc.used = time.Now()
+	return sc, nil
+}
+
+func (ss *keyScans) close(id uint64) {
+	ss.lock.Lock()
+	delete(ss.open, id)
+	ss.lock.Unlock()
+}
+
+// memStorage is the default Storage, a map guarded by a lock. A snapshot shares the map,
+// which the next write copies before changing it, so that taking a snapshot costs nothing
+// and the writers never wait for a reader of the snapshot.
+type memStorage struct {
+	data map[string]string
+	// shared is set while data is held by a snapshot
+	shared bool
+	lock   sync.RWMutex
+}
+
+func NewMemStorage() Storage {
+	return &memStorage{data: make(map[string]string)}
+}
+
+func (s *memStorage) Get(key string) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	value, ok := s.data[key]
+	return value, ok
+}
+
+// own copies the map if a snapshot shares it, under the write lock.
+func (s *memStorage) own() {
+	if !s.shared {
+		return
+	}
+	data := make(map[string]string, len(s.data))
+	for k, v := range s.data {
+		data[k] = v
+	}
+	s.data, s.shared = data, false
+}
+
+func (s *memStorage) Put(key, value string) {
+	s.lock.Lock()
+	s.own()
+	s.data[key] = value
+	s.lock.Unlock()
+}
+
+func (s *memStorage) Delete(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.data[key]
+	if ok {
+		s.own()
+		delete(s.data, key)
+	}
+	return ok
+}
+
+func (s *memStorage) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.data)
+}
+
+func (s *memStorage) Copy() map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	data := make(map[string]string, len(s.data))
+	for k, v := range s.data {
+		data[k] = v
+	}
+	return data
+}
+
+func (s *memStorage) Snapshot() map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.shared = true
+	return s.data
+}
+
+func (s *memStorage) Merge(data map[string]string) {
+	s.lock.Lock()
+	if len(data) > 0 {
+		s.own()
+	}
+	for k, v := range data {
+		s.data[k] = v
+	}
+	s.lock.Unlock()
+}
+
+func (s *memStorage) DeleteFunc(del func(key string) bool) {
+	s.lock.Lock()
+	for k := range s.data {
+		if del(k) {
+			s.own()
+			delete(s.data, k)
+		}
+	}
+	s.lock.Unlock()
+}
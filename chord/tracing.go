@@ -0,0 +1,335 @@
+package chord
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// TraceContext is carried in the RPC requests so that the spans of the nodes a request
+// passes through belong to the same trace. A zero TraceID means the request is not traced.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+func (t TraceContext) IsValid() bool {
+	return t.TraceID != [16]byte{}
+}
+
+// Span is one traced step, e.g. one hop of FindSuccessor or one replica write.
+type Span struct {
+	TraceID  string            `json:"traceId"`
+	SpanID   string            `json:"spanId"`
+	ParentID string            `json:"parentSpanId,omitempty"`
+	Name     string            `json:"name"`
+	Node     string            `json:"node"`
+	Start    time.Time         `json:"start"`
+	End      time.Time         `json:"end"`
+	Attrs    map[string]string `json:"attributes,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// SpanExporter receives the finished spans of a node.
+type SpanExporter interface {
+	ExportSpan(span Span)
+	Close() error
+}
+
+type span struct {
+	n      *ChordNode
+	ctx    TraceContext
+	parent TraceContext
+	name   string
+	start  time.Time
+	attrs  map[string]string
+	err    error
+}
+
+// startSpan starts a span as a child of parent, or as the root of a new trace if parent
+// is not valid. Without an exporter spans only pass the context of parent on.
+func (n *ChordNode) startSpan(name string, parent TraceContext) *span {
+	s := &span{n: n, parent: parent, name: name}
+	if n.cfg.SpanExporter == nil {
+		s.ctx = parent
+		return s
+	}
+	s.start = time.Now()
+	s.ctx.TraceID = parent.TraceID
+	if !parent.IsValid() {
+		binary.BigEndian.PutUint64(s.ctx.TraceID[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(s.ctx.TraceID[8:], rand.Uint64())
+	}
+	binary.BigEndian.PutUint64(s.ctx.SpanID[:], rand.Uint64())
+	return s
+}
+
+func (s *span) context() TraceContext {
+	return s.ctx
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s.n.cfg.SpanExporter == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[key] = attrValue(value)
+}
+
+// attrValue is value as a span attribute. Since a key may be any bytes, which JSON would
+// mangle, a value which is not valid UTF-8 is escaped like a Go string literal.
+func attrValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if utf8.ValidString(s) {
+		return s
+	}
+	quoted := strconv.Quote(s)
+	return quoted[1 : len(quoted)-1]
+}
+
+// finish records err, if any, and exports the span.
+func (s *span) finish(err error) {
+	if s.n.cfg.SpanExporter == nil {
+		return
+	}
+	exported := Span{
+		TraceID: hex.EncodeToString(s.ctx.TraceID[:]),
+		SpanID:  hex.EncodeToString(s.ctx.SpanID[:]),
+		Name:    s.name,
+		Node:    s.n.Addr,
+		Start:   s.start,
+		End:     time.Now(),
+		Attrs:   s.attrs,
+	}
+	if s.parent.IsValid() {
+		exported.ParentID = hex.EncodeToString(s.parent.SpanID[:])
+	}
+	if err != nil {
+		exported.Error = err.Error()
+	}
+	s.n.cfg.SpanExporter.ExportSpan(exported)
+}
+
+// FileExporter writes the spans to a file as JSON lines.
+type FileExporter struct {
+	file *os.File
+	w    *bufio.Writer
+	lock sync.Mutex
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (e *FileExporter) ExportSpan(span Span) {
+	line, _ := json.Marshal(span)
+	e.lock.Lock()
+	e.w.Write(line)
+	e.w.WriteByte('\n')
+	e.lock.Unlock()
+}
+
+func (e *FileExporter) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if err := e.w.Flush(); err != nil {
+		return err
+	}
+	return e.file.Close()
+}
+
+// OTLPExporter posts the spans in batches to a collector speaking OTLP/HTTP with JSON
+// encoding, e.g. http://localhost:4318/v1/traces.
+type OTLPExporter struct {
+	endpoint  string
+	service   string
+	client    *http.Client
+	batchSize int
+
+	spans chan Span
+	// closing is closed by Close, after which the spans are dropped, and done by run once
+	// the spans queued before are posted
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+
+	// err is the last failure of posting a batch
+	err     error
+	errLock sync.Mutex
+}
+
+func NewOTLPExporter(endpoint, service string) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint:  endpoint,
+		service:   service,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		batchSize: 256,
+		spans:     make(chan Span, 4096),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// ExportSpan drops the span if the queue is full rather than blocking the node, or if the
+// exporter is closed.
+func (e *OTLPExporter) ExportSpan(span Span) {
+	select {
+	case <-e.closing:
+		return
+	default:
+	}
+	select {
+	case e.spans <- span:
+	default:
+	}
+}
+
+// Close posts the spans queued so far, and returns the last error of posting a batch.
+func (e *OTLPExporter) Close() error {
+	e.closeOnce.Do(func() { close(e.closing) })
+	<-e.done
+	return e.lastErr()
+}
+
+func (e *OTLPExporter) lastErr() error {
+	e.errLock.Lock()
+	defer e.errLock.Unlock()
+	return e.err
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var batch []Span
+	flush := func() {
+		if err := e.post(batch); err != nil {
+			e.errLock.Lock()
+			e.err = err
+			e.errLock.Unlock()
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) >= e.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.closing:
+			for {
+				select {
+				case span := <-e.spans:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttrs(attrs map[string]string) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		kv := otlpKeyValue{Key: k}
+		kv.Value.StringValue = v
+		kvs = append(kvs, kv)
+	}
+	return kvs
+}
+
+// post sends batch to the collector, and fails if it does not accept it.
+func (e *OTLPExporter) post(batch []Span) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	type otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	type otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes"`
+		Status            otlpStatus     `json:"status"`
+	}
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		attrs := map[string]string{"dht.node": s.Node}
+		for k, v := range s.Attrs {
+			attrs[k] = v
+		}
+		spans[i] = otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              2, // server
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttrs(attrs),
+		}
+		if s.Error != "" {
+			spans[i].Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttrs(map[string]string{"service.name": e.service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "dht/chord"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("post %d spans: %w", len(batch), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("post %d spans: %s", len(batch), resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,425 @@
+package chord
+
+import (
+	"dht/internal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A watch follows the changes of a key, or of the keys whose ids are in a range, without
+// polling Get. The subscriber registers at the owners of the keys, which queue the events
+// of their primary writes until the subscriber takes them with a long poll. The owners
+// are looked up again every watchRefresh and after a failed poll, so the registrations
+// follow the keys when a node joins, quits or fails. The events between the move of the
+// keys and the new registration are missed, which is told by an EventLost.
+const (
+	// a registration is dropped when it is not polled for watchLease
+	watchLease    = 30 * time.Second
+	watchPollWait = 10 * time.Second
+	watchQueueLen = 1024
+	watchRefresh  = time.Second
+)
+
+type EventOp string
+
+const (
+	EventPut    EventOp = "put"
+	EventDelete EventOp = "delete"
+	// EventLost tells that events of the keys at Owner may have been missed, because the
+	// queue there was full or the watch had to register again
+	EventLost EventOp = "lost"
+)
+
+type Event struct {
+	Op  EventOp
+	Key string
+	// Value is the new value of a put, empty for a chunked value or a set
+	Value string
+	// Version is that of the ETag of the key, which the backups keep with the value, so
+	// it increases across owners; that of a delete is after the one of the value deleted.
+	// The sets, the counters and the locks have no version of their own, theirs increase
+	// with the writes of the owner, and across owners as long as their clocks are about
+	// in sync.
+	Version uint64
+	Owner   string
+	// Err is why the owners could not be found, for the EventLost sent when a lookup
+	// fails after one which succeeded
+	Err string
+}
+
+// watchFilter matches Key, or with Range the keys with ids in (From, To], the whole ring
+// if From is To.
+type watchFilter struct {
+	Key      string
+	Range    bool
+	From, To uint32
+}
+
+func (f watchFilter) matches(key string) bool {
+	if !f.Range {
+		return key == f.Key
+	}
+	return inRange(f.From+1, f.To+1, internal.Str_uint32_sha1(key))
+}
+
+type watchSub struct {
+	filter watchFilter
+	events []Event
+	lost   bool
+	expire time.Time
+	wake   chan struct{}
+}
+
+// chordWatches are the registrations at the node as an owner.
+type chordWatches struct {
+	subs    map[string]*watchSub
+	lock    sync.Mutex
+	version versionClock
+}
+
+// versionClock gives versions from the clock, which still increase when it goes back.
+type versionClock struct {
+	last atomic.Uint64
+}
+
+func (c *versionClock) next() uint64 {
+	for {
+		last := c.last.Load()
+		v := uint64(time.Now().UnixNano())
+		if v <= last {
+			v = last + 1
+		}
+		if c.last.CompareAndSwap(last, v) {
+			return v
+		}
+	}
+}
+
+func (w *chordWatches) register(id string, filter watchFilter) {
+	w.lock.Lock()
+	if w.subs == nil {
+		w.subs = make(map[string]*watchSub)
+	}
+	w.subs[id] = &watchSub{filter: filter, expire: time.Now().Add(watchLease), wake: make(chan struct{}, 1)}
+	w.lock.Unlock()
+}
+
+func (w *chordWatches) cancel(id string) {
+	w.lock.Lock()
+	if sub, ok := w.subs[id]; ok {
+		delete(w.subs, id)
+		close(sub.wake)
+	}
+	w.lock.Unlock()
+}
+
+func (w *chordWatches) reset() {
+	w.lock.Lock()
+	for _, sub := range w.subs {
+		close(sub.wake)
+	}
+	w.subs = nil
+	w.lock.Unlock()
+}
+
+// notifyWatches queues the event of a write to the primary data, stored being the value
+// written by a put, or the value deleted by a delete. It is called under writeLock, so
+// that the versions follow the order of the writes.
+func (n *ChordNode) notifyWatches(op EventOp, key, stored string) {
+	if isChunkKey(key) {
+		return
+	}
+	w := &n.watches
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.subs) == 0 {
+		return
+	}
+	ev := Event{Op: op, Key: key, Owner: n.Addr}
+	version, value := splitVersion(stored)
+	switch {
+	case version == 0:
+		ev.Version = w.version.next()
+	case op == EventDelete:
+		ev.Version = nextVersion(stored)
+	default:
+		ev.Version = version
+	}
+	if op == EventPut && !strings.HasPrefix(value, reservedPrefix) {
+		ev.Value = value
+	}
+	now := time.Now()
+	for id, sub := range w.subs {
+		if now.After(sub.expire) {
+			delete(w.subs, id)
+			close(sub.wake)
+			continue
+		}
+		if !sub.filter.matches(key) {
+			continue
+		}
+		if len(sub.events) >= watchQueueLen {
+			sub.lost = true
+			continue
+		}
+		sub.events = append(sub.events, ev)
+		select {
+		case sub.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Watcher receives the events of a watch in Events until it is closed, which closes
+// Events.
+type Watcher struct {
+	Events <-chan Event
+
+	events  chan Event
+	filter  watchFilter
+	lookup  func(id uint32) (string, error)
+	cfg     Config
+	pollers map[string]*watchPoller
+	lock    sync.Mutex
+	// polls are the poll goroutines, Events is closed once they have returned
+	polls sync.WaitGroup
+	// err is that of the last refresh, under lock
+	err  error
+	kick chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// watchPoller is the registration at one owner.
+type watchPoller struct {
+	id   string
+	link chordLink
+	// resync sends an EventLost first, for a registration made after the first ones
+	resync bool
+}
+
+// Watch follows the changes of key.
+func (n *ChordNode) Watch(key string) (*Watcher, error) {
+	return newWatcher(n.cfg, n.findSuccessor, watchFilter{Key: key})
+}
+
+// WatchRange follows the changes of the keys with ids in (from, to], of all keys if from
+// is to.
+func (n *ChordNode) WatchRange(from, to uint32) (*Watcher, error) {
+	return newWatcher(n.cfg, n.findSuccessor, watchFilter{Range: true, From: from, To: to})
+}
+
+// NewWatcher is Watch for a program outside the ring, lookup finds the owner of an id,
+// e.g. Remote.LookupID.
+func NewWatcher(lookup func(id uint32) (string, error), key string, opts ...Option) (*Watcher, error) {
+	return newWatcher(remoteConfig(opts), lookup, watchFilter{Key: key})
+}
+
+// NewRangeWatcher is WatchRange for a program outside the ring.
+func NewRangeWatcher(lookup func(id uint32) (string, error), from, to uint32, opts ...Option) (*Watcher, error) {
+	return newWatcher(remoteConfig(opts), lookup, watchFilter{Range: true, From: from, To: to})
+}
+
+func newWatcher(cfg Config, lookup func(id uint32) (string, error), filter watchFilter) (*Watcher, error) {
+	w := &Watcher{
+		events:  make(chan Event, 256),
+		filter:  filter,
+		lookup:  lookup,
+		cfg:     cfg,
+		pollers: make(map[string]*watchPoller),
+		kick:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	w.Events = w.events
+	if err := w.refresh(false); err != nil {
+		w.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// Close stops the watch, and closes Events once the events being sent are dropped.
+func (w *Watcher) Close() {
+	w.once.Do(func() {
+		close(w.done)
+		w.lock.Lock()
+		for addr, p := range w.pollers {
+			delete(w.pollers, addr)
+			p.cancel()
+		}
+		w.lock.Unlock()
+		w.polls.Wait()
+		close(w.events)
+	})
+}
+
+// Err returns the error of the last lookup of the owners, or of the registration at one of
+// them, nil if it succeeded. The watch goes on trying every watchRefresh.
+func (w *Watcher) Err() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err
+}
+
+func (w *Watcher) run() {
+	ticker := time.NewTicker(watchRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		case <-w.kick:
+		}
+		w.lock.Lock()
+		failed := w.err != nil
+		w.lock.Unlock()
+		if err := w.refresh(true); err != nil && !failed {
+			w.sendFailure(Event{Op: EventLost, Err: err.Error()})
+		}
+	}
+}
+
+// owners returns the owners of the watched keys.
+func (w *Watcher) owners() ([]string, error) {
+	if !w.filter.Range {
+		owner, err := w.lookup(internal.Str_uint32_sha1(w.filter.Key))
+		return []string{owner}, err
+	}
+	var owners []string
+	seen := make(map[string]bool)
+	id := w.filter.From + 1
+	for len(owners) < 1<<10 {
+		owner, err := w.lookup(id)
+		if err != nil {
+			return nil, err
+		}
+		if seen[owner] {
+			break
+		}
+		seen[owner] = true
+		owners = append(owners, owner)
+		// the owner has the ids up to its own, the rest of the range is farther
+		ownerID := internal.Str_uint32_sha1(owner)
+		if !inRange(id, w.filter.To, ownerID) {
+			break
+		}
+		id = ownerID + 1
+	}
+	return owners, nil
+}
+
+// refresh moves the registrations to the current owners.
+func (w *Watcher) refresh(resync bool) (err error) {
+	owners, err := w.owners()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	defer func() { w.err = err }()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-w.done:
+		return nil
+	default:
+	}
+	want := make(map[string]bool, len(owners))
+	for _, addr := range owners {
+		want[addr] = true
+	}
+	for addr, p := range w.pollers {
+		if !want[addr] {
+			delete(w.pollers, addr)
+			p.cancel()
+		}
+	}
+	for _, addr := range owners {
+		if w.pollers[addr] != nil {
+			continue
+		}
+		p := &watchPoller{id: newTag(), resync: resync}
+		if dialErr := p.link.Dial(addr, &w.cfg); dialErr != nil {
+			err = dialErr
+			continue
+		}
+		request := WatchRequest{ID: p.id, Key: w.filter.Key, Range: w.filter.Range, From: w.filter.From, To: w.filter.To}
+		var ok bool
+		if callErr := p.link.Call("RegisterWatch", request, &ok); callErr != nil {
+			p.link.rpcClient.Close()
+			err = callErr
+			continue
+		}
+		w.pollers[addr] = p
+		w.polls.Add(1)
+		go w.poll(addr, p)
+	}
+	return err
+}
+
+// cancel drops the registration, and makes the poll of it fail.
+func (p *watchPoller) cancel() {
+	var ok bool
+	p.link.Call("CancelWatch", p.id, &ok)
+	p.link.rpcClient.Close()
+}
+
+func (w *Watcher) poll(addr string, p *watchPoller) {
+	defer w.polls.Done()
+	defer func() {
+		w.lock.Lock()
+		if w.pollers[addr] == p {
+			delete(w.pollers, addr)
+			p.link.rpcClient.Close()
+			select {
+			case w.kick <- struct{}{}:
+			default:
+			}
+		}
+		w.lock.Unlock()
+	}()
+	if p.resync && !w.send(Event{Op: EventLost, Owner: addr}) {
+		return
+	}
+	for {
+		var reply PollWatchReply
+		if err := p.link.Call("PollWatch", PollWatchRequest{ID: p.id, Wait: watchPollWait}, &reply); err != nil {
+			return
+		}
+		if reply.Lost && !w.send(Event{Op: EventLost, Owner: addr}) {
+			return
+		}
+		for _, ev := range reply.Events {
+			if !w.send(ev) {
+				return
+			}
+		}
+	}
+}
+
+// sendFailure sends the EventLost of a failed refresh, unless Close has been called.
+// Close does not wait for run, so the send is counted in polls like those of the polls.
+func (w *Watcher) sendFailure(ev Event) {
+	w.lock.Lock()
+	select {
+	case <-w.done:
+		w.lock.Unlock()
+		return
+	default:
+	}
+	w.polls.Add(1)
+	w.lock.Unlock()
+	defer w.polls.Done()
+	w.send(ev)
+}
+
+func (w *Watcher) send(ev Event) bool {
+	select {
+	case w.events <- ev:
+		return true
+	case <-w.done:
+		return false
+	}
+}
@@ -0,0 +1,509 @@
+// Package client reads and writes a chord ring without becoming a member of it.
+//
+// A Client only knows some bootstrap nodes. It asks one of them for the owner of a key,
+// then sends the data RPC to the owner directly. The range of keys an owner is
+// responsible for is remembered for a while, so that the following operations on nearby
+// keys skip the lookup.
+//
+// Values larger than the chunk size are cut into chunks like the nodes do, see
+// chord.SplitValue.
+package client
+
+import (
+	"dht/chord"
+	"dht/internal"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRouteTTL    = 2 * time.Second
+	defaultDialTimeout = 5 * time.Second
+	// a failed operation is tried again with a fresh lookup this many times
+	defaultRetries = 2
+)
+
+// ErrNoBootstrap is returned when neither the bootstrap nodes nor the nodes learned
+// later answer a lookup.
+var ErrNoBootstrap = errors.New("no bootstrap node is reachable")
+
+// route tells that the keys in (pred, id] are owned by addr
+type route struct {
+	pred, id uint32
+	addr     string
+	expire   time.Time
+}
+
+func (r *route) covers(id uint32) bool {
+	if r.pred < r.id {
+		return r.pred < id && id <= r.id
+	}
+	return r.pred < id || id <= r.id
+}
+
+type Client struct {
+	bootstrap   []string
+	routeTTL    time.Duration
+	dialTimeout time.Duration
+	retries     int
+	chunkSize   int
+
+	// next is the index of the bootstrap node to try first
+	next int
+	// routes are sorted by id
+	routes []route
+	conns  map[string]*chord.Remote
+	lock   sync.Mutex
+}
+
+type Option func(*Client)
+
+// WithRouteTTL sets how long the owner of a range of keys is trusted without a lookup.
+// Zero disables the cache.
+func WithRouteTTL(ttl time.Duration) Option {
+	return func(c *Client) {
+		c.routeTTL = ttl
+	}
+}
+
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.dialTimeout = timeout
+	}
+}
+
+func WithRetries(retries int) Option {
+	return func(c *Client) {
+		c.retries = retries
+	}
+}
+
+// WithChunkSize sets the size above which values are chunked, that of the nodes by default.
+func WithChunkSize(size int) Option {
+	return func(c *Client) {
+		c.chunkSize = size
+	}
+}
+
+func New(bootstrap []string, opts ...Option) (*Client, error) {
+	if len(bootstrap) == 0 {
+		return nil, errors.New("at least one bootstrap node is needed")
+	}
+	c := &Client{
+		bootstrap:   append([]string(nil), bootstrap...),
+		routeTTL:    defaultRouteTTL,
+		dialTimeout: defaultDialTimeout,
+		retries:     defaultRetries,
+		chunkSize:   chord.DefaultConfig().ChunkSize,
+		conns:       make(map[string]*chord.Remote),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Close closes the connections kept to the nodes.
+func (c *Client) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for addr, r := range c.conns {
+		r.Close()
+		delete(c.conns, addr)
+	}
+	c.routes = nil
+}
+
+// conn returns the kept connection to addr, or dials a new one
+func (c *Client) conn(addr string) (*chord.Remote, error) {
+	c.lock.Lock()
+	r, ok := c.conns[addr]
+	c.lock.Unlock()
+	if ok {
+		return r, nil
+	}
+	r, err := chord.DialRemote(addr, chord.WithDialTimeout(c.dialTimeout))
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	if old, ok := c.conns[addr]; ok {
+		r.Close()
+		r = old
+	} else {
+		c.conns[addr] = r
+	}
+	c.lock.Unlock()
+	return r, nil
+}
+
+// forget drops the connection to addr and the routes to it after an error
+func (c *Client) forget(addr string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if r, ok := c.conns[addr]; ok {
+		r.Close()
+		delete(c.conns, addr)
+	}
+	routes := c.routes[:0]
+	for _, r := range c.routes {
+		if r.addr != addr {
+			routes = append(routes, r)
+		}
+	}
+	c.routes = routes
+}
+
+func (c *Client) cached(id uint32) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	i := sort.Search(len(c.routes), func(i int) bool { return c.routes[i].id >= id })
+	// the route ending at or after id, or the one wrapping around zero
+	for _, j := range []int{i, 0} {
+		if j < len(c.routes) && c.routes[j].covers(id) && now.Before(c.routes[j].expire) {
+			return c.routes[j].addr, true
+		}
+	}
+	return "", false
+}
+
+func (c *Client) remember(addr, predAddr string) {
+	if c.routeTTL <= 0 {
+		return
+	}
+	r := route{
+		pred:   internal.Str_uint32_sha1(predAddr),
+		id:     internal.Str_uint32_sha1(addr),
+		addr:   addr,
+		expire: time.Now().Add(c.routeTTL),
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// routes overlapping the new one are stale
+	routes := c.routes[:0]
+	for _, old := range c.routes {
+		if !r.covers(old.id) && !old.covers(r.id) {
+			routes = append(routes, old)
+		}
+	}
+	routes = append(routes, r)
+	sort.Slice(routes, func(i, j int) bool { return routes[i].id < routes[j].id })
+	c.routes = routes
+}
+
+// entries are the nodes to send lookups to: the bootstrap nodes from the one which
+// answered last, then the owners learned from the earlier operations
+func (c *Client) entries() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entries := make([]string, 0, len(c.bootstrap)+len(c.routes))
+	for i := range c.bootstrap {
+		entries = append(entries, c.bootstrap[(c.next+i)%len(c.bootstrap)])
+	}
+	for _, r := range c.routes {
+		entries = append(entries, r.addr)
+	}
+	return entries
+}
+
+// lookup asks the entries in turn for the owner of key
+func (c *Client) lookup(key string) (string, error) {
+	return c.lookupID(internal.Str_uint32_sha1(key))
+}
+
+func (c *Client) lookupID(id uint32) (string, error) {
+	for i, addr := range c.entries() {
+		r, err := c.conn(addr)
+		if err != nil {
+			continue
+		}
+		owner, err := r.LookupID(id)
+		if err != nil {
+			c.forget(addr)
+			continue
+		}
+		if i > 0 && i < len(c.bootstrap) {
+			c.lock.Lock()
+			c.next = (c.next + i) % len(c.bootstrap)
+			c.lock.Unlock()
+		}
+		return owner, nil
+	}
+	return "", ErrNoBootstrap
+}
+
+// Lookup returns the owner of key, from the cache if possible.
+func (c *Client) Lookup(key string) (string, error) {
+	if addr, ok := c.cached(internal.Str_uint32_sha1(key)); ok {
+		return addr, nil
+	}
+	return c.lookup(key)
+}
+
+// do runs op against the owner of key, and tries again with a fresh lookup if the owner
+// cannot be reached, if the owner from the cache does not have the key, or if the node
+// found does not own the key any more, which it tells with chord.ErrNotOwner.
+func (c *Client) do(key string, op func(r *chord.Remote) error) error {
+	id := internal.Str_uint32_sha1(key)
+	var err error
+	for try := 0; try <= c.retries; try++ {
+		owner, fromCache := "", false
+		if try == 0 {
+			owner, fromCache = c.cached(id)
+		}
+		if !fromCache {
+			if owner, err = c.lookup(key); err != nil {
+				return err
+			}
+		}
+		var r *chord.Remote
+		if r, err = c.conn(owner); err != nil {
+			c.forget(owner)
+			continue
+		}
+		err = op(r)
+		if errors.Is(err, chord.ErrNotFound) && fromCache {
+			// a node may have joined before the owner and taken the key
+			continue
+		}
+		if err == nil || errors.Is(err, chord.ErrNotFound) || errors.Is(err, chord.ErrPreconditionFailed) ||
+			errors.Is(err, chord.ErrTooLarge) || errors.Is(err, chord.ErrWrongType) ||
+			errors.Is(err, chord.ErrLocked) || errors.Is(err, chord.ErrLeaseLost) || errors.Is(err, chord.ErrNodeFull) {
+			if !fromCache {
+				if pred, predErr := r.Predecessor(); predErr == nil {
+					c.remember(owner, pred)
+				}
+			}
+			return err
+		}
+		c.forget(owner)
+	}
+	return err
+}
+
+func (c *Client) Get(key string) (string, error) {
+	value, err := c.Open(key)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.Grow(int(value.Size))
+	_, err = io.Copy(&b, value)
+	return b.String(), err
+}
+
+// Open returns a reader of the value of key, which gets the chunks of a chunked value as
+// they are read.
+func (c *Client) Open(key string) (*chord.ValueReader, error) {
+	stored, err := c.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return chord.OpenValue(stored, c.get)
+}
+
+func (c *Client) get(key string) (string, error) {
+	var value string
+	err := c.do(key, func(r *chord.Remote) (err error) {
+		value, err = r.Get(key)
+		return err
+	})
+	return value, err
+}
+
+func (c *Client) Put(key, value string) error {
+	return c.PutIf(key, value, chord.Precondition{})
+}
+
+func (c *Client) PutIf(key, value string, cond chord.Precondition) error {
+	_, err := c.PutReader(key, strings.NewReader(value), cond)
+	return err
+}
+
+// PutReader puts the value read from r, chunked while it is read if it is large, and
+// returns the ETag the owner has given to the key.
+func (c *Client) PutReader(key string, r io.Reader, cond chord.Precondition) (string, error) {
+	if err := chord.CheckKey(key); err != nil {
+		return "", err
+	}
+	stored, _, err := chord.SplitValue(r, c.chunkSize, func(chunkKey, chunk string) error {
+		_, err := c.put(chunkKey, chunk, chord.Precondition{})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return c.put(key, stored, cond)
+}
+
+func (c *Client) put(key, value string, cond chord.Precondition) (string, error) {
+	var etag string
+	err := c.do(key, func(r *chord.Remote) (err error) {
+		etag, err = r.Store(key, value, cond)
+		return err
+	})
+	return etag, err
+}
+
+func (c *Client) Delete(key string) error {
+	return c.DeleteIf(key, chord.Precondition{})
+}
+
+func (c *Client) DeleteIf(key string, cond chord.Precondition) error {
+	if err := chord.CheckKey(key); err != nil {
+		return err
+	}
+	return c.do(key, func(r *chord.Remote) error {
+		return r.DeleteIf(key, cond)
+	})
+}
+
+// Watch and WatchRange are those of chord.ChordNode, the owners are looked up through
+// the nodes known to c.
+func (c *Client) Watch(key string) (*chord.Watcher, error) {
+	return chord.NewWatcher(c.lookupID, key, chord.WithDialTimeout(c.dialTimeout))
+}
+
+func (c *Client) WatchRange(from, to uint32) (*chord.Watcher, error) {
+	return chord.NewRangeWatcher(c.lookupID, from, to, chord.WithDialTimeout(c.dialTimeout))
+}
+
+// Publish and Subscribe are those of chord.ChordNode.
+func (c *Client) Publish(topic, data string) (int, error) {
+	var count int
+	err := c.do(chord.TopicKey(topic), func(r *chord.Remote) (err error) {
+		count, err = r.Publish(topic, data)
+		return err
+	})
+	return count, err
+}
+
+func (c *Client) Subscribe(topic string) (*chord.Subscription, error) {
+	return chord.NewSubscription(c.lookupID, topic, chord.WithDialTimeout(c.dialTimeout))
+}
+
+// AddToSet, RemoveFromSet and GetSet are those of chord.ChordNode.
+func (c *Client) AddToSet(key string, ttl time.Duration, members ...string) error {
+	if err := chord.CheckKey(key); err != nil {
+		return err
+	}
+	return c.do(key, func(r *chord.Remote) error {
+		return r.UpdateSet(key, members, nil, ttl)
+	})
+}
+
+func (c *Client) RemoveFromSet(key string, members ...string) error {
+	if err := chord.CheckKey(key); err != nil {
+		return err
+	}
+	return c.do(key, func(r *chord.Remote) error {
+		return r.UpdateSet(key, nil, members, 0)
+	})
+}
+
+func (c *Client) GetSet(key string) ([]string, error) {
+	stored, err := c.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return chord.SetMembers(stored)
+}
+
+// Increment and GetCounter are those of chord.ChordNode.
+func (c *Client) Increment(key string, delta int64) (int64, error) {
+	if err := chord.CheckKey(key); err != nil {
+		return 0, err
+	}
+	var value int64
+	err := c.do(key, func(r *chord.Remote) (err error) {
+		value, err = r.Increment(key, delta)
+		return err
+	})
+	return value, err
+}
+
+func (c *Client) GetCounter(key string) (int64, error) {
+	stored, err := c.get(key)
+	if err != nil {
+		return 0, err
+	}
+	return chord.CounterValue(stored)
+}
+
+// Acquire, Renew and Release are those of chord.ChordNode.
+func (c *Client) Acquire(name string, ttl time.Duration) (*chord.Lease, error) {
+	var lease *chord.Lease
+	err := c.do(chord.LockKey(name), func(r *chord.Remote) (err error) {
+		lease, err = r.Acquire(name, ttl)
+		return err
+	})
+	return lease, err
+}
+
+func (c *Client) Renew(lease *chord.Lease, ttl time.Duration) error {
+	return c.do(chord.LockKey(lease.Name), func(r *chord.Remote) error {
+		return r.Renew(lease, ttl)
+	})
+}
+
+func (c *Client) Release(lease *chord.Lease) error {
+	return c.do(chord.LockKey(lease.Name), func(r *chord.Remote) error {
+		return r.Release(lease)
+	})
+}
+
+// Namespace gives the operations of c on the keys of a namespace, see chord.NamespaceKey.
+type Namespace struct {
+	c    *Client
+	name string
+}
+
+// Namespace returns the namespace name, the default key space if it is empty.
+func (c *Client) Namespace(name string) (*Namespace, error) {
+	if strings.Contains(name, "\x00") {
+		return nil, errors.New("namespace with a zero byte")
+	}
+	return &Namespace{c: c, name: name}, nil
+}
+
+func (ns *Namespace) Get(key string) (string, error) {
+	return ns.c.Get(chord.NamespaceKey(ns.name, key))
+}
+
+func (ns *Namespace) Put(key, value string) error {
+	return ns.c.Put(chord.NamespaceKey(ns.name, key), value)
+}
+
+func (ns *Namespace) PutIf(key, value string, cond chord.Precondition) error {
+	return ns.c.PutIf(chord.NamespaceKey(ns.name, key), value, cond)
+}
+
+func (ns *Namespace) Delete(key string) error {
+	return ns.c.Delete(chord.NamespaceKey(ns.name, key))
+}
+
+func (ns *Namespace) DeleteIf(key string, cond chord.Precondition) error {
+	return ns.c.DeleteIf(chord.NamespaceKey(ns.name, key), cond)
+}
+
+// PutBytes, GetBytes and DeleteBytes are Put, Get and Delete for binary keys and values.
+func (c *Client) PutBytes(key, value []byte) error {
+	return c.Put(string(key), string(value))
+}
+
+func (c *Client) GetBytes(key []byte) ([]byte, error) {
+	value, err := c.Get(string(key))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+func (c *Client) DeleteBytes(key []byte) error {
+	return c.Delete(string(key))
+}
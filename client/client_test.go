@@ -0,0 +1,153 @@
+package client
+
+import (
+	"dht/chord"
+	"dht/internal"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const P = 22000
+
+func makeLocalAddr(port int) string {
+	return fmt.Sprintf("127.0.0.1:%d", P+port)
+}
+
+func TestRouteCovers(t *testing.T) {
+	r := route{pred: 10, id: 20}
+	if !r.covers(20) || r.covers(10) || r.covers(21) {
+		t.Errorf("range (10, 20] wrong")
+	}
+	r = route{pred: 1 << 31, id: 5}
+	if !r.covers(0) || !r.covers(5) || !r.covers(1<<31+1) || r.covers(6) {
+		t.Errorf("range wrapping around zero wrong")
+	}
+}
+
+func TestClient(t *testing.T) {
+	const N, M = 5, 50
+	var nodes [N]*chord.ChordNode
+	for i := 0; i < N; i++ {
+		nodes[i] = chord.CreateChordNode(makeLocalAddr(i))
+		nodes[i].Run()
+	}
+	time.Sleep(200 * time.Millisecond)
+	nodes[0].Create()
+	for i := 1; i < N; i++ {
+		nodes[i].Join(makeLocalAddr(0))
+		time.Sleep(400 * time.Millisecond)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// the first bootstrap node does not exist
+	c, err := New([]string{makeLocalAddr(99), makeLocalAddr(1)}, WithDialTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < M; i++ {
+		if err := c.Put(fmt.Sprint(i), fmt.Sprint(i)); err != nil {
+			t.Errorf("put %d: %v", i, err)
+		}
+	}
+	for i := 0; i < M; i++ {
+		if ok, value := nodes[i%N].Get(fmt.Sprint(i)); !ok || value != fmt.Sprint(i) {
+			t.Errorf("get %d from the ring: %v %s", i, ok, value)
+		}
+	}
+	if len(c.routes) == 0 || len(c.routes) > N {
+		t.Errorf("%d routes cached", len(c.routes))
+	}
+	w, err := c.Watch("w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put("w", "1")
+	select {
+	case ev := <-w.Events:
+		if ev.Op != chord.EventPut || ev.Value != "1" {
+			t.Errorf("watch event: %+v", ev)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("no watch event")
+	}
+	w.Close()
+	if err := c.Delete("0"); err != nil {
+		t.Error(err)
+	}
+	if _, err := c.Get("0"); !errors.Is(err, chord.ErrNotFound) {
+		t.Errorf("get deleted key: %v", err)
+	}
+	if err := c.Put(chord.LockKey("l"), "x"); !errors.Is(err, chord.ErrReservedKey) {
+		t.Errorf("put over a lock: %v", err)
+	}
+
+	// the bootstrap node used so far quits, and the cache is out of date
+	nodes[1].Quit()
+	time.Sleep(1 * time.Second)
+	for i := 1; i < M; i++ {
+		if value, err := c.Get(fmt.Sprint(i)); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("get %d after quit: %s %v", i, value, err)
+		}
+	}
+	for i := 0; i < N; i++ {
+		nodes[i].Quit()
+	}
+	if err := c.Put("x", "y"); !errors.Is(err, ErrNoBootstrap) {
+		t.Errorf("put without ring: %v", err)
+	}
+}
+
+func TestNotOwner(t *testing.T) {
+	const M = 30
+	// 63 and 60 take many of the keys of 50 and 52
+	ports := []int{50, 51, 52, 63, 60}
+	nodes := make([]*chord.ChordNode, len(ports))
+	for i, port := range ports {
+		nodes[i] = chord.CreateChordNode(makeLocalAddr(port))
+		nodes[i].Run()
+		defer nodes[i].Quit()
+	}
+	nodes[0].Create()
+	for i := 1; i < 3; i++ {
+		nodes[i].Join(makeLocalAddr(50))
+		time.Sleep(400 * time.Millisecond)
+	}
+	c, err := New([]string{makeLocalAddr(50)}, WithRouteTTL(time.Minute), WithDialTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < M; i++ {
+		if err := c.Put(fmt.Sprint(i), "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the joined nodes take keys the cache still routes to their successors
+	for i := 3; i < len(nodes); i++ {
+		nodes[i].Join(makeLocalAddr(50))
+		time.Sleep(400 * time.Millisecond)
+	}
+	time.Sleep(time.Second)
+	moved := 0
+	for i := 0; i < M; i++ {
+		cached, _ := c.cached(internal.Str_uint32_sha1(fmt.Sprint(i)))
+		if owner, _ := c.lookup(fmt.Sprint(i)); owner != cached {
+			moved++
+		}
+		if err := c.Put(fmt.Sprint(i), "new"); err != nil {
+			t.Errorf("put %d through the warm cache: %v", i, err)
+		}
+	}
+	if moved == 0 {
+		t.Fatal("no key changed owner")
+	}
+	for i := 0; i < M; i++ {
+		if value, err := nodes[i%len(nodes)].Fetch(fmt.Sprint(i)); err != nil || value != "new" {
+			t.Errorf("key %d at its owner: %s %v", i, value, err)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+// dhtctl talks to a running chord ring through any of its nodes.
+//
+//	dhtctl -addr 127.0.0.1:7000 put key value
+//	dhtctl get key
+//	dhtctl delete key
+//	dhtctl incr key delta  # add delta to the counter and print the new value
+//	dhtctl lookup key      # owner of the key and the hops to it
+//	dhtctl watch key       # print the changes of the key until killed
+//	dhtctl publish topic message
+//	dhtctl subscribe topic # print the messages of the topic until killed
+//	dhtctl ring            # members of the ring
+//	dhtctl stats           # counters of the node
+//	dhtctl export file     # dump of all the pairs of the ring, - for stdout
+//	dhtctl import file     # load a dump into the ring, - for stdin
+//
+// With -namespace the keys of put, get, delete, incr, lookup and watch are those of the
+// namespace.
+//
+// The dumps are those of chord.ExportRing, checksummed JSON lines with the keys and
+// values in base64. import also takes the JSON arrays of {"key", "value"} in base64 of
+// the older exports, and a JSON object of text keys and values.
+package main
+
+import (
+	"bufio"
+	"dht/chord"
+	"dht/internal"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	addr      string
+	timeout   time.Duration
+	namespace string
+)
+
+// keyed are the commands whose first argument is a key
+var keyed = map[string]bool{"put": true, "get": true, "delete": true, "incr": true, "lookup": true, "watch": true}
+
+type command struct {
+	args  string
+	nargs int
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"put":       {"key value", 2, put},
+	"get":       {"key", 1, get},
+	"delete":    {"key", 1, del},
+	"incr":      {"key delta", 2, incr},
+	"lookup":    {"key", 1, lookup},
+	"watch":     {"key", 1, watch},
+	"publish":   {"topic message", 2, publish},
+	"subscribe": {"topic", 1, subscribe},
+	"ring":      {"", 0, ring},
+	"stats":     {"", 0, stats},
+	"export":    {"file", 1, export},
+	"import":    {"file", 1, importFile},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dhtctl [flags] command [args]")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].args)
+	}
+	fmt.Fprintln(os.Stderr, "flags:")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.StringVar(&addr, "addr", "127.0.0.1:7000", "address of any node of the ring")
+	flag.DurationVar(&timeout, "timeout", 5*time.Second, "timeout of dialing a node")
+	flag.StringVar(&namespace, "namespace", "", "namespace of the keys, the default one if empty")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok || len(args)-1 != cmd.nargs {
+		usage()
+		os.Exit(2)
+	}
+	if keyed[args[0]] {
+		args[1] = chord.NamespaceKey(namespace, args[1])
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "dhtctl:", err)
+		os.Exit(1)
+	}
+}
+
+func dial(addr string) (*chord.Remote, error) {
+	return chord.DialRemote(addr, chord.WithDialTimeout(timeout))
+}
+
+// owner connects to the node responsible for key
+func owner(key string) (*chord.Remote, error) {
+	entry, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	ownerAddr, _, err := entry.Lookup(key)
+	entry.Close()
+	if err != nil {
+		return nil, err
+	}
+	return dial(ownerAddr)
+}
+
+// put stores the value like chord.ChordNode.Store, chunked if it is large.
+func put(args []string) error {
+	if err := chord.CheckKey(args[0]); err != nil {
+		return err
+	}
+	stored, _, err := chord.SplitValue(strings.NewReader(args[1]), chord.DefaultConfig().ChunkSize, putStored)
+	if err != nil {
+		return err
+	}
+	return putStored(args[0], stored)
+}
+
+// putStored puts the pair as the nodes keep it at the owner of key.
+func putStored(key, stored string) error {
+	r, err := owner(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return r.Put(key, stored)
+}
+
+func incr(args []string) error {
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad delta %q", args[1])
+	}
+	if err := chord.CheckKey(args[0]); err != nil {
+		return err
+	}
+	r, err := owner(args[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	value, err := r.Increment(args[0], delta)
+	if err != nil {
+		return err
+	}
+	fmt.Println(value)
+	return nil
+}
+
+func get(args []string) error {
+	r, err := owner(args[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	stored, err := r.Get(args[0])
+	if err != nil {
+		return err
+	}
+	// a large value is stored as a manifest of chunks kept by other nodes
+	value, err := chord.OpenValue(stored, func(key string) (string, error) {
+		r, err := owner(key)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		return r.Get(key)
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(os.Stdout, value); err != nil {
+		return err
+	}
+	fmt.Println()
+	return nil
+}
+
+func del(args []string) error {
+	if err := chord.CheckKey(args[0]); err != nil {
+		return err
+	}
+	r, err := owner(args[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return r.Delete(args[0])
+}
+
+func lookup(args []string) error {
+	entry, err := dial(addr)
+	if err != nil {
+		return err
+	}
+	defer entry.Close()
+	ownerAddr, path, err := entry.Lookup(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("owner: %s\n", ownerAddr)
+	// the last node of the path finds the owner among its successors
+	fmt.Printf("hops:  %d\n", len(path))
+	for i, hop := range path {
+		fmt.Printf("  %d. %s\n", i+1, hop)
+	}
+	return nil
+}
+
+func watch(args []string) error {
+	entry, err := dial(addr)
+	if err != nil {
+		return err
+	}
+	defer entry.Close()
+	w, err := chord.NewWatcher(entry.LookupID, args[0], chord.WithDialTimeout(timeout))
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for ev := range w.Events {
+		if ev.Err != "" {
+			fmt.Fprintln(os.Stderr, "dhtctl: watch:", ev.Err)
+		}
+		fmt.Printf("%d %-6s %q %q %s\n", ev.Version, ev.Op, ev.Key, ev.Value, ev.Owner)
+	}
+	return nil
+}
+
+func publish(args []string) error {
+	r, err := owner(chord.TopicKey(args[0]))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	count, err := r.Publish(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d subscribers\n", count)
+	return nil
+}
+
+func subscribe(args []string) error {
+	entry, err := dial(addr)
+	if err != nil {
+		return err
+	}
+	defer entry.Close()
+	s, err := chord.NewSubscription(entry.LookupID, args[0], chord.WithDialTimeout(timeout))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	for msg := range s.Messages {
+		fmt.Printf("%d %q\n", msg.Seq, msg.Data)
+	}
+	return nil
+}
+
+func ring([]string) error {
+	report, err := chord.Crawl(addr, chord.WithDialTimeout(timeout))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-12s %-22s %8s\n", "id", "addr", "keys")
+	for _, m := range report.Order {
+		fmt.Printf("%-12d %-22s %8d\n", m.ID, m.Addr, m.DataKeys)
+	}
+	for _, a := range report.Unreachable {
+		fmt.Printf("%-12s %-22s\n", "unreachable", a)
+	}
+	return nil
+}
+
+func stats([]string) error {
+	r, err := dial(addr)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	s, err := r.Stats()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("node:        %s (id %d), online: %v\n", s.Info.Addr, s.Info.ID, s.Info.Online)
+	fmt.Printf("keys:        %d, backup keys: %v\n", s.Storage.DataKeys, s.Storage.BackupKeys)
+	names := make([]string, 0, len(s.Storage.Namespaces))
+	for ns := range s.Storage.Namespaces {
+		if ns != "" {
+			names = append(names, ns)
+		}
+	}
+	sort.Strings(names)
+	for _, ns := range names {
+		fmt.Printf("namespace:   %s, keys: %d, bytes: %d\n", ns, s.Storage.Namespaces[ns].Keys, s.Storage.Namespaces[ns].Bytes)
+	}
+	fmt.Printf("lookups:     %d\n", s.Stats.Lookups)
+	if s.Stats.Lookups > 0 {
+		fmt.Printf("avg hops:    %.2f\n", float64(s.Stats.LookupHops)/float64(s.Stats.Lookups))
+		fmt.Printf("avg lookup:  %v\n", s.Stats.LookupTime/time.Duration(s.Stats.Lookups))
+	}
+	fmt.Printf("rpc served:  %d\n", s.Stats.RPCServed)
+	return nil
+}
+
+// export writes a dump of the ring, see chord.ExportRing
+func export(args []string) error {
+	var w io.Writer = os.Stdout
+	if args[0] != "-" {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	count, err := chord.ExportRing(addr, w, chord.WithDialTimeout(timeout))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d keys\n", count)
+	return nil
+}
+
+// importFile loads a dump into the ring. The number of pairs done is kept in file.progress
+// while it runs, and an import started again with that file left resumes from there.
+func importFile(args []string) error {
+	var in io.Reader = os.Stdin
+	progressPath := ""
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// check the whole dump before writing any of it
+		if r := bufio.NewReader(f); chord.IsDump(r) {
+			if _, err := chord.VerifyDump(r); err != nil {
+				return err
+			}
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		in = f
+		progressPath = args[0] + ".progress"
+	}
+	r := bufio.NewReader(in)
+	if !chord.IsDump(r) {
+		return importPairs(r)
+	}
+	d, err := chord.NewDumpReader(r)
+	if err != nil {
+		return err
+	}
+	skip := 0
+	if progressPath != "" {
+		if b, err := os.ReadFile(progressPath); err == nil {
+			if skip, err = strconv.Atoi(strings.TrimSpace(string(b))); err != nil {
+				return fmt.Errorf("%s: %w", progressPath, err)
+			}
+			fmt.Fprintf(os.Stderr, "resuming after %d keys\n", skip)
+		}
+	}
+	done, err := chord.ImportDump(d, addr, skip, func(done int) error {
+		if progressPath == "" {
+			return nil
+		}
+		return os.WriteFile(progressPath, []byte(strconv.Itoa(done)+"\n"), 0o644)
+	}, chord.WithDialTimeout(timeout))
+	if err != nil {
+		return fmt.Errorf("after %d keys: %w", done, err)
+	}
+	if progressPath != "" {
+		os.Remove(progressPath)
+	}
+	fmt.Fprintf(os.Stderr, "imported %d keys\n", done-skip)
+	return nil
+}
+
+// importPairs puts the pairs of a file written by an older dhtctl export, or of a JSON
+// object, one by one.
+func importPairs(r io.Reader) error {
+	data, err := internal.ReadPairs(r)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for k, v := range data {
+		if err := put([]string{k, v}); err != nil {
+			fmt.Fprintf(os.Stderr, "dhtctl: put %s: %v\n", k, err)
+			failed++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "imported %d keys, %d failed\n", len(data)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d keys failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// duration is a time.Duration written as "500ms", "10s" etc. in the config file
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// config of the daemon, read from a JSON file and overridden by the flags
+type config struct {
+	// Listen is where the node accepts connections, Advertise by default
+	Listen string `json:"listen"`
+	// Advertise is the address other nodes reach this node at, which also decides its id
+	Advertise string `json:"advertise"`
+	// Bootstrap peers are tried in order; the node creates a new ring if there is none
+	Bootstrap []string `json:"bootstrap"`
+	// DataDir keeps the snapshot of the data of the node across restarts
+	DataDir          string   `json:"dataDir"`
+	SnapshotInterval duration `json:"snapshotInterval"`
+	// Admin, Metrics and Gateway are the addresses of the optional http endpoints
+	Admin       string `json:"admin"`
+	Metrics     string `json:"metrics"`
+	Gateway     string `json:"gateway"`
+	Replication int    `json:"replication"`
+	// MaxKeySize and MaxValueSize in bytes, the defaults of chord if zero
+	MaxKeySize   int `json:"maxKeySize"`
+	MaxValueSize int `json:"maxValueSize"`
+	// MaxKeys and MaxBytes limit the primary data, MaxBackupKeys and MaxBackupBytes the
+	// backups, unlimited if zero
+	MaxKeys        int64  `json:"maxKeys"`
+	MaxBytes       int64  `json:"maxBytes"`
+	MaxBackupKeys  int64  `json:"maxBackupKeys"`
+	MaxBackupBytes int64  `json:"maxBackupBytes"`
+	LogLevel       string `json:"logLevel"`
+	LogJSON        bool   `json:"logJSON"`
+	// Namespaces must be configured alike on all the nodes of the ring
+	Namespaces map[string]namespaceConfig `json:"namespaces"`
+}
+
+// namespaceConfig is chord.NamespaceConfig with the ttl written as a duration
+type namespaceConfig struct {
+	Replication int      `json:"replication"`
+	TTL         duration `json:"ttl"`
+}
+
+const defaultSnapshotInterval = 10 * time.Second
+
+func loadConfig(path string) (config, error) {
+	var c config
+	if path == "" {
+		return c, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c *config) validate() error {
+	if c.Advertise == "" {
+		return errors.New("advertise address is required")
+	}
+	if c.Listen == "" {
+		c.Listen = c.Advertise
+	}
+	if c.SnapshotInterval == 0 {
+		c.SnapshotInterval = duration(defaultSnapshotInterval)
+	}
+	if c.SnapshotInterval < 0 {
+		return fmt.Errorf("snapshot interval %v should be positive", time.Duration(c.SnapshotInterval))
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+// dhtd runs a single long-lived chord node.
+//
+//	dhtd -config node.json
+//	dhtd -advertise 10.0.0.2:7000 -bootstrap 10.0.0.1:7000 -data /var/lib/dhtd -admin :8080
+//
+// On SIGTERM or SIGINT the node quits gracefully, handing its data to its successor. The
+// data is also written to the data directory from time to time, so that a node killed
+// without Quit puts its keys back into the ring when it is restarted, leaving the keys
+// written since as they are.
+package main
+
+import (
+	"dht/chord"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// listenTransport listens on the configured address instead of the advertised one,
+// e.g. 0.0.0.0:7000 behind a NAT.
+type listenTransport struct {
+	listen string
+}
+
+func (t listenTransport) Listen(string) (net.Listener, error) {
+	return net.Listen("tcp", t.listen)
+}
+
+func (t listenTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+func main() {
+	c, err := parseConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	os.Exit(run(c))
+}
+
+// parseConfig reads the config file given by -config, overrides it with the other flags
+// set in args, and validates the result.
+func parseConfig(args []string) (config, error) {
+	var (
+		configPath string
+		flags      config
+		bootstrap  string
+		snapshot   time.Duration
+	)
+	fs := flag.NewFlagSet("dhtd", flag.ContinueOnError)
+	fs.StringVar(&configPath, "config", "", "JSON config file, overridden by the other flags")
+	fs.StringVar(&flags.Listen, "listen", "", "address to listen on, the advertised address by default")
+	fs.StringVar(&flags.Advertise, "advertise", "", "address other nodes reach this node at")
+	fs.StringVar(&bootstrap, "bootstrap", "", "comma separated addresses of nodes of the ring to join")
+	fs.StringVar(&flags.DataDir, "data", "", "directory to keep the data in across restarts")
+	fs.DurationVar(&snapshot, "snapshot-interval", defaultSnapshotInterval, "interval of writing the data to the data directory")
+	fs.StringVar(&flags.Admin, "admin", "", "address of the admin http API")
+	fs.StringVar(&flags.Metrics, "metrics", "", "address of the /metrics endpoint")
+	fs.StringVar(&flags.Gateway, "gateway", "", "address of the HTTP/JSON key-value gateway")
+	fs.IntVar(&flags.Replication, "replication", 0, "successors keeping a backup of the data")
+	fs.IntVar(&flags.MaxKeySize, "max-key-size", 0, "max size of a key in bytes")
+	fs.IntVar(&flags.MaxValueSize, "max-value-size", 0, "max size of a value in bytes")
+	fs.Int64Var(&flags.MaxKeys, "max-keys", 0, "max keys of the primary data")
+	fs.Int64Var(&flags.MaxBytes, "max-bytes", 0, "max bytes of the primary data")
+	fs.Int64Var(&flags.MaxBackupKeys, "max-backup-keys", 0, "keys of all the backups over which they are counted in the health and the metrics")
+	fs.Int64Var(&flags.MaxBackupBytes, "max-backup-bytes", 0, "bytes of all the backups over which they are counted in the health and the metrics")
+	fs.StringVar(&flags.LogLevel, "log-level", "", "log level: debug/info/warn/error")
+	fs.BoolVar(&flags.LogJSON, "log-json", false, "log in JSON")
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+
+	c, err := loadConfig(configPath)
+	if err != nil {
+		return c, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			c.Listen = flags.Listen
+		case "advertise":
+			c.Advertise = flags.Advertise
+		case "bootstrap":
+			c.Bootstrap = strings.Split(bootstrap, ",")
+		case "data":
+			c.DataDir = flags.DataDir
+		case "snapshot-interval":
+			c.SnapshotInterval = duration(snapshot)
+		case "admin":
+			c.Admin = flags.Admin
+		case "metrics":
+			c.Metrics = flags.Metrics
+		case "gateway":
+			c.Gateway = flags.Gateway
+		case "replication":
+			c.Replication = flags.Replication
+		case "max-key-size":
+			c.MaxKeySize = flags.MaxKeySize
+		case "max-value-size":
+			c.MaxValueSize = flags.MaxValueSize
+		case "max-keys":
+			c.MaxKeys = flags.MaxKeys
+		case "max-bytes":
+			c.MaxBytes = flags.MaxBytes
+		case "max-backup-keys":
+			c.MaxBackupKeys = flags.MaxBackupKeys
+		case "max-backup-bytes":
+			c.MaxBackupBytes = flags.MaxBackupBytes
+		case "log-level":
+			c.LogLevel = flags.LogLevel
+		case "log-json":
+			c.LogJSON = flags.LogJSON
+		}
+	})
+	return c, c.validate()
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "dhtd:", err)
+	os.Exit(1)
+}
+
+func run(c config) int {
+	level, err := logrus.ParseLevel(c.LogLevel)
+	if err != nil {
+		fatal(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	logger.SetLevel(level)
+	if c.LogJSON {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	}
+
+	opts := []chord.Option{
+		chord.WithLogger(logger),
+		chord.WithReplication(c.Replication),
+		chord.WithSizeLimits(c.MaxKeySize, c.MaxValueSize),
+		chord.WithQuota(c.MaxKeys, c.MaxBytes),
+		chord.WithBackupQuota(c.MaxBackupKeys, c.MaxBackupBytes),
+		chord.WithTransport(listenTransport{c.Listen}),
+	}
+	for name, nc := range c.Namespaces {
+		opts = append(opts, chord.WithNamespace(name, chord.NamespaceConfig{Replication: nc.Replication, TTL: time.Duration(nc.TTL)}))
+	}
+	node, err := chord.NewChordNode(c.Advertise, opts...)
+	if err != nil {
+		fatal(err)
+	}
+	store := newSnapshotStore(c.DataDir)
+	saved, err := store.load()
+	if err != nil {
+		fatal(err)
+	}
+	if err := node.Start(); err != nil {
+		fatal(err)
+	}
+	if c.Admin != "" {
+		if err := node.ServeAdmin(c.Admin); err != nil {
+			fatal(err)
+		}
+	}
+	if c.Metrics != "" {
+		if err := node.ServeMetrics(c.Metrics); err != nil {
+			fatal(err)
+		}
+	}
+	if c.Gateway != "" {
+		if err := node.ServeGateway(c.Gateway); err != nil {
+			fatal(err)
+		}
+	}
+	if !joinRing(node, c.Bootstrap, logger) {
+		node.ForceQuit()
+		return 1
+	}
+	logger.Infof("node %s (id %d) is up", c.Advertise, node.Id)
+	if len(saved) > 0 {
+		// the keys may have been taken over or changed owner while the node was down
+		go func() {
+			restored, kept, failed := restore(node, saved)
+			logger.Infof("restored %d keys from %s, %d newer kept, %d failed", restored, store.path(), kept, failed)
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	ticker := time.NewTicker(time.Duration(c.SnapshotInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case sig := <-signals:
+			logger.Infof("%s received, quitting", sig)
+			node.Quit()
+			// the data is with the successor now, and must not come back on the next start
+			if err := store.remove(); err != nil {
+				logger.Error("failed to remove the snapshot: ", err)
+				return 1
+			}
+			return 0
+		case <-ticker.C:
+			if err := store.save(node.LocalData()); err != nil {
+				logger.Error("failed to save the snapshot: ", err)
+			}
+		}
+	}
+}
+
+// restore puts the saved pairs back into the ring as they are stored, the chunks of large
+// values included, without overwriting what was written while the node was down. It
+// returns the number of keys restored, kept as they were, and failed.
+func restore(node *chord.ChordNode, saved map[string]string) (restored, kept, failed int) {
+	for k, v := range saved {
+		err := node.RestoreStored(k, v)
+		switch {
+		case err == nil:
+			restored++
+		case errors.Is(err, chord.ErrPreconditionFailed):
+			kept++
+		default:
+			failed++
+		}
+	}
+	return
+}
+
+// joinRing joins through the first bootstrap peer which answers, or creates a ring if
+// no peer is given.
+func joinRing(node *chord.ChordNode, peers []string, logger *logrus.Logger) bool {
+	if len(peers) == 0 {
+		node.Create()
+		return true
+	}
+	for _, peer := range peers {
+		if peer == "" {
+			continue
+		}
+		if node.Join(peer) {
+			return true
+		}
+		logger.Warn("failed to join through ", peer)
+	}
+	logger.Error("no bootstrap peer could be joined")
+	return false
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"dht/chord"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const P = 24000
+
+func makeLocalAddr(port int) string {
+	return fmt.Sprintf("127.0.0.1:%d", P+port)
+}
+
+func TestParseConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "node.json")
+	os.WriteFile(file, []byte(`{
+	  "advertise": "10.0.0.2:7000",
+	  "bootstrap": ["10.0.0.1:7000"],
+	  "snapshotInterval": "5s",
+	  "replication": 2,
+	  "maxKeys": 100,
+	  "maxBackupKeys": 300,
+	  "maxBackupBytes": 4096,
+	  "namespaces": {"cache": {"replication": 1, "ttl": "10m"}}
+	}`), 0644)
+	unknown := filepath.Join(dir, "unknown.json")
+	os.WriteFile(unknown, []byte(`{"advertise": "10.0.0.2:7000", "replicas": 2}`), 0644)
+
+	fromFile := config{
+		Listen:           "10.0.0.2:7000",
+		Advertise:        "10.0.0.2:7000",
+		Bootstrap:        []string{"10.0.0.1:7000"},
+		SnapshotInterval: duration(5 * time.Second),
+		Replication:      2,
+		MaxKeys:          100,
+		MaxBackupKeys:    300,
+		MaxBackupBytes:   4096,
+		LogLevel:         "info",
+		Namespaces:       map[string]namespaceConfig{"cache": {Replication: 1, TTL: duration(10 * time.Minute)}},
+	}
+	tests := []struct {
+		name string
+		args []string
+		// change makes the config expected from fromFile
+		change func(c *config)
+		err    string
+	}{
+		{"file", []string{"-config", file}, func(c *config) {}, ""},
+		{"flags over the file", []string{"-config", file, "-listen", ":7000", "-bootstrap", "a:1,b:2", "-replication", "3",
+			"-snapshot-interval", "1m", "-max-keys", "0", "-max-backup-keys", "10", "-max-backup-bytes", "20", "-log-level", "debug", "-log-json"},
+			func(c *config) {
+				c.Listen = ":7000"
+				c.Bootstrap = []string{"a:1", "b:2"}
+				c.Replication = 3
+				c.SnapshotInterval = duration(time.Minute)
+				c.MaxKeys = 0
+				c.MaxBackupKeys = 10
+				c.MaxBackupBytes = 20
+				c.LogLevel = "debug"
+				c.LogJSON = true
+			}, ""},
+		{"flags without a file", []string{"-advertise", "127.0.0.1:7000", "-max-bytes", "1024", "-data", "/tmp/d"},
+			func(c *config) {
+				*c = config{Listen: "127.0.0.1:7000", Advertise: "127.0.0.1:7000", DataDir: "/tmp/d", MaxBytes: 1024,
+					SnapshotInterval: duration(defaultSnapshotInterval), LogLevel: "info"}
+			}, ""},
+		{"no advertise", []string{"-listen", ":7000"}, nil, "advertise address is required"},
+		{"negative interval", []string{"-config", file, "-snapshot-interval", "-1s"}, nil, "should be positive"},
+		{"unknown field", []string{"-config", unknown}, nil, `unknown field "replicas"`},
+		{"missing file", []string{"-config", filepath.Join(dir, "none.json")}, nil, "no such file"},
+		{"unknown flag", []string{"-replicas", "2"}, nil, "flag provided but not defined"},
+	}
+	for _, test := range tests {
+		c, err := parseConfig(test.args)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		want := fromFile
+		test.change(&want)
+		if !reflect.DeepEqual(c, want) {
+			t.Errorf("%s:\n%+v\nwant\n%+v", test.name, c, want)
+		}
+	}
+}
+
+func TestSnapshotStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	s := newSnapshotStore(dir)
+	if saved, err := s.load(); err != nil || saved != nil {
+		t.Errorf("load without a snapshot: %v %v", saved, err)
+	}
+	first := map[string]string{"a": "1", "binary\x00\xff": "\x00\x01"}
+	second := map[string]string{"b": "2"}
+	for _, data := range []map[string]string{first, second} {
+		if err := s.save(data); err != nil {
+			t.Fatal(err)
+		}
+		if saved, err := s.load(); err != nil || !reflect.DeepEqual(saved, data) {
+			t.Errorf("load: %v %v, want %v", saved, err, data)
+		}
+	}
+	// the snapshot is replaced by a rename, no temporary file is left
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 || entries[0].Name() != snapshotFile {
+		t.Errorf("files in the data directory: %v", entries)
+	}
+	if err := s.remove(); err != nil {
+		t.Error(err)
+	}
+	if saved, err := s.load(); err != nil || saved != nil {
+		t.Errorf("load after remove: %v %v", saved, err)
+	}
+	if err := s.remove(); err != nil {
+		t.Errorf("remove twice: %v", err)
+	}
+	// without a data directory nothing is kept
+	none := newSnapshotStore("")
+	if err := none.save(first); err != nil {
+		t.Error(err)
+	}
+	if saved, err := none.load(); err != nil || saved != nil {
+		t.Errorf("load without a data directory: %v %v", saved, err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	opts := []chord.Option{chord.WithLogger(logger), chord.WithChunkSize(1 << 10)}
+	var nodes []*chord.ChordNode
+	defer func() {
+		for _, n := range nodes {
+			n.Quit()
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		nodes = append(nodes, chord.CreateChordNode(makeLocalAddr(i), opts...))
+		nodes[i].Run()
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !joinRing(nodes[0], nil, logger) || !joinRing(nodes[1], []string{makeLocalAddr(99), makeLocalAddr(0)}, logger) {
+		t.Fatal("failed to make the ring")
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	large := strings.Repeat("0123456789", 500)
+	for i := 0; i < 20; i++ {
+		nodes[0].Put(fmt.Sprint(i), fmt.Sprint(i))
+	}
+	nodes[0].Put("large", large)
+	nodes[0].AddToSet("set", 0, "a")
+	store := newSnapshotStore(t.TempDir())
+	data := make(map[string]string)
+	for _, n := range nodes[:2] {
+		for k, v := range n.LocalData() {
+			data[k] = v
+		}
+	}
+	if err := store.save(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// written and deleted since the snapshot
+	nodes[0].Put("0", "newer")
+	for i := 1; i < 5; i++ {
+		nodes[0].Delete(fmt.Sprint(i))
+	}
+	nodes[0].Delete("large")
+	nodes[0].AddToSet("set", 0, "b")
+
+	// the node is started again with its snapshot, and joins the ring
+	saved, err := store.load()
+	if err != nil || len(saved) != len(data) {
+		t.Fatalf("load: %d of %d pairs, %v", len(saved), len(data), err)
+	}
+	if !joinRing(nodes[2], []string{makeLocalAddr(1)}, logger) {
+		t.Fatal("join failed")
+	}
+	time.Sleep(500 * time.Millisecond)
+	restored, kept, failed := restore(nodes[2], saved)
+	if failed != 0 || restored < 6 || restored+kept != len(saved) {
+		t.Errorf("%d restored, %d kept, %d failed of %d", restored, kept, failed, len(saved))
+	}
+	for i := 0; i < 20; i++ {
+		want := fmt.Sprint(i)
+		if i == 0 {
+			want = "newer"
+		}
+		if ok, value := nodes[i%3].Get(fmt.Sprint(i)); !ok || value != want {
+			t.Errorf("%d after restore: %v %q", i, ok, value)
+		}
+	}
+	if ok, value := nodes[1].Get("large"); !ok || value != large {
+		t.Errorf("large value after restore: %v %d bytes", ok, len(value))
+	}
+	if members, err := nodes[2].GetSet("set"); err != nil || len(members) != 2 {
+		t.Errorf("set after restore: %v %v", members, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"dht/internal"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const snapshotFile = "data.json"
+
+// snapshotStore writes the data of the node to a file in the data directory. The file is
+// replaced by a rename, so a kill at any time leaves either the old or the new snapshot.
+// Without a data directory nothing is kept.
+type snapshotStore struct {
+	dir string
+}
+
+func newSnapshotStore(dir string) *snapshotStore {
+	return &snapshotStore{dir: dir}
+}
+
+func (s *snapshotStore) path() string {
+	return filepath.Join(s.dir, snapshotFile)
+}
+
+func (s *snapshotStore) load() (map[string]string, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(s.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return internal.ReadPairs(bytes.NewReader(b))
+}
+
+func (s *snapshotStore) save(data map[string]string) error {
+	if s.dir == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := internal.WritePairs(&buf, data); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	tmp, err := os.CreateTemp(s.dir, snapshotFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path())
+}
+
+func (s *snapshotStore) remove() error {
+	if s.dir == "" {
+		return nil
+	}
+	err := os.Remove(s.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
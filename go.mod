@@ -5,6 +5,7 @@ go 1.18
 require (
 	github.com/fatih/color v1.15.0
 	github.com/sirupsen/logrus v1.9.3
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
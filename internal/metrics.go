@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A minimal implementation of the Prometheus text exposition format, so that nodes
+// can be scraped without pulling in the client library.
+
+// CounterVec is a set of counters distinguished by the value of one label.
+type CounterVec struct {
+	lock     sync.RWMutex
+	counters map[string]*atomic.Int64
+}
+
+func (v *CounterVec) Inc(label string) {
+	v.lock.RLock()
+	c, ok := v.counters[label]
+	v.lock.RUnlock()
+	if !ok {
+		v.lock.Lock()
+		if v.counters == nil {
+			v.counters = make(map[string]*atomic.Int64)
+		}
+		if c, ok = v.counters[label]; !ok {
+			c = new(atomic.Int64)
+			v.counters[label] = c
+		}
+		v.lock.Unlock()
+	}
+	c.Add(1)
+}
+
+func (v *CounterVec) Values() map[string]int64 {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	values := make(map[string]int64, len(v.counters))
+	for k, c := range v.counters {
+		values[k] = c.Load()
+	}
+	return values
+}
+
+// Histogram counts observations in cumulative buckets with the given upper bounds.
+type Histogram struct {
+	bounds  []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sumBits atomic.Uint64
+}
+
+func NewHistogram(bounds ...float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i].Add(1)
+		}
+	}
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func WriteCounter(w io.Writer, name, help string, value int64) {
+	writeHeader(w, name, help, "counter")
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func WriteGauge(w io.Writer, name, help string, value int64) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func WriteGaugeFloat(w io.Writer, name, help string, value float64) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %g\n", name, value)
+}
+
+// WriteGaugeVec writes gauges distinguished by the value of one label.
+func WriteGaugeVec(w io.Writer, name, help, label string, values map[string]int64) {
+	writeHeader(w, name, help, "gauge")
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, values[k])
+	}
+}
+
+func WriteCounterVec(w io.Writer, name, help, label string, v *CounterVec) {
+	writeHeader(w, name, help, "counter")
+	values := v.Values()
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, values[k])
+	}
+}
+
+func WriteHistogram(w io.Writer, name, help string, h *Histogram) {
+	writeHeader(w, name, help, "histogram")
+	for i, b := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, b, h.counts[i].Load())
+	}
+	count := h.count.Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, math.Float64frombits(h.sumBits.Load()))
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
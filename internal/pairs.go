@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// pair is a key-value pair in the files written by WritePairs. []byte is base64 in JSON,
+// so binary keys and values are kept as they are.
+type pair struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// WritePairs writes data as a JSON array of {"key", "value"} objects in base64, sorted by key.
+func WritePairs(w io.Writer, data map[string]string) error {
+	pairs := make([]pair, 0, len(data))
+	for k, v := range data {
+		pairs = append(pairs, pair{[]byte(k), []byte(v)})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return bytes.Compare(pairs[i].Key, pairs[j].Key) < 0 })
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(pairs)
+}
+
+// ReadPairs reads what WritePairs writes, or a JSON object of text keys and values.
+func ReadPairs(r io.Reader) (map[string]string, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '{' {
+		var data map[string]string
+		err := json.Unmarshal(raw, &data)
+		return data, err
+	}
+	var pairs []pair
+	if err := json.Unmarshal(raw, &pairs); err != nil {
+		return nil, err
+	}
+	data := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		data[string(p.Key)] = string(p.Value)
+	}
+	return data, nil
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+)
+
+// gobServerCodec is the codec of net/rpc, with a hook called for every request.
+type gobServerCodec struct {
+	rwc       io.ReadWriteCloser
+	dec       *gob.Decoder
+	enc       *gob.Encoder
+	encBuf    *bufio.Writer
+	closed    bool
+	onRequest func(method string)
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	if c.onRequest != nil {
+		c.onRequest(r.ServiceMethod)
+	}
+	return nil
+}
+
+func (c *gobServerCodec) ReadRequestBody(body any) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body any) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// ServeConn is rpc.Server.ServeConn which calls onRequest with the method name of every request.
+func ServeConn(server *rpc.Server, conn io.ReadWriteCloser, onRequest func(method string)) {
+	buf := bufio.NewWriter(conn)
+	server.ServeCodec(&gobServerCodec{
+		rwc:       conn,
+		dec:       gob.NewDecoder(conn),
+		enc:       gob.NewEncoder(buf),
+		encBuf:    buf,
+		onRequest: onRequest,
+	})
+}
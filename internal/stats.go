@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NodeStats is a snapshot of the counters of a node, used to compare DHT implementations.
+type NodeStats struct {
+	Lookups    int64
+	LookupHops int64
+	LookupTime time.Duration
+	RPCServed  int64
+}
+
+func (s *NodeStats) Add(o NodeStats) {
+	s.Lookups += o.Lookups
+	s.LookupHops += o.LookupHops
+	s.LookupTime += o.LookupTime
+	s.RPCServed += o.RPCServed
+}
+
+// Counters are updated concurrently by a running node.
+type Counters struct {
+	lookups     atomic.Int64
+	lookupHops  atomic.Int64
+	lookupNanos atomic.Int64
+	rpcServed   atomic.Int64
+
+	rpcByMethod CounterVec
+	hopsHist    *Histogram
+	latencyHist *Histogram
+	histOnce    sync.Once
+}
+
+// histograms are created on first use since Counters is embedded by value in the nodes
+func (c *Counters) histograms() (*Histogram, *Histogram) {
+	c.histOnce.Do(func() {
+		c.hopsHist = NewHistogram(0, 1, 2, 3, 4, 5, 6, 8, 10, 15, 20, 32)
+		c.latencyHist = NewHistogram(.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5)
+	})
+	return c.hopsHist, c.latencyHist
+}
+
+// RecordLookup records a lookup of a user operation which took hops remote hops.
+func (c *Counters) RecordLookup(hops int, d time.Duration) {
+	c.lookups.Add(1)
+	c.lookupHops.Add(int64(hops))
+	c.lookupNanos.Add(int64(d))
+	hopsHist, latencyHist := c.histograms()
+	hopsHist.Observe(float64(hops))
+	latencyHist.Observe(d.Seconds())
+}
+
+func (c *Counters) RecordRPC(method string) {
+	c.rpcServed.Add(1)
+	c.rpcByMethod.Inc(method)
+}
+
+func (c *Counters) Snapshot() NodeStats {
+	return NodeStats{
+		Lookups:    c.lookups.Load(),
+		LookupHops: c.lookupHops.Load(),
+		LookupTime: time.Duration(c.lookupNanos.Load()),
+		RPCServed:  c.rpcServed.Load(),
+	}
+}
+
+// WriteMetrics writes the counters in the Prometheus text format, each name prefixed with prefix.
+func (c *Counters) WriteMetrics(w io.Writer, prefix string) {
+	hopsHist, latencyHist := c.histograms()
+	WriteCounterVec(w, prefix+"rpc_served_total", "RPCs served by method.", "method", &c.rpcByMethod)
+	WriteHistogram(w, prefix+"lookup_hops", "Hops of the lookups of user operations.", hopsHist)
+	WriteHistogram(w, prefix+"lookup_duration_seconds", "Latency of the lookups of user operations.", latencyHist)
+}
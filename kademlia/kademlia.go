@@ -0,0 +1,511 @@
+package kademlia
+
+import (
+	"dht/internal"
+	"errors"
+	"math/bits"
+	"net"
+	"net/rpc"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	KadM               = 32
+	KadK               = 8
+	KadAlpha           = 3
+	republishInterval  = time.Second * 30
+	refreshInterval    = time.Second * 10
+	tombstoneExpire    = time.Minute
+	dialTimeout        = time.Second * 2
+	lookupRoundTimeout = time.Second * 5
+)
+
+// clock is the time of the stores and the republishes, replaced in the tests
+var clock = time.Now
+
+// distance is the XOR metric of Kademlia
+func distance(a, b uint32) uint32 {
+	return a ^ b
+}
+
+// bucketIndex returns the index of the k-bucket in which id should be stored, -1 for self
+func bucketIndex(self, id uint32) int {
+	return bits.Len32(distance(self, id)) - 1
+}
+
+type Contact struct {
+	ID   uint32
+	Addr string
+}
+
+func makeContact(addr string) Contact {
+	return Contact{internal.Str_uint32_sha1(addr), addr}
+}
+
+// Entry is a stored value. Deletions are kept as tombstones so that republishing
+// of stale copies cannot bring a deleted key back.
+type Entry struct {
+	Value   string
+	Version int64
+	Deleted bool
+}
+
+type storedEntry struct {
+	Entry
+	lastStored time.Time
+	// lastReceived is the last store of the entry by another node, not by our own
+	// republish
+	lastReceived time.Time
+}
+
+type KademliaNode struct {
+	Id     uint32
+	Addr   string
+	online atomic.Bool
+
+	listener net.Listener
+	server   *rpc.Server
+
+	data     map[string]*storedEntry
+	dataLock sync.RWMutex
+
+	buckets     [KadM][]Contact
+	bucketsLock sync.RWMutex
+
+	activeConn     map[net.Conn]struct{}
+	activeConnLock sync.Mutex
+
+	stats internal.Counters
+}
+
+// local methods
+
+func CreateKademliaNode(addr string) *KademliaNode {
+	return &KademliaNode{
+		Addr:       addr,
+		Id:         internal.Str_uint32_sha1(addr),
+		data:       make(map[string]*storedEntry),
+		activeConn: make(map[net.Conn]struct{}),
+	}
+}
+
+func (n *KademliaNode) self() Contact {
+	return Contact{n.Id, n.Addr}
+}
+
+func (n *KademliaNode) Clear() {
+	n.dataLock.Lock()
+	n.data = make(map[string]*storedEntry)
+	n.dataLock.Unlock()
+	n.bucketsLock.Lock()
+	for i := range n.buckets {
+		n.buckets[i] = nil
+	}
+	n.bucketsLock.Unlock()
+}
+
+func (n *KademliaNode) RunRPCServer() {
+	n.server = rpc.NewServer()
+	n.server.Register(n)
+	var err error
+	n.listener, err = net.Listen("tcp", n.Addr)
+	if err != nil {
+		logrus.Error(n.Addr, " listen error: ", err)
+		return
+	}
+	for {
+		conn, err := n.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logrus.Warn(n.Addr, " accept: ", err)
+			continue
+		}
+		go func(conn net.Conn) {
+			n.activeConnLock.Lock()
+			n.activeConn[conn] = struct{}{}
+			n.activeConnLock.Unlock()
+			internal.ServeConn(n.server, conn, n.stats.RecordRPC)
+			n.activeConnLock.Lock()
+			delete(n.activeConn, conn)
+			n.activeConnLock.Unlock()
+		}(conn)
+	}
+}
+
+func (n *KademliaNode) closeRPCLinks() {
+	n.activeConnLock.Lock()
+	for k := range n.activeConn {
+		k.Close()
+	}
+	n.activeConnLock.Unlock()
+}
+
+func (n *KademliaNode) maintain() {
+	go func() {
+		for n.online.Load() {
+			time.Sleep(republishInterval)
+			if n.online.Load() {
+				n.republish()
+			}
+		}
+	}()
+	go func() {
+		for n.online.Load() {
+			time.Sleep(refreshInterval)
+			if n.online.Load() {
+				n.refreshBuckets()
+			}
+		}
+	}()
+}
+
+// updateContact records that c is alive. As in the paper, a full bucket keeps its least
+// recently seen contact if that one still answers ping, and drops the new contact.
+func (n *KademliaNode) updateContact(c Contact) {
+	if c.Addr == "" || c.Addr == n.Addr {
+		return
+	}
+	idx := bucketIndex(n.Id, c.ID)
+	if idx < 0 {
+		// another address hashed to our own ID, which has no bucket
+		logrus.Warn(n.Addr, " updateContact: ", c.Addr, " has the same ID ", c.ID)
+		return
+	}
+	n.bucketsLock.Lock()
+	bucket := n.buckets[idx]
+	for i, old := range bucket {
+		if old.Addr == c.Addr {
+			n.buckets[idx] = append(append(bucket[:i:i], bucket[i+1:]...), c)
+			n.bucketsLock.Unlock()
+			return
+		}
+	}
+	if len(bucket) < KadK {
+		n.buckets[idx] = append(bucket, c)
+		n.bucketsLock.Unlock()
+		go n.pushCloserEntries(c)
+		return
+	}
+	oldest := bucket[0]
+	n.bucketsLock.Unlock()
+	go func() {
+		alive := linkTo(oldest).Ping(n.self()) == nil
+		n.bucketsLock.Lock()
+		defer n.bucketsLock.Unlock()
+		bucket := n.buckets[idx]
+		if len(bucket) == 0 || bucket[0].Addr != oldest.Addr {
+			return
+		}
+		if alive {
+			n.buckets[idx] = append(bucket[1:len(bucket):len(bucket)], oldest)
+		} else {
+			n.buckets[idx] = append(bucket[1:len(bucket):len(bucket)], c)
+			go n.pushCloserEntries(c)
+		}
+	}()
+}
+
+// pushCloserEntries stores the entries to which c is closer than us on c, so that a newly
+// joined node gets its data without waiting for the next republish.
+func (n *KademliaNode) pushCloserEntries(c Contact) {
+	if !n.online.Load() {
+		return
+	}
+	toPush := make(map[string]Entry)
+	n.dataLock.RLock()
+	for k, e := range n.data {
+		id := keyID(k)
+		if distance(c.ID, id) < distance(n.Id, id) {
+			toPush[k] = e.Entry
+		}
+	}
+	n.dataLock.RUnlock()
+	link := linkTo(c)
+	for k, e := range toPush {
+		if _, err := link.Store(n.self(), k, e); err != nil {
+			logrus.Warn(n.Addr, " pushCloserEntries: store to ", c.Addr, " failed with ", err)
+			return
+		}
+	}
+}
+
+func (n *KademliaNode) removeContact(c Contact) {
+	idx := bucketIndex(n.Id, c.ID)
+	if idx < 0 {
+		return
+	}
+	n.bucketsLock.Lock()
+	defer n.bucketsLock.Unlock()
+	bucket := n.buckets[idx]
+	for i, old := range bucket {
+		if old.Addr == c.Addr {
+			n.buckets[idx] = append(bucket[:i:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+// closestContacts returns at most count known contacts (including self) closest to target
+func (n *KademliaNode) closestContacts(target uint32, count int) []Contact {
+	n.bucketsLock.RLock()
+	contacts := []Contact{n.self()}
+	for _, bucket := range n.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	n.bucketsLock.RUnlock()
+	sortByDistance(contacts, target)
+	if len(contacts) > count {
+		contacts = contacts[:count]
+	}
+	return contacts
+}
+
+func sortByDistance(contacts []Contact, target uint32) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return distance(contacts[i].ID, target) < distance(contacts[j].ID, target)
+	})
+}
+
+type lookupResult struct {
+	closest []Contact
+	entry   *Entry
+	rounds  int
+}
+
+// lookup performs the iterative node lookup for target, querying KadAlpha contacts in
+// parallel each round. If key is not empty, nodes are asked for the value as well and
+// the newest version among the replies is returned in entry.
+func (n *KademliaNode) lookup(target uint32, key string) lookupResult {
+	type reply struct {
+		from     Contact
+		contacts []Contact
+		entry    *Entry
+		err      error
+	}
+	shortlist := n.closestContacts(target, KadK)
+	seen := make(map[string]bool)
+	queried := make(map[string]bool)
+	failed := make(map[string]bool)
+	for _, c := range shortlist {
+		seen[c.Addr] = true
+	}
+	var best *Entry
+	rounds := 0
+	for {
+		var batch []Contact
+		for _, c := range shortlist {
+			if len(batch) == KadAlpha {
+				break
+			}
+			if !queried[c.Addr] {
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		rounds++
+		replies := make(chan reply, len(batch))
+		for _, c := range batch {
+			queried[c.Addr] = true
+			go func(c Contact) {
+				r := reply{from: c}
+				if c.Addr == n.Addr {
+					r.contacts, r.entry = n.localFind(target, key)
+				} else if key == "" {
+					r.contacts, r.err = linkTo(c).FindNode(n.self(), target)
+				} else {
+					r.contacts, r.entry, r.err = linkTo(c).FindValue(n.self(), key)
+				}
+				replies <- r
+			}(c)
+		}
+		timeout := time.After(lookupRoundTimeout)
+	collect:
+		for range batch {
+			select {
+			case r := <-replies:
+				if r.err != nil {
+					logrus.Warn(n.Addr, " lookup: ", r.from.Addr, " failed with ", r.err)
+					failed[r.from.Addr] = true
+					n.removeContact(r.from)
+					continue
+				}
+				n.updateContact(r.from)
+				if r.entry != nil && (best == nil || r.entry.Version > best.Version) {
+					best = r.entry
+				}
+				for _, c := range r.contacts {
+					if !seen[c.Addr] {
+						seen[c.Addr] = true
+						shortlist = append(shortlist, c)
+					}
+				}
+			case <-timeout:
+				break collect
+			}
+		}
+		alive := shortlist[:0]
+		for _, c := range shortlist {
+			if !failed[c.Addr] {
+				alive = append(alive, c)
+			}
+		}
+		shortlist = alive
+		sortByDistance(shortlist, target)
+		if len(shortlist) > KadK {
+			shortlist = shortlist[:KadK]
+		}
+	}
+	var closest []Contact
+	for _, c := range shortlist {
+		if queried[c.Addr] && !failed[c.Addr] {
+			closest = append(closest, c)
+		}
+	}
+	return lookupResult{closest, best, rounds}
+}
+
+func (n *KademliaNode) localFind(target uint32, key string) ([]Contact, *Entry) {
+	contacts := n.closestContacts(target, KadK)
+	if key == "" {
+		return contacts, nil
+	}
+	n.dataLock.RLock()
+	defer n.dataLock.RUnlock()
+	if e, ok := n.data[key]; ok {
+		entry := e.Entry
+		return contacts, &entry
+	}
+	return contacts, nil
+}
+
+// storeLocal keeps entry if it is newer than what is stored, received telling whether it
+// was sent by another node. It returns whether the previously stored value was live.
+func (n *KademliaNode) storeLocal(key string, entry Entry, received bool) bool {
+	n.dataLock.Lock()
+	defer n.dataLock.Unlock()
+	now := clock()
+	old, ok := n.data[key]
+	if ok && old.Version > entry.Version {
+		return false
+	}
+	existed := ok && !old.Deleted
+	if !ok || old.Version != entry.Version {
+		old = &storedEntry{Entry: entry}
+		n.data[key] = old
+	}
+	old.lastStored = now
+	if received {
+		old.lastReceived = now
+	}
+	return existed
+}
+
+// storeToClosest stores entry on the k closest nodes of key and returns how many stores succeeded.
+func (n *KademliaNode) storeToClosest(key string, entry Entry) int {
+	res := n.lookup(keyID(key), "")
+	return n.storeTo(res.closest, key, entry)
+}
+
+// lookupKey is lookup for a user operation, which is recorded in the stats. The rounds
+// of the iterative lookup are counted as hops.
+func (n *KademliaNode) lookupKey(key string, findValue bool) lookupResult {
+	start := time.Now()
+	var res lookupResult
+	if findValue {
+		res = n.lookup(keyID(key), key)
+	} else {
+		res = n.lookup(keyID(key), "")
+	}
+	n.stats.RecordLookup(res.rounds, time.Since(start))
+	return res
+}
+
+func (n *KademliaNode) Stats() internal.NodeStats {
+	return n.stats.Snapshot()
+}
+
+func (n *KademliaNode) storeTo(contacts []Contact, key string, entry Entry) int {
+	var wg sync.WaitGroup
+	var succeeded atomic.Int32
+	for _, c := range contacts {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			if c.Addr == n.Addr {
+				n.storeLocal(key, entry, false)
+				succeeded.Add(1)
+				return
+			}
+			if _, err := linkTo(c).Store(n.self(), key, entry); err != nil {
+				logrus.Warn(n.Addr, " storeTo: store ", key, " to ", c.Addr, " failed with ", err)
+				n.removeContact(c)
+				return
+			}
+			succeeded.Add(1)
+		}(c)
+	}
+	wg.Wait()
+	return int(succeeded.Load())
+}
+
+// republish stores every entry that has not been stored by others since the last
+// round to the current k closest nodes, which also moves keys to newly joined nodes. It
+// returns the number of entries published. Only the stores of other nodes count, those
+// of our own republish would make every other round skip the entry.
+func (n *KademliaNode) republish() int {
+	now := clock()
+	toPublish := make(map[string]Entry)
+	n.dataLock.Lock()
+	for k, e := range n.data {
+		if e.Deleted && now.Sub(e.lastStored) > tombstoneExpire {
+			delete(n.data, k)
+			continue
+		}
+		if now.Sub(e.lastReceived) < republishInterval {
+			// someone else republished it during this round
+			continue
+		}
+		toPublish[k] = e.Entry
+	}
+	n.dataLock.Unlock()
+	published := 0
+	for k, e := range toPublish {
+		if !n.online.Load() {
+			break
+		}
+		n.storeToClosest(k, e)
+		published++
+	}
+	return published
+}
+
+// refreshBuckets looks up a random id in every bucket which is not full, starting from
+// the bucket of the closest neighbor since the nearer ones are expected to be empty.
+func (n *KademliaNode) refreshBuckets() {
+	n.bucketsLock.RLock()
+	var sizes [KadM]int
+	nearest := KadM
+	for i, bucket := range n.buckets {
+		sizes[i] = len(bucket)
+		if sizes[i] > 0 && i < nearest {
+			nearest = i
+		}
+	}
+	n.bucketsLock.RUnlock()
+	for i := nearest; i < KadM; i++ {
+		if sizes[i] >= KadK {
+			continue
+		}
+		target := n.Id ^ (1 << i) ^ (uint32(time.Now().UnixNano()) & ((1 << i) - 1))
+		n.lookup(target, "")
+	}
+}
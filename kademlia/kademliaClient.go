@@ -0,0 +1,63 @@
+package kademlia
+
+import (
+	"net"
+	"net/rpc"
+)
+
+// kadLink dials the remote node for every call, since contacts in the k-buckets
+// change much more often than the fingers of chord.
+type kadLink struct {
+	Contact
+}
+
+func linkTo(c Contact) *kadLink {
+	return &kadLink{c}
+}
+
+func (link *kadLink) Call(method string, args interface{}, reply interface{}) error {
+	const NodeServName = "KademliaNode."
+	conn, err := net.DialTimeout("tcp", link.Addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	return client.Call(NodeServName+method, args, reply)
+}
+
+func (link *kadLink) Ping(sender Contact) error {
+	var ok bool
+	return link.Call("Ping", PingRequest{Sender: sender}, &ok)
+}
+
+func (link *kadLink) FindNode(sender Contact, target uint32) ([]Contact, error) {
+	var contacts []Contact
+	err := link.Call("FindNode", FindNodeRequest{
+		Sender: sender,
+		Target: target,
+	}, &contacts)
+	return contacts, err
+}
+
+func (link *kadLink) FindValue(sender Contact, key string) ([]Contact, *Entry, error) {
+	var reply FindValueReply
+	err := link.Call("FindValue", FindValueRequest{
+		Sender: sender,
+		Key:    key,
+	}, &reply)
+	if err != nil || !reply.Found {
+		return reply.Contacts, nil, err
+	}
+	return reply.Contacts, &reply.Entry, nil
+}
+
+func (link *kadLink) Store(sender Contact, key string, entry Entry) (bool, error) {
+	var existed bool
+	err := link.Call("Store", StoreRequest{
+		Sender: sender,
+		Key:    key,
+		Entry:  entry,
+	}, &existed)
+	return existed, err
+}
@@ -0,0 +1,67 @@
+package kademlia
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+type PingRequest struct {
+	Sender Contact
+}
+
+func (n *KademliaNode) Ping(request PingRequest, reply *bool) error {
+	n.updateContact(request.Sender)
+	*reply = true
+	return nil
+}
+
+type FindNodeRequest struct {
+	Sender Contact
+	Target uint32
+}
+
+func (n *KademliaNode) FindNode(request FindNodeRequest, reply *[]Contact) error {
+	n.updateContact(request.Sender)
+	*reply = n.closestContacts(request.Target, KadK)
+	return nil
+}
+
+type FindValueRequest struct {
+	Sender Contact
+	Key    string
+}
+
+type FindValueReply struct {
+	Contacts []Contact
+	Found    bool
+	Entry    Entry
+}
+
+func (n *KademliaNode) FindValue(request FindValueRequest, reply *FindValueReply) error {
+	n.updateContact(request.Sender)
+	contacts, entry := n.localFind(keyID(request.Key), request.Key)
+	reply.Contacts = contacts
+	if entry != nil {
+		reply.Found = true
+		reply.Entry = *entry
+	}
+	return nil
+}
+
+type StoreRequest struct {
+	Sender Contact
+	Key    string
+	Entry  Entry
+}
+
+func (n *KademliaNode) Store(request StoreRequest, existed *bool) error {
+	if !n.online.Load() {
+		err := fmt.Errorf("%s is not in the network", n.Addr)
+		logrus.Warn(n.Addr, " Store: ", err)
+		return err
+	}
+	n.updateContact(request.Sender)
+	*existed = n.storeLocal(request.Key, request.Entry, true)
+	return nil
+}
@@ -0,0 +1,118 @@
+package kademlia
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+const P = 21000
+
+func makeLocalAddr(port int) string {
+	return fmt.Sprintf("127.0.0.1:%d", P+port)
+}
+
+func TestBucketIndex(t *testing.T) {
+	if idx := bucketIndex(0b1010, 0b1010); idx != -1 {
+		t.Errorf("bucket of self should be -1, got %d", idx)
+	}
+	if idx := bucketIndex(0b1010, 0b1011); idx != 0 {
+		t.Errorf("expected bucket 0, got %d", idx)
+	}
+	if idx := bucketIndex(0, 1<<31); idx != 31 {
+		t.Errorf("expected bucket 31, got %d", idx)
+	}
+}
+
+func TestIDCollision(t *testing.T) {
+	n := CreateKademliaNode(makeLocalAddr(0))
+	n.updateContact(Contact{n.Id, makeLocalAddr(1)})
+	for i, bucket := range n.buckets {
+		if len(bucket) > 0 {
+			t.Errorf("contact with our own ID should not be kept, found in bucket %d", i)
+		}
+	}
+}
+
+func TestSmallNetwork(t *testing.T) {
+	const N, M = 10, 50
+	var nodes [N]*KademliaNode
+	for i := 0; i < N; i++ {
+		nodes[i] = CreateKademliaNode(makeLocalAddr(i))
+		nodes[i].Run()
+	}
+	time.Sleep(200 * time.Millisecond)
+	nodes[0].Create()
+	for i := 1; i < N; i++ {
+		if !nodes[i].Join(makeLocalAddr(i / 2)) {
+			t.Fatalf("node %d failed to join", i)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for i := 0; i < M; i++ {
+		if !nodes[i%N].Put(fmt.Sprint(i), fmt.Sprint(i)) {
+			t.Errorf("put %d failed", i)
+		}
+	}
+	for i := 0; i < M; i++ {
+		ok, val := nodes[(i+3)%N].Get(fmt.Sprint(i))
+		if !ok || val != fmt.Sprint(i) {
+			t.Errorf("get %d: %v %s", i, ok, val)
+		}
+	}
+	for i := 0; i < M; i += 2 {
+		if !nodes[(i+5)%N].Delete(fmt.Sprint(i)) {
+			t.Errorf("delete %d failed", i)
+		}
+	}
+	if nodes[0].Delete("0") {
+		t.Errorf("deleting a deleted key should fail")
+	}
+	for _, v := range [...]int{2, 5, 7} {
+		nodes[v].ForceQuit()
+	}
+	nodes[3].Quit()
+	time.Sleep(500 * time.Millisecond)
+	for i := 0; i < M; i++ {
+		ok, val := nodes[i%2].Get(fmt.Sprint(i))
+		if i%2 == 0 && ok {
+			t.Errorf("deleted key %d still exists", i)
+		}
+		if i%2 == 1 && (!ok || val != fmt.Sprint(i)) {
+			t.Errorf("get %d after quit: %v %s", i, ok, val)
+		}
+	}
+	for i := 0; i < N; i++ {
+		nodes[i].Quit()
+	}
+}
+
+func TestRepublishRate(t *testing.T) {
+	now := time.Now()
+	clock = func() time.Time { return now }
+	defer func() { clock = time.Now }()
+	a, b := CreateKademliaNode(makeLocalAddr(50)), CreateKademliaNode(makeLocalAddr(51))
+	a.Run()
+	b.Run()
+	defer a.Quit()
+	defer b.Quit()
+	time.Sleep(200 * time.Millisecond)
+	a.Create()
+	if !b.Join(a.Addr) {
+		t.Fatal("join failed")
+	}
+	if !a.Put("k", "v") {
+		t.Fatal("put failed")
+	}
+	// a republishes every round, which b receives and so leaves to a
+	const rounds = 6
+	var byA, byB int
+	for i := 0; i < rounds; i++ {
+		now = now.Add(republishInterval)
+		byA += a.republish()
+		byB += b.republish()
+	}
+	if byA != rounds || byB != 0 {
+		t.Errorf("%d republishes by a and %d by b in %d rounds", byA, byB, rounds)
+	}
+}
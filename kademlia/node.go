@@ -0,0 +1,126 @@
+package kademlia
+
+import (
+	"dht/internal"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Impl. of DHT interface
+
+func keyID(key string) uint32 {
+	return internal.Str_uint32_sha1(key)
+}
+
+func (n *KademliaNode) Run() {
+	go n.RunRPCServer()
+}
+
+func (n *KademliaNode) Create() {
+	logrus.Infof("%s, %d Create new network", n.Addr, n.Id)
+	n.online.Store(true)
+	n.maintain()
+}
+
+func (n *KademliaNode) Join(addr string) bool {
+	logrus.Infof("%s, %d Join %s ...", n.Addr, n.Id, addr)
+	bootstrap := makeContact(addr)
+	if err := linkTo(bootstrap).Ping(n.self()); err != nil {
+		logrus.Error(n.Addr, " Join: failed to ping ", addr, " ", err)
+		return false
+	}
+	n.updateContact(bootstrap)
+	n.online.Store(true)
+	// looking up self fills the buckets near us and announces us to our neighbors
+	n.lookup(n.Id, "")
+	n.refreshBuckets()
+	n.maintain()
+	return true
+}
+
+func (n *KademliaNode) Quit() {
+	if !n.online.Load() {
+		return
+	}
+	logrus.Info(n.Addr, " start Quit")
+	n.online.Store(false)
+	// hand over our entries so that they still have k replicas without us
+	n.dataLock.RLock()
+	entries := make(map[string]Entry, len(n.data))
+	for k, e := range n.data {
+		entries[k] = e.Entry
+	}
+	n.dataLock.RUnlock()
+	const handOverWorkers = 16
+	keys := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < handOverWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range keys {
+				n.storeToClosest(k, entries[k])
+			}
+		}()
+	}
+	for k := range entries {
+		keys <- k
+	}
+	close(keys)
+	wg.Wait()
+	n.shutdown()
+}
+
+func (n *KademliaNode) ForceQuit() {
+	if !n.online.Load() {
+		return
+	}
+	logrus.Warn(n.Addr, " start ForceQuit")
+	n.online.Store(false)
+	n.shutdown()
+}
+
+func (n *KademliaNode) shutdown() {
+	if n.listener != nil {
+		if err := n.listener.Close(); err != nil {
+			logrus.Error(n.Addr, " close listener with error: ", err)
+		}
+	}
+	n.closeRPCLinks()
+	n.Clear()
+}
+
+func (n *KademliaNode) Put(key string, value string) bool {
+	res := n.lookupKey(key, false)
+	cnt := n.storeTo(res.closest, key, Entry{Value: value, Version: time.Now().UnixNano()})
+	if cnt == 0 {
+		logrus.Error(n.Addr, " Put: failed to store ", key, " to any node")
+		return false
+	}
+	logrus.Infof("%s Put: stored %s [%d] on %d nodes", n.Addr, key, keyID(key), cnt)
+	return true
+}
+
+func (n *KademliaNode) Get(key string) (bool, string) {
+	res := n.lookupKey(key, true)
+	if res.entry == nil || res.entry.Deleted {
+		logrus.Error(n.Addr, " Get: unknown key ", key)
+		return false, ""
+	}
+	return true, res.entry.Value
+}
+
+func (n *KademliaNode) Delete(key string) bool {
+	res := n.lookupKey(key, true)
+	if res.entry == nil || res.entry.Deleted {
+		logrus.Error(n.Addr, " Delete: key ", key, " not exist")
+		return false
+	}
+	if n.storeTo(res.closest, key, Entry{Version: time.Now().UnixNano(), Deleted: true}) == 0 {
+		logrus.Error(n.Addr, " Delete: failed to store tombstone of ", key)
+		return false
+	}
+	return true
+}
@@ -1,35 +1,90 @@
 package main
 
 import (
+	"dht/chord"
 	"flag"
+	"fmt"
+	"io"
 	"math/rand"
 	"os"
+	"strings"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 var (
-	help     bool
-	testName string
+	help         bool
+	testName     string
+	scenarioPath string
+	protocol     string
+	compare      string
+	logPath      string
+	crawlAddr    string
+	crawlFormat  string
 )
 
 func init() {
 	flag.BoolVar(&help, "help", false, "help")
 	flag.StringVar(&testName, "test", "", "which test(s) do you want to run: basic/advance/all")
+	flag.StringVar(&protocol, "protocol", "chord", "which DHT protocol to test: "+strings.Join(protocolNames(), "/"))
+	flag.StringVar(&compare, "compare", "", "comma separated protocols to run the scenario against and compare")
+	flag.StringVar(&logPath, "log", "dht.log", "file the nodes log to")
+	flag.StringVar(&crawlAddr, "crawl", "", "crawl the chord ring from the node at this address and report its consistency")
+	flag.StringVar(&crawlFormat, "format", "text", "format of the crawl report: text/json/dot")
+	flag.StringVar(&scenarioPath, "scenario", "", "run the test scenario described in this JSON or YAML file instead")
 
 	flag.Usage = usage
+}
+
+// parseFlags is called by main rather than init, so that the tests of the package run
+// with the flags of go test.
+func parseFlags() {
 	flag.Parse()
 
-	if help || (testName != "basic" && testName != "advance" && testName != "all") {
+	if help || (crawlAddr == "" && scenarioPath == "" && testName != "basic" && testName != "advance" && testName != "all") ||
+		protocols[protocol] == nil || (compare != "" && scenarioPath == "") ||
+		(crawlFormat != "text" && crawlFormat != "json" && crawlFormat != "dot") {
 		flag.Usage()
 		os.Exit(0)
 	}
+	for _, name := range compareList() {
+		if protocols[name] == nil {
+			flag.Usage()
+			os.Exit(0)
+		}
+	}
+
+	// the log file is only for the nodes run by the tests, crawling runs none
+	if crawlAddr == "" {
+		f, err := os.Create(logPath)
+		if err != nil {
+			red.Println("Failed to create log file:", err)
+			os.Exit(1)
+		}
+		logrus.SetOutput(f)
+	}
 
 	rand.Seed(time.Now().UnixNano())
 }
 
 func main() {
+	parseFlags()
+	if crawlAddr != "" {
+		crawl(crawlAddr, crawlFormat)
+		return
+	}
 	yellow.Printf("Welcome to DHT-2023 Test Program!\n\n")
 
+	if compare != "" {
+		compareProtocols(scenarioPath, compareList())
+		return
+	}
+	if scenarioPath != "" {
+		runScenario(scenarioPath)
+		return
+	}
+
 	var basicFailRate float64
 	var forceQuitFailRate float64
 	var QASFailRate float64
@@ -110,6 +165,110 @@ func main() {
 	}
 }
 
+func runScenario(path string) {
+	s, err := loadScenario(path)
+	if err != nil {
+		red.Println("Failed to load scenario:", err)
+		os.Exit(1)
+	}
+	res := scenarioTest(s)
+	if res.panicked {
+		red.Printf("Scenario %s Panicked.", s.Name)
+		os.Exit(0)
+	}
+	if res.err != nil {
+		red.Printf("Scenario %s stopped: %v\n", s.Name, res.err)
+		os.Exit(1)
+	}
+
+	cyan.Println("\nFinal print:")
+	if !res.passed(s) {
+		red.Printf("Scenario %s failed with fail rate %.4f\n", s.Name, res.failRate())
+	} else {
+		green.Printf("Scenario %s passed with fail rate %.4f\n", s.Name, res.failRate())
+	}
+}
+
+func compareList() []string {
+	if compare == "" {
+		return nil
+	}
+	return strings.Split(compare, ",")
+}
+
+// compareProtocols runs the same scenario against every protocol and prints the results side by side.
+func compareProtocols(path string, names []string) {
+	s, err := loadScenario(path)
+	if err != nil {
+		red.Println("Failed to load scenario:", err)
+		os.Exit(1)
+	}
+	results := runProtocols(s, names, afterTestSleepTime)
+	cyan.Printf("\nComparison of scenario %s:\n", s.Name)
+	writeComparison(os.Stdout, s, names, results)
+}
+
+// runProtocols runs the scenario against every protocol in turn, pausing in between so
+// that the ports of the nodes are free again.
+func runProtocols(s *scenario, names []string, pause time.Duration) []scenarioResult {
+	results := make([]scenarioResult, len(names))
+	for i, name := range names {
+		if i > 0 {
+			time.Sleep(pause)
+		}
+		yellow.Printf("Protocol %s:\n", name)
+		protocol = name
+		results[i] = scenarioTest(s)
+	}
+	return results
+}
+
+// writeComparison writes a header and a row of the results of each protocol.
+func writeComparison(w io.Writer, s *scenario, names []string, results []scenarioResult) {
+	fmt.Fprintf(w, "%-10s %8s %10s %10s %12s %12s %12s\n",
+		"protocol", "result", "fail rate", "avg hops", "lookup (ms)", "op (ms)", "messages")
+	for i, name := range names {
+		res := &results[i]
+		var avgHops, lookupMs, opMs float64
+		if res.stats.Lookups > 0 {
+			avgHops = float64(res.stats.LookupHops) / float64(res.stats.Lookups)
+			lookupMs = float64(res.stats.LookupTime.Microseconds()) / 1000 / float64(res.stats.Lookups)
+		}
+		if res.opCnt > 0 {
+			opMs = float64(res.opTime.Microseconds()) / 1000 / float64(res.opCnt)
+		}
+		result := "passed"
+		if res.panicked {
+			result = "panicked"
+		} else if res.err != nil {
+			result = "error"
+		} else if !res.passed(s) {
+			result = "failed"
+		}
+		fmt.Fprintf(w, "%-10s %8s %10.4f %10.2f %12.3f %12.3f %12d\n",
+			name, result, res.failRate(), avgHops, lookupMs, opMs, res.stats.RPCServed)
+	}
+}
+
+func crawl(addr, format string) {
+	report, err := chord.Crawl(addr)
+	if err != nil {
+		red.Println("Failed to crawl:", err)
+		os.Exit(1)
+	}
+	switch format {
+	case "json":
+		report.WriteJSON(os.Stdout)
+	case "dot":
+		report.WriteDOT(os.Stdout)
+	default:
+		report.WriteText(os.Stdout)
+	}
+	if !report.Healthy() {
+		os.Exit(2)
+	}
+}
+
 func usage() {
 	flag.PrintDefaults()
 }
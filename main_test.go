@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScenario(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadScenario(t *testing.T) {
+	json := `{
+	  "name": "nested",
+	  "steps": [
+	    {"action": "run", "count": 3},
+	    {"action": "create"},
+	    {"action": "repeat", "times": 2, "steps": [
+	      {"action": "repeat", "times": 3, "steps": [
+	        {"action": "put", "count": 5},
+	        {"action": "get", "maxFailRate": 0.1}
+	      ]},
+	      {"action": "wait", "sleep": "200ms"}
+	    ]}
+	  ]
+	}`
+	yaml := `name: nested
+steps:
+  - {action: run, count: 3}
+  - {action: create}
+  - action: repeat
+    times: 2
+    steps:
+      - action: repeat
+        times: 3
+        steps:
+          - {action: put, count: 5}
+          - {action: get, maxFailRate: 0.1}
+      - {action: wait, sleep: 200ms}
+`
+	fromJSON, err := loadScenario(writeScenario(t, "s.json", json))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"s.yaml", "s.yml"} {
+		fromYAML, err := loadScenario(writeScenario(t, name, yaml))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(fromJSON, fromYAML) {
+			t.Errorf("%s differs from the JSON:\n%+v\n%+v", name, fromYAML, fromJSON)
+		}
+	}
+	if fromJSON.FirstPort != firstPort || fromJSON.KeyLength != lengthOfKeyValue || fromJSON.MaxFailRate != 1 {
+		t.Errorf("defaults: %+v", fromJSON)
+	}
+	outer := fromJSON.Steps[2]
+	inner := outer.Steps[0]
+	if outer.Times != 2 || inner.Times != 3 || len(inner.Steps) != 2 || inner.Steps[0].Count != 5 {
+		t.Errorf("nested repeat: %+v", outer)
+	}
+	if rate := inner.Steps[1].MaxFailRate; rate == nil || *rate != 0.1 {
+		t.Errorf("max fail rate of the nested get: %v", rate)
+	}
+	if sleep := time.Duration(outer.Steps[1].Sleep); sleep != 200*time.Millisecond {
+		t.Errorf("sleep of the nested wait: %v", sleep)
+	}
+}
+
+func TestLoadScenarioErrors(t *testing.T) {
+	tests := []struct {
+		name, file, content string
+		// err is a part of the error
+		err string
+	}{
+		{"json syntax", "s.json", `{"steps": [`, "s.json"},
+		{"json duration", "s.json", `{"steps": [{"action": "wait", "sleep": 10}]}`, `like "10s"`},
+		{"yaml duration", "s.yaml", "steps:\n  - {action: wait, sleep: soon}\n", "line 2"},
+		{"unknown action", "s.json", `{"steps": [{"action": "jump"}]}`, `step 0: unknown action "jump"`},
+		{"missing action", "s.yaml", "steps:\n  - {count: 3}\n", `step 0: unknown action ""`},
+		{"missing count", "s.json", `{"steps": [{"action": "create"}, {"action": "join"}]}`, "step 1 (join): count should be positive"},
+		{"negative get", "s.yaml", "steps:\n  - {action: get, count: -1}\n", "step 0 (get): count should not be negative"},
+		{"missing times", "s.json", `{"steps": [{"action": "repeat", "steps": []}]}`, "step 0 (repeat): times should be positive"},
+		{"nested", "s.yaml", `steps:
+  - {action: run, count: 1}
+  - action: repeat
+    times: 1
+    steps:
+      - action: repeat
+        times: 2
+        steps:
+          - {action: quit}
+`, "step 1 (repeat): step 0 (repeat): step 0 (quit): count should be positive"},
+	}
+	for _, test := range tests {
+		_, err := loadScenario(writeScenario(t, test.file, test.content))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestScenarioFiles(t *testing.T) {
+	fromJSON, err := loadScenario("scenarios/churn.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromYAML, err := loadScenario("scenarios/churn.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromJSON, fromYAML) {
+		t.Errorf("churn.yaml differs from churn.json:\n%+v\n%+v", fromYAML, fromJSON)
+	}
+}
+
+func TestProtocols(t *testing.T) {
+	names := protocolNames()
+	if !sort.StringsAreSorted(names) || len(names) != len(protocols) {
+		t.Errorf("protocol names %v", names)
+	}
+	for _, name := range []string{"chord", "kademlia"} {
+		if protocols[name] == nil {
+			t.Errorf("%s is not registered", name)
+		}
+	}
+}
+
+func TestCompareProtocols(t *testing.T) {
+	defer func(p string) { protocol = p }(protocol)
+	s := &scenario{
+		Name:        "tiny",
+		FirstPort:   23000,
+		KeyLength:   10,
+		MaxFailRate: 0.5,
+		Steps: []scenarioStep{
+			{Action: "run", Count: 3},
+			{Action: "create"},
+			{Action: "join", Count: 2, Sleep: duration(200 * time.Millisecond)},
+			{Action: "wait", Sleep: duration(time.Second)},
+			{Action: "put", Count: 10},
+			{Action: "get"},
+		},
+	}
+	names := protocolNames()
+	results := runProtocols(s, names, time.Second)
+	var out bytes.Buffer
+	writeComparison(&out, s, names, results)
+	lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+	if len(lines) != len(names)+1 || !strings.HasPrefix(lines[0], "protocol") {
+		t.Fatalf("comparison table:\n%s", out.String())
+	}
+	for i, name := range names {
+		fields := strings.Fields(lines[i+1])
+		if len(fields) != 7 || fields[0] != name || fields[1] != "passed" {
+			t.Errorf("row of %s: %q", name, lines[i+1])
+			continue
+		}
+		if rate := fmt.Sprintf("%.4f", results[i].failRate()); fields[2] != rate {
+			t.Errorf("fail rate of %s: %s, want %s", name, fields[2], rate)
+		}
+		if messages, err := strconv.Atoi(fields[6]); err != nil || messages <= 0 {
+			t.Errorf("messages of %s: %s", name, fields[6])
+		}
+		// the joins, the puts and the gets are counted, the puts and the gets timed
+		if results[i].totalCnt != 2+10+10 || results[i].opCnt != 20 {
+			t.Errorf("operations of %s: %d counted, %d timed", name, results[i].totalCnt, results[i].opCnt)
+		}
+	}
+}
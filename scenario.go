@@ -0,0 +1,363 @@
+package main
+
+import (
+	"dht/internal"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// duration is a time.Duration that is written as "200ms", "10s", ... in scenario files.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"10s\": %s", string(b))
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalYAML(node *yaml.Node) error {
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return fmt.Errorf("line %d: duration should be a string like \"10s\"", node.Line)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*d = duration(v)
+	return nil
+}
+
+/*
+ * A scenario file describes a test as a sequence of steps, in JSON or, if the file name
+ * ends with .yaml or .yml, in YAML with the same field names, e.g.
+ *
+ *	{
+ *	  "name": "small churn",
+ *	  "maxFailRate": 0.05,
+ *	  "steps": [
+ *	    {"action": "run", "count": 20},
+ *	    {"action": "create"},
+ *	    {"action": "join", "count": 19, "sleep": "1s"},
+ *	    {"action": "wait", "sleep": "10s"},
+ *	    {"action": "put", "count": 200},
+ *	    {"action": "repeat", "times": 3, "steps": [
+ *	      {"action": "forceQuit", "count": 2, "sleep": "500ms"},
+ *	      {"action": "get", "maxFailRate": 0.1}
+ *	    ]}
+ *	  ]
+ *	}
+ *
+ * Actions:
+ *   run       start "count" new nodes (NewNode + Run)
+ *   create    let the first running node create the network
+ *   join      join "count" running nodes to a random node in the network
+ *   put       put "count" random key-value pairs
+ *   get       get "count" known keys and check the values (0 means all)
+ *   delete    delete "count" known keys
+ *   quit      quit "count" random nodes in the network
+ *   forceQuit force quit "count" random nodes in the network
+ *   wait      sleep for "sleep"
+ *   repeat    run "steps" for "times" times
+ *
+ * "sleep" is waited after every single operation of join/quit/forceQuit and once for wait.
+ * "maxFailRate" of a step is checked against that step only, the one of the scenario
+ * against all operations. A create or join without a running node left to add makes the
+ * scenario fail with an error.
+ */
+
+type scenarioStep struct {
+	Action      string         `json:"action" yaml:"action"`
+	Count       int            `json:"count" yaml:"count"`
+	Sleep       duration       `json:"sleep" yaml:"sleep"`
+	MaxFailRate *float64       `json:"maxFailRate" yaml:"maxFailRate"`
+	Times       int            `json:"times" yaml:"times"`
+	Steps       []scenarioStep `json:"steps" yaml:"steps"`
+}
+
+type scenario struct {
+	Name        string         `json:"name" yaml:"name"`
+	FirstPort   int            `json:"firstPort" yaml:"firstPort"`
+	KeyLength   int            `json:"keyLength" yaml:"keyLength"`
+	MaxFailRate float64        `json:"maxFailRate" yaml:"maxFailRate"`
+	Steps       []scenarioStep `json:"steps" yaml:"steps"`
+}
+
+func loadScenario(path string) (*scenario, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &scenario{
+		FirstPort:   firstPort,
+		KeyLength:   lengthOfKeyValue,
+		MaxFailRate: 1,
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, s)
+	default:
+		err = json.Unmarshal(raw, s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validateSteps(s.Steps); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+func validateSteps(steps []scenarioStep) error {
+	for i, step := range steps {
+		switch step.Action {
+		case "run", "join", "put", "delete", "quit", "forceQuit":
+			if step.Count <= 0 {
+				return fmt.Errorf("step %d (%s): count should be positive", i, step.Action)
+			}
+		case "get":
+			if step.Count < 0 {
+				return fmt.Errorf("step %d (get): count should not be negative", i)
+			}
+		case "create", "wait":
+		case "repeat":
+			if step.Times <= 0 {
+				return fmt.Errorf("step %d (repeat): times should be positive", i)
+			}
+			if err := validateSteps(step.Steps); err != nil {
+				return fmt.Errorf("step %d (repeat): %w", i, err)
+			}
+		default:
+			return fmt.Errorf("step %d: unknown action %q", i, step.Action)
+		}
+	}
+	return nil
+}
+
+/* ------ Struct "scenarioRunner" ------ */
+type scenarioRunner struct {
+	s *scenario
+
+	nodes          []dhtNode
+	nodeAddresses  []string
+	nodesInNetwork []int
+	nextJoinNode   int
+	kvMap          map[string]string
+	// left holds the nodes which have quit, so they are not quit again at the end
+	left map[int]bool
+
+	failedCnt, totalCnt int
+	stepFailed          bool
+
+	opCnt  int
+	opTime time.Duration
+}
+
+// timed runs a Put/Get/Delete and adds its latency to the runner.
+func (r *scenarioRunner) timed(op func() bool) bool {
+	start := time.Now()
+	ok := op()
+	r.opTime += time.Since(start)
+	r.opCnt++
+	return ok
+}
+
+func (r *scenarioRunner) randomNodeInNetwork() dhtNode {
+	return r.nodes[r.nodesInNetwork[rand.Intn(len(r.nodesInNetwork))]]
+}
+
+// runSteps stops at the first step which cannot be run on the current nodes.
+func (r *scenarioRunner) runSteps(steps []scenarioStep, round string) error {
+	for i, step := range steps {
+		msg := fmt.Sprintf("%s%d %s", round, i+1, step.Action)
+		info := testInfo{msg: msg}
+		switch step.Action {
+		case "run":
+			for j := 0; j < step.Count; j++ {
+				port := r.s.FirstPort + len(r.nodes)
+				r.nodes = append(r.nodes, NewNode(port))
+				r.nodeAddresses = append(r.nodeAddresses, portToAddr(localAddress, port))
+				go r.nodes[len(r.nodes)-1].Run()
+			}
+			time.Sleep(basicTestAfterRunSleepTime)
+			continue
+		case "create":
+			if r.nextJoinNode >= len(r.nodes) {
+				return fmt.Errorf("%s: no running node to create the network", msg)
+			}
+			r.nodes[r.nextJoinNode].Create()
+			r.nodesInNetwork = append(r.nodesInNetwork, r.nextJoinNode)
+			r.nextJoinNode++
+			continue
+		case "join":
+			cyan.Printf("Start joining (%s)\n", msg)
+			for j := 0; j < step.Count; j++ {
+				if r.nextJoinNode >= len(r.nodes) {
+					return fmt.Errorf("%s: no more running nodes to join", msg)
+				}
+				if len(r.nodesInNetwork) == 0 {
+					return fmt.Errorf("%s: join before the network is created", msg)
+				}
+				addr := r.nodeAddresses[r.nodesInNetwork[rand.Intn(len(r.nodesInNetwork))]]
+				if !r.nodes[r.nextJoinNode].Join(addr) {
+					info.fail()
+				} else {
+					info.success()
+				}
+				r.nodesInNetwork = append(r.nodesInNetwork, r.nextJoinNode)
+				r.nextJoinNode++
+				time.Sleep(time.Duration(step.Sleep))
+			}
+		case "put":
+			cyan.Printf("Start putting (%s)\n", msg)
+			for j := 0; j < step.Count; j++ {
+				key := randString(r.s.KeyLength)
+				value := randString(r.s.KeyLength)
+				r.kvMap[key] = value
+				node := r.randomNodeInNetwork()
+				if !r.timed(func() bool { return node.Put(key, value) }) {
+					info.fail()
+				} else {
+					info.success()
+				}
+			}
+		case "get":
+			cyan.Printf("Start getting (%s)\n", msg)
+			cnt := 0
+			for key, value := range r.kvMap {
+				if step.Count > 0 && cnt == step.Count {
+					break
+				}
+				node := r.randomNodeInNetwork()
+				var res string
+				ok := r.timed(func() (ok bool) {
+					ok, res = node.Get(key)
+					return
+				})
+				if !ok || res != value {
+					info.fail()
+				} else {
+					info.success()
+				}
+				cnt++
+			}
+		case "delete":
+			cyan.Printf("Start deleting (%s)\n", msg)
+			for j := 0; j < step.Count; j++ {
+				for key := range r.kvMap {
+					delete(r.kvMap, key)
+					node := r.randomNodeInNetwork()
+					if !r.timed(func() bool { return node.Delete(key) }) {
+						info.fail()
+					} else {
+						info.success()
+					}
+					break
+				}
+			}
+		case "quit", "forceQuit":
+			cyan.Printf("Start quitting (%s)\n", msg)
+			for j := 0; j < step.Count && len(r.nodesInNetwork) > 1; j++ {
+				idxInArray := rand.Intn(len(r.nodesInNetwork))
+				idx := r.nodesInNetwork[idxInArray]
+				if step.Action == "quit" {
+					r.nodes[idx].Quit()
+				} else {
+					r.nodes[idx].ForceQuit()
+				}
+				r.left[idx] = true
+				r.nodesInNetwork = removeFromArray(r.nodesInNetwork, idxInArray)
+				time.Sleep(time.Duration(step.Sleep))
+			}
+			green.Printf("%s passed.\n", msg)
+			continue
+		case "wait":
+			time.Sleep(time.Duration(step.Sleep))
+			continue
+		case "repeat":
+			for t := 1; t <= step.Times; t++ {
+				cyan.Printf("%s round %d\n", msg, t)
+				if err := r.runSteps(step.Steps, fmt.Sprintf("%s%d.%d.", round, i+1, t)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		info.finish(&r.failedCnt, &r.totalCnt)
+		if step.MaxFailRate != nil && info.totalCnt > 0 &&
+			float64(info.failedCnt)/float64(info.totalCnt) > *step.MaxFailRate {
+			red.Printf("%s exceeded max fail rate %.4f\n", msg, *step.MaxFailRate)
+			r.stepFailed = true
+		}
+	}
+	return nil
+}
+
+type scenarioResult struct {
+	panicked bool
+	// err is set if a step could not be run, e.g. join without running nodes
+	err        error
+	stepFailed bool
+	failedCnt  int
+	totalCnt   int
+
+	opCnt  int
+	opTime time.Duration
+	stats  internal.NodeStats
+}
+
+func (res *scenarioResult) failRate() float64 {
+	if res.totalCnt == 0 {
+		return 0
+	}
+	return float64(res.failedCnt) / float64(res.totalCnt)
+}
+
+func (res *scenarioResult) passed(s *scenario) bool {
+	return !res.panicked && res.err == nil && !res.stepFailed && res.failRate() <= s.MaxFailRate
+}
+
+// scenarioTest runs the scenario and returns whether it panicked or stopped with an error,
+// whether some step exceeded its own threshold, the failed/total operation counts and the
+// stats of all nodes.
+func scenarioTest(s *scenario) (res scenarioResult) {
+	yellow.Printf("Start Scenario %s\n", s.Name)
+
+	r := &scenarioRunner{s: s, kvMap: make(map[string]string), left: make(map[int]bool)}
+
+	defer func() {
+		if p := recover(); p != nil {
+			red.Println("Program panicked with", p)
+			res.panicked = true
+		}
+		/* All nodes quit. */
+		for i, node := range r.nodes {
+			if !r.left[i] {
+				node.Quit()
+			}
+			if sn, ok := node.(statsNode); ok {
+				res.stats.Add(sn.Stats())
+			}
+		}
+		res.stepFailed, res.failedCnt, res.totalCnt = r.stepFailed, r.failedCnt, r.totalCnt
+		res.opCnt, res.opTime = r.opCnt, r.opTime
+	}()
+
+	if res.err = r.runSteps(s.Steps, ""); res.err != nil {
+		red.Println("Scenario stopped:", res.err)
+	}
+	return
+}
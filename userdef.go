@@ -2,6 +2,9 @@ package main
 
 import (
 	"dht/chord"
+	"dht/internal"
+	"dht/kademlia"
+	"sort"
 )
 
 /*
@@ -10,7 +13,30 @@ import (
  * You can use the "naive.Node" struct as a reference to implement your own struct.
  */
 
+// protocols are the DHT implementations which can be selected by name with -protocol.
+var protocols = map[string]func(addr string) dhtNode{
+	"chord": func(addr string) dhtNode {
+		return chord.CreateChordNode(addr)
+	},
+	"kademlia": func(addr string) dhtNode {
+		return kademlia.CreateKademliaNode(addr)
+	},
+}
+
+// statsNode is implemented by nodes which count their lookups and messages.
+type statsNode interface {
+	Stats() internal.NodeStats
+}
+
+func protocolNames() []string {
+	names := make([]string, 0, len(protocols))
+	for name := range protocols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func NewNode(port int) dhtNode {
-	// Todo: create a node and then return it.
-	return chord.CreateChordNode(portToAddr(localAddress, port))
+	return protocols[protocol](portToAddr(localAddress, port))
 }